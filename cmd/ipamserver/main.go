@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	_ "github.com/lib/pq"
+
+	"github.com/zinrai/ipam-mvp-go/internal/config"
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/consul"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/db"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/memory"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/persistence"
+	"github.com/zinrai/ipam-mvp-go/internal/interface/api"
+	"github.com/zinrai/ipam-mvp-go/internal/usecase"
+)
+
+func main() {
+	configPath := flag.String("config", "config.yaml", "path to the configuration file")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(cfg, flag.Args()[1:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
+	repo, closeRepo, err := newRepository(cfg)
+	if err != nil {
+		log.Fatalf("failed to set up %s storage: %v", cfg.Storage.Backend, err)
+	}
+	defer closeRepo()
+
+	useCase := usecase.NewIPAMUseCase(repo,
+		usecase.WithEventPublisher(logPublisher{}),
+		usecase.WithUtilizationThresholds(domain.UtilizationThresholds{
+			Warning:  cfg.Utilization.Warning,
+			Critical: cfg.Utilization.Critical,
+		}),
+	)
+	handler := api.NewIPAMHandler(useCase)
+
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+
+	srv := &http.Server{
+		Addr:    cfg.Server.Address,
+		Handler: mux,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.Allocation.LeaseReapInterval > 0 {
+		go reapLeases(ctx, useCase, cfg.Allocation.LeaseReapInterval)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("listening on %s", cfg.Server.Address)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, waiting up to %s for in-flight requests", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("graceful shutdown failed: %v", err)
+	}
+}
+
+// newRepository builds the storage backend selected in the configuration
+// and returns a function releasing its resources.
+func newRepository(cfg *config.Config) (domain.IPAMRepository, func(), error) {
+	switch cfg.Storage.Backend {
+	case "postgres":
+		sqlDB, err := openDB(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cfg.Database.AutoMigrate {
+			if err := migrateUp(sqlDB); err != nil {
+				sqlDB.Close()
+				return nil, nil, err
+			}
+		}
+		repo := persistence.NewIPAMRepository(db.NewDB(sqlDB), persistence.WithQuarantine(cfg.Allocation.Quarantine))
+		return repo, func() { sqlDB.Close() }, nil
+	case "consul":
+		client := consul.NewClient(cfg.Consul.Address, cfg.Consul.Token, cfg.Consul.Datacenter)
+		repo := consul.NewIPAMRepository(client, cfg.Consul.Prefix, consul.WithQuarantine(cfg.Allocation.Quarantine))
+		return repo, func() {}, nil
+	case "memory":
+		repo, err := memory.NewIPAMRepository(cfg.Memory.SnapshotFile, memory.WithQuarantine(cfg.Allocation.Quarantine))
+		if err != nil {
+			return nil, nil, err
+		}
+		return repo, func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/zinrai/ipam-mvp-go/internal/config"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/db"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/migration"
+)
+
+// runMigrate implements "ipamserver migrate up|down [steps]|status".
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ipamserver migrate up|down [steps]|status")
+	}
+
+	sqlDB, err := openDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	migrator, err := migration.NewMigrator(db.NewDB(sqlDB))
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		for _, version := range applied {
+			fmt.Printf("applied %d\n", version)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		if err != nil {
+			return err
+		}
+		for _, version := range reverted {
+			fmt.Printf("reverted %d\n", version)
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d  %-40s %s\n", status.Version, status.Name, applied)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+	return nil
+}
+
+func openDB(cfg *config.Config) (*sql.DB, error) {
+	sqlDB, err := sql.Open("postgres", cfg.GetDBConnString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	return sqlDB, nil
+}
+
+// migrateUp applies pending migrations before the server starts.
+func migrateUp(sqlDB *sql.DB) error {
+	migrator, err := migration.NewMigrator(db.NewDB(sqlDB))
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		return err
+	}
+	for _, version := range applied {
+		log.Printf("applied schema migration %d", version)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+	"github.com/zinrai/ipam-mvp-go/internal/usecase"
+)
+
+// reapLeases releases expired leases every interval until ctx is done.
+func reapLeases(ctx context.Context, useCase *usecase.IPAMUseCase, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := useCase.ExpireLeases(); err != nil {
+				log.Printf("failed to expire leases: %v", err)
+			}
+		}
+	}
+}
+
+// logPublisher writes events to the server log.
+type logPublisher struct{}
+
+func (logPublisher) Publish(event domain.Event) {
+	ip := event.IP
+	log.Printf("event %s: IP address %d (%s, hostname %q) in network %d",
+		event.Type, ip.ID, ip.Address, ip.Hostname, ip.NetworkID)
+}
@@ -3,11 +3,16 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
+	Server struct {
+		Address         string        `yaml:"address"`
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	} `yaml:"server"`
 	Database struct {
 		Host     string `yaml:"host"`
 		Port     int    `yaml:"port"`
@@ -15,7 +20,34 @@ type Config struct {
 		Password string `yaml:"password"`
 		DBName   string `yaml:"dbname"`
 		SSLMode  string `yaml:"sslmode"`
+		// AutoMigrate applies pending schema migrations on startup.
+		AutoMigrate bool `yaml:"auto_migrate"`
 	} `yaml:"database"`
+	Allocation struct {
+		// Quarantine keeps released addresses out of allocation so ARP
+		// caches and DNS records of the previous host can expire.
+		Quarantine time.Duration `yaml:"quarantine"`
+		// LeaseReapInterval is how often expired leases are released.
+		LeaseReapInterval time.Duration `yaml:"lease_reap_interval"`
+	} `yaml:"allocation"`
+	Utilization struct {
+		// Warning and Critical are the percentages of a network in use at
+		// which it is flagged as nearing exhaustion. Zero disables a level.
+		Warning  float64 `yaml:"warning"`
+		Critical float64 `yaml:"critical"`
+	} `yaml:"utilization"`
+	Storage struct {
+		Backend string `yaml:"backend"` // "postgres", "consul" or "memory"
+	} `yaml:"storage"`
+	Consul struct {
+		Address    string `yaml:"address"`
+		Token      string `yaml:"token"`
+		Datacenter string `yaml:"datacenter"`
+		Prefix     string `yaml:"prefix"`
+	} `yaml:"consul"`
+	Memory struct {
+		SnapshotFile string `yaml:"snapshot_file"`
+	} `yaml:"memory"`
 }
 
 func LoadConfig(filename string) (*Config, error) {
@@ -25,6 +57,14 @@ func LoadConfig(filename string) (*Config, error) {
 	}
 
 	c := &Config{}
+	c.Server.Address = ":8080"
+	c.Server.ShutdownTimeout = 15 * time.Second
+	c.Allocation.LeaseReapInterval = time.Minute
+	c.Utilization.Warning = 80
+	c.Utilization.Critical = 95
+	c.Storage.Backend = "postgres"
+	c.Consul.Address = "http://127.0.0.1:8500"
+	c.Consul.Prefix = "ipam"
 	err = yaml.Unmarshal(buf, c)
 	if err != nil {
 		return nil, fmt.Errorf("in file %q: %v", filename, err)
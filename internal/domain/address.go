@@ -0,0 +1,345 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// sparseHostBits is the number of host bits above which a network is too
+// large to walk address by address. Such networks, i.e. typical IPv6
+// subnets, are allocated by probing random addresses instead.
+const sparseHostBits = 16
+
+// RandomProbes is how many random candidates are tried in a sparse
+// network before giving up.
+const RandomProbes = 128
+
+// IsSparse reports whether addresses in ipNet should be picked at random
+// rather than sequentially.
+func IsSparse(ipNet *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	return bits == 8*net.IPv6len && bits-ones > sparseHostBits
+}
+
+// IsSubnetRouterAnycast reports whether ip is the Subnet-Router anycast
+// address of an IPv6 network (RFC 4291 2.6.1), which must not be assigned
+// to a host.
+func IsSubnetRouterAnycast(ipNet *net.IPNet, ip net.IP) bool {
+	return ipNet.IP.To4() == nil && ip.Equal(ipNet.IP)
+}
+
+// EUI64 derives the modified EUI-64 address (RFC 4291 appendix A) of mac
+// in ipNet. The prefix must be an IPv6 prefix of at most 64 bits.
+func EUI64(ipNet *net.IPNet, mac net.HardwareAddr) (net.IP, error) {
+	ones, bits := ipNet.Mask.Size()
+	if bits != 8*net.IPv6len || ones > 64 {
+		return nil, NewError(ErrInvalid, "EUI-64 addressing needs an IPv6 prefix of /64 or shorter, got %s", ipNet)
+	}
+
+	var iid [8]byte
+	switch len(mac) {
+	case 6:
+		copy(iid[:3], mac[:3])
+		iid[3], iid[4] = 0xff, 0xfe
+		copy(iid[5:], mac[3:])
+	case 8:
+		copy(iid[:], mac)
+	default:
+		return nil, NewError(ErrInvalid, "unsupported MAC address %s", mac)
+	}
+	iid[0] ^= 0x02
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ipNet.IP.To16()[:8])
+	copy(ip[8:], iid[:])
+	return ip, nil
+}
+
+// RandomAddress returns a random address inside ipNet.
+func RandomAddress(ipNet *net.IPNet) (net.IP, error) {
+	ip := make(net.IP, len(ipNet.IP))
+	if _, err := rand.Read(ip); err != nil {
+		return nil, fmt.Errorf("failed to generate random address: %v", err)
+	}
+	for i := range ip {
+		ip[i] = ipNet.IP[i] | (ip[i] &^ ipNet.Mask[i])
+	}
+	return ip, nil
+}
+
+// NextIP returns the address following ip.
+func NextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for j := len(next) - 1; j >= 0; j-- {
+		next[j]++
+		if next[j] > 0 {
+			break
+		}
+	}
+	return next
+}
+
+// LastAddress returns the highest address in ipNet, which is the
+// broadcast address of an IPv4 network.
+func LastAddress(ipNet *net.IPNet) net.IP {
+	last := make(net.IP, len(ipNet.IP))
+	for i := range last {
+		last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
+	}
+	return last
+}
+
+// IsNetworkOrBroadcast reports whether ip is the network or broadcast
+// address of an IPv4 network. Point-to-point /31 and host /32 networks
+// have neither (RFC 3021).
+func IsNetworkOrBroadcast(ipNet *net.IPNet, ip net.IP) bool {
+	ones, bits := ipNet.Mask.Size()
+	if bits != 8*net.IPv4len || bits-ones < 2 {
+		return false
+	}
+	return ip.Equal(ipNet.IP) || ip.Equal(LastAddress(ipNet))
+}
+
+// ValidateRequested checks that ip may be allocated on request in network.
+// Reserved ranges do not apply to explicit requests.
+func ValidateRequested(network *Network, ipNet *net.IPNet, ip net.IP) error {
+	switch {
+	case !ipNet.Contains(ip):
+		return NewError(ErrInvalid, "IP address %s is outside network %s", ip, network.CIDR).
+			WithDetail("address", ip.String())
+	case ip.Equal(network.Gateway):
+		return NewError(ErrInvalid, "cannot allocate gateway address %s", network.Gateway).
+			WithDetail("address", network.Gateway.String())
+	case IsNetworkOrBroadcast(ipNet, ip):
+		return NewError(ErrInvalid, "cannot allocate network or broadcast address %s", ip).
+			WithDetail("address", ip.String())
+	case IsSubnetRouterAnycast(ipNet, ip):
+		return NewError(ErrInvalid, "cannot allocate subnet-router anycast address %s", ip).
+			WithDetail("address", ip.String())
+	}
+	return nil
+}
+
+// Allocatable reports whether ip may be picked automatically in network.
+func Allocatable(network *Network, ipNet *net.IPNet, ip net.IP) bool {
+	if ip.Equal(network.Gateway) || IsNetworkOrBroadcast(ipNet, ip) || IsSubnetRouterAnycast(ipNet, ip) {
+		return false
+	}
+	for _, r := range network.Reserved {
+		if r.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// PrevIP returns the address preceding ip.
+func PrevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for j := len(prev) - 1; j >= 0; j-- {
+		prev[j]--
+		if prev[j] < 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// AllocatableRanges returns the ranges of addresses in network that may be
+// picked automatically, in ascending order. They hold exactly the
+// addresses for which Allocatable is true, so a repository can search them
+// for a free address without walking the network.
+func AllocatableRanges(network *Network, ipNet *net.IPNet) []IPRange {
+	first, last := ipNet.IP, LastAddress(ipNet)
+	size := len(first)
+	excluded := append([]IPRange(nil), network.Reserved...)
+	if ipNet.Contains(network.Gateway) {
+		excluded = append(excluded, IPRange{Start: network.Gateway, End: network.Gateway})
+	}
+	if IsNetworkOrBroadcast(ipNet, first) {
+		excluded = append(excluded, IPRange{Start: first, End: first}, IPRange{Start: last, End: last})
+	}
+	if IsSubnetRouterAnycast(ipNet, first) {
+		excluded = append(excluded, IPRange{Start: first, End: first})
+	}
+	sort.Slice(excluded, func(i, j int) bool { return compareIP(excluded[i].Start, excluded[j].Start) < 0 })
+
+	var ranges []IPRange
+	next := first
+	for _, r := range excluded {
+		start, end := normalizeIP(r.Start, size), normalizeIP(r.End, size)
+		if compareIP(end, next) < 0 {
+			continue
+		}
+		if compareIP(start, next) > 0 {
+			ranges = append(ranges, IPRange{Start: next, End: PrevIP(start)})
+		}
+		if compareIP(end, last) >= 0 {
+			return ranges
+		}
+		next = NextIP(end)
+	}
+	return append(ranges, IPRange{Start: next, End: last})
+}
+
+// normalizeIP returns ip in the size byte form used by a network's
+// addresses, so that address arithmetic stays within that form.
+func normalizeIP(ip net.IP, size int) net.IP {
+	if size == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// ValidateReserved checks that the reserved ranges of network are well
+// formed and lie inside it.
+func ValidateReserved(network *Network, ipNet *net.IPNet) error {
+	for _, r := range network.Reserved {
+		if r.Start == nil || r.End == nil || compareIP(r.Start, r.End) > 0 {
+			return NewError(ErrInvalid, "invalid reserved range %s-%s", r.Start, r.End)
+		}
+		if !ipNet.Contains(r.Start) || !ipNet.Contains(r.End) {
+			return NewError(ErrInvalid, "reserved range %s-%s is outside network %s", r.Start, r.End, network.CIDR)
+		}
+	}
+	return nil
+}
+
+// SelectAddress picks the address to allocate in network for req, given
+// a function reporting addresses that are already taken and one returning
+// the network's release history. It is shared by the repositories that
+// search for free addresses in Go.
+func SelectAddress(network *Network, req *AllocationRequest, inUse func(net.IP) bool, history func() (ReleaseHistory, error)) (net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network CIDR: %v", err)
+	}
+
+	requestedIP := req.RequestedIP
+	if requestedIP == nil && len(req.MAC) > 0 && ipNet.IP.To4() == nil {
+		if requestedIP, err = EUI64(ipNet, req.MAC); err != nil {
+			return nil, err
+		}
+	}
+
+	if requestedIP != nil {
+		if err := ValidateRequested(network, ipNet, requestedIP); err != nil {
+			return nil, err
+		}
+		if inUse(requestedIP) {
+			return nil, NewError(ErrConflict, "IP address %s is already allocated", requestedIP).
+				WithDetail("address", requestedIP.String())
+		}
+		return requestedIP, nil
+	}
+
+	picker, err := NewPicker(ResolveStrategy(req.Strategy, network, ipNet), network, ipNet, inUse, history)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := picker.Next()
+	if err != nil {
+		return nil, err
+	}
+	if ip == nil {
+		return nil, NewError(ErrExhausted, "no available IP addresses in network %d", network.ID)
+	}
+	return ip, nil
+}
+
+// SelectAddresses picks the addresses to allocate in network for req, in
+// ascending order. Contiguous requests get a single block of consecutive
+// addresses. Like SelectAddress it skips addresses that are not
+// Allocatable or reported by inUse.
+func SelectAddresses(network *Network, req *BulkAllocationRequest, inUse func(net.IP) bool, history func() (ReleaseHistory, error)) ([]net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network CIDR: %v", err)
+	}
+	n := req.Size()
+
+	var addresses []net.IP
+	if req.Contiguous {
+		addresses, err = selectBlock(network, ipNet, n, inUse)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		picker, err := NewPicker(ResolveStrategy(req.Strategy, network, ipNet), network, ipNet, inUse, history)
+		if err != nil {
+			return nil, err
+		}
+		for len(addresses) < n {
+			ip, err := picker.Next()
+			if err != nil {
+				return nil, err
+			}
+			if ip == nil {
+				return nil, NewError(ErrExhausted, "fewer than %d available IP addresses in network %d", n, network.ID).
+					WithDetail("count", strconv.Itoa(n))
+			}
+			addresses = append(addresses, ip)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool { return compareIP(addresses[i], addresses[j]) < 0 })
+	return addresses, nil
+}
+
+// selectBlock picks the lowest block of n consecutive free addresses in
+// ipNet. Sparse networks are too large to walk, so blocks are probed at
+// random starting points instead.
+func selectBlock(network *Network, ipNet *net.IPNet, n int, inUse func(net.IP) bool) ([]net.IP, error) {
+	free := func(ip net.IP) bool {
+		return ipNet.Contains(ip) && Allocatable(network, ipNet, ip) && !inUse(ip)
+	}
+
+	if IsSparse(ipNet) {
+		for probe := 0; probe < RandomProbes; probe++ {
+			start, err := RandomAddress(ipNet)
+			if err != nil {
+				return nil, err
+			}
+			var block []net.IP
+			for ip := start; len(block) < n && free(ip); ip = NextIP(ip) {
+				block = append(block, ip)
+			}
+			if len(block) == n {
+				return block, nil
+			}
+		}
+		return nil, exhaustedBlock(network, n)
+	}
+
+	var block []net.IP
+	walk := &walker{ranges: AllocatableRanges(network, ipNet)}
+	for ip := walk.next(); ip != nil; ip = walk.next() {
+		switch {
+		case inUse(ip):
+			block = block[:0]
+			continue
+		case len(block) > 0 && !ip.Equal(NextIP(block[len(block)-1])):
+			// The walk skipped excluded addresses, which also ends a block.
+			block = block[:0]
+		}
+		block = append(block, ip)
+		if len(block) == n {
+			return block, nil
+		}
+	}
+	return nil, exhaustedBlock(network, n)
+}
+
+func exhaustedBlock(network *Network, n int) error {
+	return NewError(ErrExhausted, "no block of %d contiguous available IP addresses in network %d", n, network.ID).
+		WithDetail("count", strconv.Itoa(n))
+}
+
+func compareIP(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
+}
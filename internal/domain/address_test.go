@@ -0,0 +1,128 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("invalid CIDR %s: %v", cidr, err)
+	}
+	return ipNet
+}
+
+func TestEUI64(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		mac    net.HardwareAddr
+		want   string
+	}{
+		{"48-bit MAC in a /64", "2001:db8::/64", net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, "2001:db8::5054:ff:fe12:3456"},
+		{"Universal/local bit set", "2001:db8::/64", net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}, "2001:db8::ff:fe00:1"},
+		{"64-bit MAC", "2001:db8::/64", net.HardwareAddr{0x02, 0, 0, 0, 0, 0, 0, 0x01}, "2001:db8::1"},
+		{"Shorter prefix keeps the first 64 bits", "2001:db8:1::/48", net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, "2001:db8:1:0:5054:ff:fe12:3456"},
+		{"/56 prefix", "2001:db8:0:ab00::/56", net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}, "2001:db8:0:ab00:5054:ff:fe12:3456"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := EUI64(mustParseCIDR(t, tt.prefix), tt.mac)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := net.ParseIP(tt.want); !ip.Equal(want) {
+				t.Errorf("expected %s, got %s", want, ip)
+			}
+		})
+	}
+}
+
+func TestEUI64Invalid(t *testing.T) {
+	mac := net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	tests := []struct {
+		name   string
+		prefix string
+		mac    net.HardwareAddr
+	}{
+		{"Prefix longer than /64", "2001:db8::/80", mac},
+		{"IPv4 network", "192.168.1.0/24", mac},
+		{"Unsupported MAC length", "2001:db8::/64", net.HardwareAddr{0x52, 0x54, 0x00, 0x12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := EUI64(mustParseCIDR(t, tt.prefix), tt.mac); !errors.Is(err, ErrInvalid) {
+				t.Errorf("expected ErrInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRandomAddress(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.0/30", "10.0.0.5/32", "2001:db8::/64", "2001:db8::/127"} {
+		t.Run(cidr, func(t *testing.T) {
+			ipNet := mustParseCIDR(t, cidr)
+			for i := 0; i < 100; i++ {
+				ip, err := RandomAddress(ipNet)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(ip) != len(ipNet.IP) || !ipNet.Contains(ip) {
+					t.Fatalf("expected an address in %s, got %s", cidr, ip)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocatableRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		gateway  string
+		reserved []IPRange
+		want     []string
+	}{
+		{"IPv4 /24", "192.168.1.0/24", "192.168.1.1", nil, []string{"192.168.1.2-192.168.1.254"}},
+		{"Gateway in the middle", "192.168.1.0/24", "192.168.1.100", nil, []string{"192.168.1.1-192.168.1.99", "192.168.1.101-192.168.1.254"}},
+		{"Reserved ranges", "192.168.1.0/24", "192.168.1.1", []IPRange{
+			{Start: net.ParseIP("192.168.1.200"), End: net.ParseIP("192.168.1.255")},
+			{Start: net.ParseIP("192.168.1.10"), End: net.ParseIP("192.168.1.20")},
+		}, []string{"192.168.1.2-192.168.1.9", "192.168.1.21-192.168.1.199"}},
+		{"Reserved range covering the gateway", "192.168.1.0/24", "192.168.1.1", []IPRange{
+			{Start: net.ParseIP("192.168.1.0"), End: net.ParseIP("192.168.1.5")},
+		}, []string{"192.168.1.6-192.168.1.254"}},
+		{"All-ones broadcast", "255.255.255.0/24", "255.255.255.1", nil, []string{"255.255.255.2-255.255.255.254"}},
+		{"Point-to-point /31", "10.0.0.0/31", "10.0.0.0", nil, []string{"10.0.0.1-10.0.0.1"}},
+		{"Host /32 without the gateway", "10.0.0.5/32", "", nil, []string{"10.0.0.5-10.0.0.5"}},
+		{"Host /32 holding the gateway", "10.0.0.5/32", "10.0.0.5", nil, nil},
+		{"Fully reserved", "192.168.1.0/29", "192.168.1.1", []IPRange{
+			{Start: net.ParseIP("192.168.1.2"), End: net.ParseIP("192.168.1.6")},
+		}, nil},
+		{"IPv6 excludes the subnet-router anycast", "2001:db8::/120", "2001:db8::1", nil, []string{"2001:db8::2-2001:db8::ff"}},
+		{"IPv6 has no broadcast", "2001:db8::/120", "2001:db8::ff", nil, []string{"2001:db8::1-2001:db8::fe"}},
+		{"IPv6 /127", "2001:db8::/127", "2001:db8::1", nil, nil},
+		{"IPv6 /127 without the gateway", "2001:db8::/127", "", nil, []string{"2001:db8::1-2001:db8::1"}},
+		{"IPv6 /128", "2001:db8::5/128", "", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := &Network{CIDR: tt.cidr, Gateway: net.ParseIP(tt.gateway), Reserved: tt.reserved}
+			ipNet := mustParseCIDR(t, tt.cidr)
+			var got []string
+			for _, r := range AllocatableRanges(network, ipNet) {
+				if len(r.Start) != len(ipNet.IP) || len(r.End) != len(ipNet.IP) {
+					t.Errorf("expected %d byte addresses, got %d and %d", len(ipNet.IP), len(r.Start), len(r.End))
+				}
+				got = append(got, fmt.Sprintf("%s-%s", r.Start, r.End))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
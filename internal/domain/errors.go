@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds returned by repositories and use cases. Callers test for
+// them with errors.Is.
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrConflict  = errors.New("conflict")
+	ErrExhausted = errors.New("exhausted")
+	ErrInvalid   = errors.New("invalid")
+)
+
+// Error is an error of one of the kinds above with a human readable
+// message and optional machine readable details.
+type Error struct {
+	Kind    error
+	Message string
+	Details map[string]string
+}
+
+func NewError(kind error, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// WithDetail adds a detail to e and returns it.
+func (e *Error) WithDetail(key, value string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
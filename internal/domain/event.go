@@ -0,0 +1,26 @@
+package domain
+
+import "time"
+
+// EventType identifies what happened to an address.
+type EventType string
+
+const (
+	// EventLeaseExpired is emitted after an address was released because
+	// its lease expired.
+	EventLeaseExpired EventType = "lease_expired"
+)
+
+// Event records a change to an address that was not requested by a
+// client. IP is the record as it was before the change.
+type Event struct {
+	Type EventType
+	Time time.Time
+	IP   *IPAddress
+}
+
+// EventPublisher delivers events to interested parties. Publish must not
+// block for long, as it is called on the path that caused the event.
+type EventPublisher interface {
+	Publish(event Event)
+}
@@ -2,12 +2,120 @@ package domain
 
 import (
 	"net"
+	"strings"
+	"time"
 )
 
 type Network struct {
 	ID      int
 	CIDR    string
 	Gateway net.IP
+	// VRF names the routing domain of the network. Networks may only
+	// overlap if they are in different VRFs; the empty VRF is the global
+	// routing table.
+	VRF string
+	// ParentID is the ID of the network this one was carved from, if any.
+	ParentID *int
+	// Reserved ranges are never handed out automatically, but addresses
+	// in them can still be requested explicitly.
+	Reserved []IPRange
+	// Strategy picks addresses in the network unless a request names
+	// another one. See ResolveStrategy for the default.
+	Strategy Strategy
+
+	Name        string
+	Description string
+	// VLAN is the 802.1Q VLAN ID of the network, or 0 if it has none.
+	VLAN int
+	// Site is the location the network is deployed at.
+	Site string
+	Tags map[string]string
+}
+
+// NetworkUpdate holds the changes to apply to a network. Nil fields are
+// left unchanged.
+type NetworkUpdate struct {
+	Gateway     net.IP
+	Reserved    *[]IPRange
+	Strategy    *Strategy
+	Name        *string
+	Description *string
+	VLAN        *int
+	Site        *string
+	Tags        *map[string]string
+}
+
+// NetworkFilter selects networks by their metadata. Zero fields match any
+// network; a network matches Tags if it carries all of them.
+type NetworkFilter struct {
+	Site string
+	VLAN int
+	Tags map[string]string
+}
+
+// Matches reports whether network is selected by the filter. A nil filter
+// matches every network.
+func (f *NetworkFilter) Matches(network *Network) bool {
+	if f == nil {
+		return true
+	}
+	if f.Site != "" && network.Site != f.Site {
+		return false
+	}
+	if f.VLAN != 0 && network.VLAN != f.VLAN {
+		return false
+	}
+	for key, value := range f.Tags {
+		if v, ok := network.Tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// IPFilter selects IP addresses. Zero fields match any address; an
+// address matches Tags if it carries all of them.
+type IPFilter struct {
+	Status         AddressStatus
+	HostnamePrefix string
+	Tags           map[string]string
+}
+
+// Matches reports whether ip is selected by the filter. A nil filter
+// matches every address.
+func (f *IPFilter) Matches(ip *IPAddress) bool {
+	if f == nil {
+		return true
+	}
+	if f.Status != "" && ip.Status != f.Status {
+		return false
+	}
+	if !strings.HasPrefix(ip.Hostname, f.HostnamePrefix) {
+		return false
+	}
+	for key, value := range f.Tags {
+		if v, ok := ip.Tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// NetworkNode is a network together with the networks carved from it.
+type NetworkNode struct {
+	Network  *Network
+	Children []*NetworkNode
+}
+
+// IPRange is an inclusive range of addresses.
+type IPRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+// Contains reports whether ip lies within the range.
+func (r IPRange) Contains(ip net.IP) bool {
+	return compareIP(r.Start, ip) <= 0 && compareIP(ip, r.End) <= 0
 }
 
 type IPAddress struct {
@@ -15,16 +123,174 @@ type IPAddress struct {
 	NetworkID int
 	Address   net.IP
 	Hostname  string
-	Status    string // e.g., "available", "allocated"
+	Status    AddressStatus
+
+	MAC         net.HardwareAddr
+	Description string
+	// Owner is the person or team responsible for the host.
+	Owner string
+	Tags  map[string]string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// ReleasedAt is set when the address was released. A released address
+	// is handed out again once the repository's quarantine period passed.
+	ReleasedAt *time.Time
+	// LeaseExpiresAt is set for leased allocations, which are released
+	// automatically once it has passed unless the lease is renewed.
+	LeaseExpiresAt *time.Time
+	// IdempotencyKey is the key the address was allocated with, if any.
+	// Releasing the address clears it.
+	IdempotencyKey string
+}
+
+// IPUpdate holds the changes to apply to an IP address. Nil fields are
+// left unchanged.
+type IPUpdate struct {
+	Hostname    *string
+	MAC         *net.HardwareAddr
+	Description *string
+	Owner       *string
+	Tags        *map[string]string
+}
+
+// AllocationRequest describes an address allocation. If RequestedIP is
+// nil the repository picks a free address; in IPv6 networks a MAC, when
+// given, selects the host's EUI-64 address instead. The MAC is recorded
+// with the allocation in either case.
+type AllocationRequest struct {
+	NetworkID   int
+	RequestedIP net.IP
+	Hostname    string
+	MAC         net.HardwareAddr
+	Description string
+	Owner       string
+	Tags        map[string]string
+	// Status is the state of the new record, StatusAllocated if empty. A
+	// StatusReserved record holds the address without a host.
+	Status AddressStatus
+	// Lease is the lifetime of the allocation. Zero allocates the address
+	// until it is released.
+	Lease time.Duration
+	// IdempotencyKey identifies the allocation across client retries. It
+	// is unique among the allocated addresses of a network.
+	IdempotencyKey string
+	// Strategy overrides the network's strategy for this allocation.
+	Strategy Strategy
+}
+
+// InitialStatus returns the status of the record created for req.
+func (req *AllocationRequest) InitialStatus() AddressStatus {
+	if req.Status == "" {
+		return StatusAllocated
+	}
+	return req.Status
+}
+
+// BulkAllocationRequest describes the allocation of several addresses in
+// one go. Either Count addresses are allocated, or one per entry of
+// Hostnames. The metadata and status apply to every address.
+type BulkAllocationRequest struct {
+	NetworkID int
+	Count     int
+	Hostnames []string
+	// Contiguous requests a block of consecutive addresses.
+	Contiguous  bool
+	Description string
+	Owner       string
+	Tags        map[string]string
+	Status      AddressStatus
+	Lease       time.Duration
+	// Strategy overrides the network's strategy. Contiguous blocks are
+	// always placed at the lowest free position, or at random in sparse
+	// networks.
+	Strategy Strategy
+}
+
+// Size returns the number of addresses to allocate for req.
+func (req *BulkAllocationRequest) Size() int {
+	if len(req.Hostnames) > 0 {
+		return len(req.Hostnames)
+	}
+	return req.Count
+}
+
+// Hostname returns the hostname of the i-th address allocated for req.
+func (req *BulkAllocationRequest) Hostname(i int) string {
+	if i < len(req.Hostnames) {
+		return req.Hostnames[i]
+	}
+	return ""
+}
+
+// InitialStatus returns the status of the records created for req.
+func (req *BulkAllocationRequest) InitialStatus() AddressStatus {
+	if req.Status == "" {
+		return StatusAllocated
+	}
+	return req.Status
 }
 
 type IPAMRepository interface {
 	CreateNetwork(network *Network) error
 	GetNetwork(id int) (*Network, error)
-	ListNetworks() ([]*Network, error)
-	AllocateIP(networkID int, requestedIP net.IP, hostname string) (*IPAddress, error)
+	// ListNetworks returns the page of networks matching filter, and the
+	// cursor of the next page, or "" on the last one. A nil filter
+	// returns all networks, and a nil page all of them ordered by ID.
+	ListNetworks(filter *NetworkFilter, page *Page) ([]*Network, string, error)
+	// AllocateChildNetwork carves a child of prefix length ones out of a
+	// parent network as CarveChild does and stores it. Carves and other
+	// writes inside the parent are serialized, so concurrent carves get
+	// different prefixes.
+	AllocateChildNetwork(parentID, ones int) (*Network, error)
+	// UpdateNetwork stores the gateway, reserved ranges and metadata of
+	// network. It fails with ErrConflict if the new gateway is allocated
+	// to a host.
+	UpdateNetwork(network *Network) error
+	// DeleteNetwork removes a network. It fails with ErrConflict while
+	// networks were carved from it, and unless force is set while
+	// addresses are allocated; otherwise they are removed with it.
+	DeleteNetwork(id int, force bool) error
+	// AllocateIP allocates an address for req. It fails with ErrConflict
+	// if the hostname or idempotency key is already in use in the network.
+	AllocateIP(req *AllocationRequest) (*IPAddress, error)
+	// AllocateIPs allocates all addresses of req in a single transaction,
+	// in address order. Either every address is allocated or none is.
+	AllocateIPs(req *BulkAllocationRequest) ([]*IPAddress, error)
+	// ReleaseIP marks an address quarantined or available, depending on
+	// the repository's quarantine, and clears its hostname, MAC,
+	// description, owner, tags, lease and idempotency key.
 	ReleaseIP(id int) error
+	// RenewLease sets the lease expiry of an address. It fails with
+	// ErrConflict if the address has been released.
+	RenewLease(id int, expiresAt time.Time) error
+	// ExpireLeases releases every address whose lease expired at or before
+	// now and returns the records as they were before the release.
+	ExpireLeases(now time.Time) ([]*IPAddress, error)
+	// UpdateIPStatus moves an address from one status to another. It fails
+	// with ErrConflict if the address is no longer in status from.
+	UpdateIPStatus(id int, from, to AddressStatus) error
 	GetIP(id int) (*IPAddress, error)
-	ListIPs(networkID int) ([]*IPAddress, error)
-	UpdateIPHostname(id int, hostname string) error
+	// GetIPByHostname returns the address holding hostname in a network.
+	// It fails with ErrNotFound if there is none.
+	GetIPByHostname(networkID int, hostname string) (*IPAddress, error)
+	// GetIPByIdempotencyKey returns the address allocated in a network
+	// with the given idempotency key. It fails with ErrNotFound if there
+	// is none.
+	GetIPByIdempotencyKey(networkID int, key string) (*IPAddress, error)
+	// ListIPs returns the page of addresses in a network matching filter
+	// like ListNetworks.
+	ListIPs(networkID int, filter *IPFilter, page *Page) ([]*IPAddress, string, error)
+	// UpdateIP stores the hostname, MAC, description, owner and tags of
+	// ip and sets its UpdatedAt. It fails with ErrConflict if the hostname
+	// is already in use in the network.
+	UpdateIP(ip *IPAddress) error
+	// GetUtilization counts the addresses of a network by use. It fails
+	// with ErrNotFound if the network does not exist.
+	GetUtilization(networkID int) (*Utilization, error)
+	// ListUtilization returns the utilization of the networks matching
+	// filter, ordered by network ID. A nil filter selects all networks.
+	ListUtilization(filter *NetworkFilter) ([]*Utilization, error)
+	// Search finds address records and networks across all networks.
+	Search(query *SearchQuery) (*SearchResult, error)
 }
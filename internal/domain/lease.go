@@ -0,0 +1,19 @@
+package domain
+
+import "time"
+
+// LeaseExpiry returns the expiry of a lease of the given length starting
+// at now, or nil if lease is zero.
+func LeaseExpiry(now time.Time, lease time.Duration) *time.Time {
+	if lease == 0 {
+		return nil
+	}
+	expiresAt := now.Add(lease)
+	return &expiresAt
+}
+
+// LeaseExpired reports whether ip holds a lease that expired at or before
+// now. Released addresses hold no lease.
+func LeaseExpired(ip *IPAddress, now time.Time) bool {
+	return !ip.Status.Released() && ip.LeaseExpiresAt != nil && !ip.LeaseExpiresAt.After(now)
+}
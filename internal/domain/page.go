@@ -0,0 +1,238 @@
+package domain
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPageLimit is the number of items in a page unless a client asks
+// for another; MaxPageLimit bounds what it may ask for.
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// SortKey names the field a listing is ordered by. Items with the same
+// value are ordered by ID.
+type SortKey string
+
+const (
+	SortByID        SortKey = "id"
+	SortByCIDR      SortKey = "cidr"
+	SortByAddress   SortKey = "address"
+	SortByHostname  SortKey = "hostname"
+	SortByCreatedAt SortKey = "created_at"
+)
+
+// NetworkSorts and IPSorts are the keys networks and IP addresses can be
+// sorted by.
+var (
+	NetworkSorts = []SortKey{SortByID, SortByCIDR}
+	IPSorts      = []SortKey{SortByID, SortByAddress, SortByHostname, SortByCreatedAt}
+)
+
+// Page selects part of a sorted listing.
+type Page struct {
+	Sort       SortKey
+	Descending bool
+	// Limit is the maximum number of items in the page. Zero selects all
+	// remaining items.
+	Limit int
+	// Cursor is the next cursor returned with the previous page, or empty
+	// for the first page.
+	Cursor string
+}
+
+// Validate checks that page is sorted by one of sorts, is limited to at
+// most MaxPageLimit items and carries a valid cursor.
+func (p *Page) Validate(sorts []SortKey) error {
+	if !slices.Contains(sorts, p.Sort) {
+		return NewError(ErrInvalid, "cannot sort by %q", p.Sort).
+			WithDetail("sort", string(p.Sort))
+	}
+	if p.Limit < 1 || p.Limit > MaxPageLimit {
+		return NewError(ErrInvalid, "limit must be between 1 and %d", MaxPageLimit)
+	}
+	_, err := p.DecodeCursor()
+	return err
+}
+
+// Cursor is the position after the last item of a page. Clients see it
+// as an opaque string.
+type Cursor struct {
+	Sort       SortKey `json:"s"`
+	Descending bool    `json:"d,omitempty"`
+	// Key is the sort field of the last item in string form. It is empty
+	// when sorting by ID.
+	Key string `json:"k,omitempty"`
+	ID  int    `json:"i"`
+}
+
+// Encode returns c in the form handed to clients.
+func (c *Cursor) Encode() string {
+	buf, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// DecodeCursor returns the cursor of page, or nil for the first page. It
+// fails with ErrInvalid if the cursor is malformed or was issued for a
+// listing in another order.
+func (p *Page) DecodeCursor() (*Cursor, error) {
+	if p.Cursor == "" {
+		return nil, nil
+	}
+	invalid := NewError(ErrInvalid, "invalid cursor").WithDetail("cursor", p.Cursor)
+	buf, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	var c Cursor
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, invalid
+	}
+	if c.Sort != p.Sort || c.Descending != p.Descending {
+		return nil, NewError(ErrInvalid, "cursor belongs to a listing in another order").WithDetail("cursor", p.Cursor)
+	}
+
+	valid := true
+	switch c.Sort {
+	case SortByCIDR:
+		_, _, err = net.ParseCIDR(c.Key)
+		valid = err == nil
+	case SortByAddress:
+		valid = net.ParseIP(c.Key) != nil
+	case SortByCreatedAt:
+		_, err = time.Parse(time.RFC3339Nano, c.Key)
+		valid = err == nil
+	}
+	if !valid {
+		return nil, invalid
+	}
+	return &c, nil
+}
+
+// sortField orders the items of a listing by one field, compared in the
+// string form kept in cursors.
+type sortField[T any] struct {
+	key     func(T) string
+	compare func(a, b string) int
+}
+
+var networkSortFields = map[SortKey]sortField[*Network]{
+	SortByID:   {key: func(*Network) string { return "" }, compare: strings.Compare},
+	SortByCIDR: {key: func(n *Network) string { return n.CIDR }, compare: compareCIDRs},
+}
+
+var ipSortFields = map[SortKey]sortField[*IPAddress]{
+	SortByID:        {key: func(*IPAddress) string { return "" }, compare: strings.Compare},
+	SortByAddress:   {key: func(ip *IPAddress) string { return ip.Address.String() }, compare: compareAddresses},
+	SortByHostname:  {key: func(ip *IPAddress) string { return ip.Hostname }, compare: strings.Compare},
+	SortByCreatedAt: {key: func(ip *IPAddress) string { return ip.CreatedAt.UTC().Format(time.RFC3339Nano) }, compare: compareTimes},
+}
+
+// PageNetworks returns the networks selected by page, or all of them in
+// ID order if page is nil, and the cursor of the next page, which is
+// empty on the last one. networks must hold the whole listing; it is
+// sorted in place. It is shared by the repositories that sort in Go.
+func PageNetworks(networks []*Network, page *Page) ([]*Network, string, error) {
+	return paginate(networks, page, networkSortFields, func(n *Network) int { return n.ID })
+}
+
+// PageIPs is PageNetworks for IP addresses.
+func PageIPs(ips []*IPAddress, page *Page) ([]*IPAddress, string, error) {
+	return paginate(ips, page, ipSortFields, func(ip *IPAddress) int { return ip.ID })
+}
+
+func paginate[T any](items []T, page *Page, fields map[SortKey]sortField[T], id func(T) int) ([]T, string, error) {
+	if page == nil {
+		slices.SortFunc(items, func(a, b T) int { return cmp.Compare(id(a), id(b)) })
+		return items, "", nil
+	}
+	field, ok := fields[page.Sort]
+	if !ok {
+		return nil, "", NewError(ErrInvalid, "cannot sort by %q", page.Sort).
+			WithDetail("sort", string(page.Sort))
+	}
+	cursor, err := page.DecodeCursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// position compares an item to the one with the given key and ID in
+	// the order of the listing.
+	position := func(item T, key string, itemID int) int {
+		c := field.compare(field.key(item), key)
+		if c == 0 {
+			c = cmp.Compare(id(item), itemID)
+		}
+		if page.Descending {
+			return -c
+		}
+		return c
+	}
+	slices.SortFunc(items, func(a, b T) int { return position(a, field.key(b), id(b)) })
+
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(items), func(i int) bool { return position(items[i], cursor.Key, cursor.ID) > 0 })
+	}
+	if page.Limit == 0 || start+page.Limit >= len(items) {
+		return items[start:], "", nil
+	}
+	items = items[start : start+page.Limit]
+	return items, nextCursor(page, field, items[len(items)-1], id), nil
+}
+
+// NextNetworkCursor returns the cursor of the page following network.
+func (p *Page) NextNetworkCursor(network *Network) string {
+	return nextCursor(p, networkSortFields[p.Sort], network, func(n *Network) int { return n.ID })
+}
+
+// NextIPCursor returns the cursor of the page following ip.
+func (p *Page) NextIPCursor(ip *IPAddress) string {
+	return nextCursor(p, ipSortFields[p.Sort], ip, func(ip *IPAddress) int { return ip.ID })
+}
+
+func nextCursor[T any](page *Page, field sortField[T], last T, id func(T) int) string {
+	return (&Cursor{Sort: page.Sort, Descending: page.Descending, Key: field.key(last), ID: id(last)}).Encode()
+}
+
+func compareCIDRs(a, b string) int {
+	_, netA, errA := net.ParseCIDR(a)
+	_, netB, errB := net.ParseCIDR(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	if c := compareAddresses(netA.IP.String(), netB.IP.String()); c != 0 {
+		return c
+	}
+	onesA, _ := netA.Mask.Size()
+	onesB, _ := netB.Mask.Size()
+	return cmp.Compare(onesA, onesB)
+}
+
+// compareAddresses orders IPv4 addresses before IPv6 ones, as PostgreSQL
+// orders inet values.
+func compareAddresses(a, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	v4A, v4B := ipA.To4() != nil, ipB.To4() != nil
+	if v4A != v4B {
+		if v4A {
+			return -1
+		}
+		return 1
+	}
+	return compareIP(ipA, ipB)
+}
+
+func compareTimes(a, b string) int {
+	timeA, _ := time.Parse(time.RFC3339Nano, a)
+	timeB, _ := time.Parse(time.RFC3339Nano, b)
+	return timeA.Compare(timeB)
+}
@@ -0,0 +1,59 @@
+package domain
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestPageNetworks(t *testing.T) {
+	networks := []*Network{
+		{ID: 3, CIDR: "10.0.0.0/24"},
+		{ID: 1, CIDR: "192.168.0.0/24"},
+		{ID: 4, CIDR: "2001:db8::/64"},
+		{ID: 2, CIDR: "10.0.0.0/16"},
+	}
+
+	tests := []struct {
+		name string
+		page Page
+		want []int
+	}{
+		{"By ID", Page{Sort: SortByID, Limit: 3}, []int{1, 2, 3, 4}},
+		{"By CIDR, IPv4 first", Page{Sort: SortByCIDR, Limit: 3}, []int{2, 3, 1, 4}},
+		{"By CIDR descending", Page{Sort: SortByCIDR, Descending: true, Limit: 3}, []int{4, 1, 3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, next, err := PageNetworks(slices.Clone(networks), &tt.page)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.page.Cursor = next
+			rest, last, err := PageNetworks(slices.Clone(networks), &tt.page)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []int
+			for _, network := range append(first, rest...) {
+				got = append(got, network.ID)
+			}
+			if !slices.Equal(got, tt.want) || last != "" {
+				t.Errorf("expected %v, got %v and cursor %q", tt.want, got, last)
+			}
+		})
+	}
+}
+
+func TestPageInvalidCursor(t *testing.T) {
+	byID := (&Cursor{Sort: SortByID, ID: 1}).Encode()
+	for _, page := range []*Page{
+		{Sort: SortByID, Limit: 10, Cursor: "not a cursor"},
+		{Sort: SortByCIDR, Limit: 10, Cursor: byID},
+		{Sort: SortByID, Descending: true, Limit: 10, Cursor: byID},
+	} {
+		if _, _, err := PageNetworks([]*Network{{ID: 1, CIDR: "10.0.0.0/24"}}, page); !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected ErrInvalid for %+v, got %v", page, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package domain
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// NextFreePrefix returns the lowest prefix of length ones inside parent
+// that overlaps none of used, or nil if there is no room left. Prefixes
+// are aligned to their size.
+func NextFreePrefix(parent *net.IPNet, used []*net.IPNet, ones int) *net.IPNet {
+	parentOnes, bits := parent.Mask.Size()
+	if ones < parentOnes || ones > bits {
+		return nil
+	}
+
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	start := ipToInt(parent.IP)
+	end := new(big.Int).Add(start, new(big.Int).Lsh(big.NewInt(1), uint(bits-parentOnes)))
+
+	sorted := append([]*net.IPNet(nil), used...)
+	sort.Slice(sorted, func(i, j int) bool { return ipToInt(sorted[i].IP).Cmp(ipToInt(sorted[j].IP)) < 0 })
+
+	candidate := start
+	for _, u := range sorted {
+		usedOnes, _ := u.Mask.Size()
+		usedStart := ipToInt(u.IP)
+		usedEnd := new(big.Int).Add(usedStart, new(big.Int).Lsh(big.NewInt(1), uint(bits-usedOnes)))
+		if usedEnd.Cmp(candidate) <= 0 {
+			continue
+		}
+		if new(big.Int).Add(candidate, size).Cmp(usedStart) <= 0 {
+			break
+		}
+		// Move past the used prefix and round up to the next boundary.
+		candidate = new(big.Int).Add(usedEnd, new(big.Int).Sub(size, big.NewInt(1)))
+		candidate.Div(candidate, size).Mul(candidate, size)
+	}
+
+	if new(big.Int).Add(candidate, size).Cmp(end) > 0 {
+		return nil
+	}
+	return &net.IPNet{IP: intToIP(candidate, bits/8), Mask: net.CIDRMask(ones, bits)}
+}
+
+// CarveChild returns a child of parent with the lowest free, aligned
+// prefix of length ones, whose gateway is its first usable address. A
+// prefix is taken if any network of the parent's VRF lies inside the
+// parent, whether or not it was carved from it. Host routes are rejected
+// with ErrInvalid, as they have no address left for the gateway, and
+// ErrExhausted is returned if no prefix is free.
+func CarveChild(parent *Network, networks []*Network, ones int) (*Network, error) {
+	_, parentNet, err := net.ParseCIDR(parent.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network CIDR: %v", err)
+	}
+	parentOnes, bits := parentNet.Mask.Size()
+	if ones <= parentOnes || ones >= bits {
+		return nil, NewError(ErrInvalid, "prefix length must be between %d and %d", parentOnes+1, bits-1).
+			WithDetail("prefix_length", strconv.Itoa(ones))
+	}
+
+	// Networks containing the parent are its ancestors and take nothing
+	// from it.
+	var used []*net.IPNet
+	for _, network := range networks {
+		if network.VRF != parent.VRF || network.ID == parent.ID {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network.CIDR)
+		if err != nil {
+			continue
+		}
+		if networkOnes, networkBits := ipNet.Mask.Size(); networkBits == bits && networkOnes > parentOnes && parentNet.Contains(ipNet.IP) {
+			used = append(used, ipNet)
+		}
+	}
+
+	child := NextFreePrefix(parentNet, used, ones)
+	if child == nil {
+		return nil, NewError(ErrExhausted, "no free /%d left in network %d", ones, parent.ID).
+			WithDetail("prefix_length", strconv.Itoa(ones))
+	}
+	parentID := parent.ID
+	return &Network{
+		CIDR:     child.String(),
+		Gateway:  NextIP(child.IP),
+		VRF:      parent.VRF,
+		ParentID: &parentID,
+	}, nil
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+func intToIP(i *big.Int, size int) net.IP {
+	return i.FillBytes(make([]byte, size))
+}
+
+// CheckOverlap returns ErrConflict if network overlaps one of networks in
+// the same VRF that is not one of its ancestors. Repositories run it
+// together with the write, so concurrent creations cannot both pass.
+func CheckOverlap(network *Network, networks []*Network) error {
+	_, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return fmt.Errorf("failed to parse network CIDR: %v", err)
+	}
+	byID := make(map[int]*Network, len(networks))
+	for _, existing := range networks {
+		byID[existing.ID] = existing
+	}
+	ancestors := make(map[int]bool)
+	for id := network.ParentID; id != nil && !ancestors[*id]; {
+		ancestors[*id] = true
+		parent, ok := byID[*id]
+		if !ok {
+			break
+		}
+		id = parent.ParentID
+	}
+
+	for _, existing := range networks {
+		if existing.VRF != network.VRF || existing.ID == network.ID || ancestors[existing.ID] {
+			continue
+		}
+		_, other, err := net.ParseCIDR(existing.CIDR)
+		if err != nil {
+			continue
+		}
+		if other.Contains(ipNet.IP) || ipNet.Contains(other.IP) {
+			return NewError(ErrConflict, "network %s overlaps network %d (%s)", ipNet, existing.ID, existing.CIDR).
+				WithDetail("network_id", strconv.Itoa(existing.ID))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNextFreePrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		used []string
+		ones int
+		want string
+	}{
+		{"Empty parent", nil, 24, "10.0.0.0/24"},
+		{"Gap before a used prefix", []string{"10.0.1.0/24"}, 24, "10.0.0.0/24"},
+		{"Aligned to its size", []string{"10.0.1.0/24"}, 23, "10.0.2.0/23"},
+		{"Full parent", []string{"10.0.0.0/17", "10.0.128.0/17"}, 24, ""},
+		{"Shorter than the parent", nil, 8, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var used []*net.IPNet
+			for _, cidr := range tt.used {
+				used = append(used, mustParseCIDR(t, cidr))
+			}
+			got := NextFreePrefix(mustParseCIDR(t, "10.0.0.0/16"), used, tt.ones)
+			if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+				t.Errorf("expected %q, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCarveChild(t *testing.T) {
+	parentID := 1
+	parent := &Network{ID: parentID, CIDR: "10.0.0.0/16", Gateway: net.ParseIP("10.0.0.1"), VRF: "blue"}
+	networks := []*Network{
+		parent,
+		{ID: 2, CIDR: "10.0.0.0/24", VRF: "blue", ParentID: &parentID},
+		// Other VRFs do not take prefixes.
+		{ID: 3, CIDR: "10.0.1.0/24", VRF: "red"},
+	}
+
+	child, err := CarveChild(parent, networks, 24)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if child.CIDR != "10.0.1.0/24" || !child.Gateway.Equal(net.ParseIP("10.0.1.1")) || child.VRF != "blue" || *child.ParentID != parentID {
+		t.Errorf("expected 10.0.1.0/24 in VRF blue below network %d, got %+v", parentID, child)
+	}
+
+	if _, err := CarveChild(parent, networks, 32); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a host route, got %v", err)
+	}
+}
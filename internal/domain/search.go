@@ -0,0 +1,186 @@
+package domain
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// SearchQuery selects what a search looks for across all networks.
+// Exactly one of IP, Prefix, Hostname and MAC is set.
+type SearchQuery struct {
+	// IP finds the records of an address and the networks containing it.
+	IP net.IP
+	// Prefix finds the records inside a prefix and the networks
+	// containing it.
+	Prefix *net.IPNet
+	// Hostname finds records by hostname. A "*" matches any run of
+	// characters; without one the hostname must match exactly.
+	Hostname string
+	// MAC finds the records of a host by its MAC address.
+	MAC net.HardwareAddr
+	// Limit caps the number of addresses returned. Zero returns all of
+	// them.
+	Limit int
+}
+
+// SearchResult holds the address records matching a search, ordered by
+// address, and the networks they were found in, ordered by ID. Released
+// records are never returned.
+type SearchResult struct {
+	Addresses []*IPAddress
+	// Networks holds the most specific network containing the IP or
+	// prefix in each VRF, or the networks of the addresses found by
+	// hostname or MAC.
+	Networks []*Network
+	// Truncated reports whether more addresses matched than Limit.
+	Truncated bool
+}
+
+// Validate checks that q looks for exactly one thing and is limited to
+// between 1 and MaxPageLimit addresses.
+func (q *SearchQuery) Validate() error {
+	set := 0
+	for _, ok := range []bool{q.IP != nil, q.Prefix != nil, q.Hostname != "", len(q.MAC) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return NewError(ErrInvalid, "exactly one of ip, prefix, hostname and mac is required")
+	}
+	if q.Hostname != "" && strings.Trim(q.Hostname, "*") == "" {
+		return NewError(ErrInvalid, "hostname pattern must contain more than wildcards").
+			WithDetail("hostname", q.Hostname)
+	}
+	if q.Limit < 1 || q.Limit > MaxPageLimit {
+		return NewError(ErrInvalid, "limit must be between 1 and %d", MaxPageLimit)
+	}
+	return nil
+}
+
+// Target returns the prefix whose containing networks q looks for: the
+// prefix itself, or a single-address prefix for an IP. It is nil for
+// searches by hostname or MAC.
+func (q *SearchQuery) Target() *net.IPNet {
+	if q.Prefix != nil {
+		return q.Prefix
+	}
+	if q.IP == nil {
+		return nil
+	}
+	if ip4 := q.IP.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: q.IP, Mask: net.CIDRMask(128, 128)}
+}
+
+// Matches reports whether ip is found by q. Released records never are.
+func (q *SearchQuery) Matches(ip *IPAddress) bool {
+	switch {
+	case ip.Status.Released():
+		return false
+	case q.IP != nil:
+		return q.IP.Equal(ip.Address)
+	case q.Prefix != nil:
+		return q.Prefix.Contains(ip.Address)
+	case len(q.MAC) > 0:
+		return bytes.Equal(q.MAC, ip.MAC)
+	default:
+		return matchWildcard(q.Hostname, ip.Hostname)
+	}
+}
+
+// Search runs q over networks and all their address records. It is
+// shared by the repositories that search in Go.
+func Search(q *SearchQuery, networks []*Network, ips []*IPAddress) (*SearchResult, error) {
+	result := &SearchResult{}
+	for _, ip := range ips {
+		if q.Matches(ip) {
+			result.Addresses = append(result.Addresses, ip)
+		}
+	}
+	sort.Slice(result.Addresses, func(i, j int) bool {
+		a, b := result.Addresses[i], result.Addresses[j]
+		if c := compareAddresses(a.Address.String(), b.Address.String()); c != 0 {
+			return c < 0
+		}
+		return a.ID < b.ID
+	})
+	if q.Limit > 0 && len(result.Addresses) > q.Limit {
+		result.Addresses = result.Addresses[:q.Limit]
+		result.Truncated = true
+	}
+
+	if target := q.Target(); target != nil {
+		containing, err := mostSpecificNetworks(networks, target)
+		if err != nil {
+			return nil, err
+		}
+		result.Networks = containing
+	} else {
+		found := make(map[int]bool)
+		for _, ip := range result.Addresses {
+			found[ip.NetworkID] = true
+		}
+		for _, network := range networks {
+			if found[network.ID] {
+				result.Networks = append(result.Networks, network)
+			}
+		}
+	}
+	sort.Slice(result.Networks, func(i, j int) bool { return result.Networks[i].ID < result.Networks[j].ID })
+	return result, nil
+}
+
+// mostSpecificNetworks returns the longest network containing target in
+// each VRF.
+func mostSpecificNetworks(networks []*Network, target *net.IPNet) ([]*Network, error) {
+	type match struct {
+		network *Network
+		ones    int
+	}
+	targetOnes, targetBits := target.Mask.Size()
+	best := make(map[string]match)
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse network CIDR: %v", err)
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits != targetBits || ones > targetOnes || !ipNet.Contains(target.IP) {
+			continue
+		}
+		if m, ok := best[network.VRF]; !ok || ones > m.ones {
+			best[network.VRF] = match{network, ones}
+		}
+	}
+	containing := make([]*Network, 0, len(best))
+	for _, m := range best {
+		containing = append(containing, m.network)
+	}
+	return containing, nil
+}
+
+// matchWildcard reports whether s matches pattern, in which "*" matches
+// any run of characters.
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
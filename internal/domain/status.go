@@ -0,0 +1,63 @@
+package domain
+
+// AddressStatus is the lifecycle state of an IP address record.
+//
+// Records are created either reserved or allocated. A reserved address has
+// no host yet but is kept out of automatic allocation. Allocated addresses
+// can be deprecated to announce their removal. Releasing an address makes
+// it quarantined while the repository's quarantine period runs, and
+// available afterwards; available records are recycled by the next
+// allocation in the network.
+type AddressStatus string
+
+const (
+	StatusAvailable   AddressStatus = "available"
+	StatusReserved    AddressStatus = "reserved"
+	StatusAllocated   AddressStatus = "allocated"
+	StatusDeprecated  AddressStatus = "deprecated"
+	StatusQuarantined AddressStatus = "quarantined"
+)
+
+// transitions lists the states each state may be moved to by a client.
+// Moving to StatusAvailable releases the address.
+var transitions = map[AddressStatus][]AddressStatus{
+	StatusReserved:   {StatusAllocated, StatusAvailable},
+	StatusAllocated:  {StatusDeprecated, StatusAvailable},
+	StatusDeprecated: {StatusAllocated, StatusAvailable},
+}
+
+// Valid reports whether s is a known status.
+func (s AddressStatus) Valid() bool {
+	switch s {
+	case StatusAvailable, StatusReserved, StatusAllocated, StatusDeprecated, StatusQuarantined:
+		return true
+	}
+	return false
+}
+
+// Released reports whether an address in state s has been released, i.e.
+// it is quarantined or available.
+func (s AddressStatus) Released() bool {
+	return s == StatusAvailable || s == StatusQuarantined
+}
+
+// ReleasedStatus returns the status a released address takes: quarantined
+// if the repository holds released addresses back, available otherwise.
+func ReleasedStatus(quarantined bool) AddressStatus {
+	if quarantined {
+		return StatusQuarantined
+	}
+	return StatusAvailable
+}
+
+// CheckTransition returns ErrConflict unless an address may move from one
+// status to the other.
+func CheckTransition(from, to AddressStatus) error {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return NewError(ErrConflict, "IP address cannot change from %s to %s", from, to).
+		WithDetail("status", string(from))
+}
@@ -0,0 +1,286 @@
+package domain
+
+import (
+	"math/big"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"time"
+)
+
+// Strategy names how a free address is picked when a request does not
+// ask for a specific one.
+type Strategy string
+
+const (
+	// StrategyFirstFree picks the lowest free address.
+	StrategyFirstFree Strategy = "first_free"
+	// StrategyLastFree picks the highest free address.
+	StrategyLastFree Strategy = "last_free"
+	// StrategyRandom picks a free address at random.
+	StrategyRandom Strategy = "random"
+	// StrategyLeastRecentlyReleased prefers addresses that were never
+	// released, then those released longest ago, like a DHCP server.
+	StrategyLeastRecentlyReleased Strategy = "least_recently_released"
+)
+
+// Valid reports whether s is a known strategy. The empty strategy is
+// valid and leaves the choice to the network or the default.
+func (s Strategy) Valid() bool {
+	switch s {
+	case "", StrategyFirstFree, StrategyLastFree, StrategyRandom, StrategyLeastRecentlyReleased:
+		return true
+	}
+	return false
+}
+
+// ResolveStrategy returns the strategy to pick addresses in network with:
+// the requested one if set, otherwise the network's. Networks without a
+// strategy use StrategyFirstFree, or StrategyRandom if they are sparse.
+func ResolveStrategy(requested Strategy, network *Network, ipNet *net.IPNet) Strategy {
+	switch {
+	case requested != "":
+		return requested
+	case network.Strategy != "":
+		return network.Strategy
+	case IsSparse(ipNet):
+		return StrategyRandom
+	}
+	return StrategyFirstFree
+}
+
+// ReleaseHistory records when the addresses of a network were last
+// released, keyed by address in String form.
+type ReleaseHistory map[string]time.Time
+
+// Picker yields the free addresses of a network in the order a Strategy
+// prefers them, each at most once. Next returns nil when none are left.
+type Picker interface {
+	Next() (net.IP, error)
+}
+
+// NewPicker returns the Picker for strategy in network. inUse reports
+// addresses that are taken; addresses that are not Allocatable are never
+// yielded. history is only called for StrategyLeastRecentlyReleased.
+func NewPicker(strategy Strategy, network *Network, ipNet *net.IPNet, inUse func(net.IP) bool, history func() (ReleaseHistory, error)) (Picker, error) {
+	ranges := AllocatableRanges(network, ipNet)
+	switch strategy {
+	case StrategyLastFree:
+		return &sequentialPicker{walk: &walker{ranges: ranges, desc: true}, inUse: inUse}, nil
+	case StrategyRandom:
+		if IsSparse(ipNet) {
+			return &probingPicker{network: network, ipNet: ipNet, inUse: inUse, yielded: make(map[string]bool)}, nil
+		}
+		return newSamplingPicker(ranges, inUse), nil
+	case StrategyLeastRecentlyReleased:
+		released, err := history()
+		if err != nil {
+			return nil, err
+		}
+		return &lruPicker{network: network, ipNet: ipNet, walk: &walker{ranges: ranges}, inUse: inUse, history: released}, nil
+	}
+	return &sequentialPicker{walk: &walker{ranges: ranges}, inUse: inUse}, nil
+}
+
+// walker yields the addresses of ascending, disjoint ranges one by one,
+// from the bottom or, with desc set, from the top.
+type walker struct {
+	ranges []IPRange
+	desc   bool
+	i      int
+	ip     net.IP
+}
+
+func (w *walker) next() net.IP {
+	for w.i < len(w.ranges) {
+		r := w.ranges[w.i]
+		first, last, step := r.Start, r.End, NextIP
+		if w.desc {
+			r = w.ranges[len(w.ranges)-1-w.i]
+			first, last, step = r.End, r.Start, PrevIP
+		}
+		switch {
+		case w.ip == nil:
+			w.ip = first
+		case w.ip.Equal(last):
+			w.ip = nil
+			w.i++
+			continue
+		default:
+			w.ip = step(w.ip)
+		}
+		return w.ip
+	}
+	return nil
+}
+
+// sequentialPicker yields free addresses in walk order.
+type sequentialPicker struct {
+	walk  *walker
+	inUse func(net.IP) bool
+}
+
+func (p *sequentialPicker) Next() (net.IP, error) {
+	for ip := p.walk.next(); ip != nil; ip = p.walk.next() {
+		if !p.inUse(ip) {
+			return ip, nil
+		}
+	}
+	return nil, nil
+}
+
+// samplingPicker yields the free addresses of a network that is not
+// sparse in random order. It tries random addresses of the allocatable
+// ranges, so only those are looked up, and after RandomProbes misses in a
+// row walks the ranges from a random address on to find the last free
+// ones of a nearly full network.
+type samplingPicker struct {
+	ranges  []IPRange
+	sizes   []int64
+	total   int64
+	inUse   func(net.IP) bool
+	yielded map[string]bool
+	walk    *walker
+}
+
+func newSamplingPicker(ranges []IPRange, inUse func(net.IP) bool) *samplingPicker {
+	p := &samplingPicker{ranges: ranges, inUse: inUse, yielded: make(map[string]bool)}
+	for _, r := range ranges {
+		// Networks that are not sparse hold at most 2^32 addresses.
+		size := rangesSize([]IPRange{r}).Int64()
+		p.sizes = append(p.sizes, size)
+		p.total += size
+	}
+	return p
+}
+
+func (p *samplingPicker) Next() (net.IP, error) {
+	if p.total == 0 {
+		return nil, nil
+	}
+	if p.walk == nil {
+		for probe := 0; probe < RandomProbes; probe++ {
+			if _, ip := p.locate(rand.Int64N(p.total)); p.free(ip) {
+				return ip, nil
+			}
+		}
+		p.walk = &walker{ranges: p.rotate(rand.Int64N(p.total))}
+	}
+	for ip := p.walk.next(); ip != nil; ip = p.walk.next() {
+		if p.free(ip) {
+			return ip, nil
+		}
+	}
+	return nil, nil
+}
+
+// free reports whether ip may be yielded, and marks it as yielded if so.
+func (p *samplingPicker) free(ip net.IP) bool {
+	if p.inUse(ip) || p.yielded[ip.String()] {
+		return false
+	}
+	p.yielded[ip.String()] = true
+	return true
+}
+
+// locate returns the index of the range holding the address at offset in
+// the ranges taken together, and that address.
+func (p *samplingPicker) locate(offset int64) (int, net.IP) {
+	i := 0
+	for offset >= p.sizes[i] {
+		offset -= p.sizes[i]
+		i++
+	}
+	start := p.ranges[i].Start
+	return i, intToIP(new(big.Int).Add(ipToInt(start), big.NewInt(offset)), len(start))
+}
+
+// rotate returns the ranges reordered to start at the address at offset
+// and wrap around below it.
+func (p *samplingPicker) rotate(offset int64) []IPRange {
+	i, ip := p.locate(offset)
+	r := p.ranges[i]
+	rotated := []IPRange{{Start: ip, End: r.End}}
+	rotated = append(rotated, p.ranges[i+1:]...)
+	rotated = append(rotated, p.ranges[:i]...)
+	if !ip.Equal(r.Start) {
+		rotated = append(rotated, IPRange{Start: r.Start, End: PrevIP(ip)})
+	}
+	return rotated
+}
+
+// probingPicker yields random free addresses of a sparse network, giving
+// up after RandomProbes misses in a row.
+type probingPicker struct {
+	network *Network
+	ipNet   *net.IPNet
+	inUse   func(net.IP) bool
+	yielded map[string]bool
+}
+
+func (p *probingPicker) Next() (net.IP, error) {
+	for probe := 0; probe < RandomProbes; probe++ {
+		ip, err := RandomAddress(p.ipNet)
+		if err != nil {
+			return nil, err
+		}
+		if !Allocatable(p.network, p.ipNet, ip) || p.inUse(ip) || p.yielded[ip.String()] {
+			continue
+		}
+		p.yielded[ip.String()] = true
+		return ip, nil
+	}
+	return nil, nil
+}
+
+// lruPicker yields the free addresses that were never released in walk
+// order, followed by the released ones from the longest ago. Only the
+// release history is sorted, so the free addresses are never collected.
+type lruPicker struct {
+	network  *Network
+	ipNet    *net.IPNet
+	walk     *walker
+	inUse    func(net.IP) bool
+	history  ReleaseHistory
+	released []net.IP
+}
+
+func (p *lruPicker) Next() (net.IP, error) {
+	for ip := p.walk.next(); ip != nil; ip = p.walk.next() {
+		if _, ok := p.history[ip.String()]; !ok && !p.inUse(ip) {
+			return ip, nil
+		}
+	}
+	if p.released == nil {
+		p.released = p.releasedAddresses()
+	}
+	for len(p.released) > 0 {
+		ip := p.released[0]
+		p.released = p.released[1:]
+		if !p.inUse(ip) {
+			return ip, nil
+		}
+	}
+	return nil, nil
+}
+
+// releasedAddresses returns the allocatable addresses of the release
+// history from the longest released ago, then in ascending order.
+func (p *lruPicker) releasedAddresses() []net.IP {
+	released := []net.IP{}
+	for address := range p.history {
+		ip := net.ParseIP(address)
+		if ip == nil || !p.ipNet.Contains(ip) || !Allocatable(p.network, p.ipNet, ip) {
+			continue
+		}
+		released = append(released, normalizeIP(ip, len(p.ipNet.IP)))
+	}
+	sort.Slice(released, func(i, j int) bool {
+		a, b := p.history[released[i].String()], p.history[released[j].String()]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return compareIP(released[i], released[j]) < 0
+	})
+	return released
+}
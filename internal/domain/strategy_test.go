@@ -0,0 +1,71 @@
+package domain
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPickers(t *testing.T) {
+	network := &Network{CIDR: "192.168.1.0/29", Gateway: net.ParseIP("192.168.1.1")}
+	ipNet := mustParseCIDR(t, network.CIDR)
+	inUse := func(ip net.IP) bool { return ip.Equal(net.ParseIP("192.168.1.3")) }
+	history := func() (ReleaseHistory, error) {
+		return ReleaseHistory{
+			"192.168.1.2": time.Unix(200, 0),
+			"192.168.1.4": time.Unix(100, 0),
+		}, nil
+	}
+
+	tests := []struct {
+		strategy Strategy
+		want     []string
+	}{
+		{StrategyFirstFree, []string{"192.168.1.2", "192.168.1.4", "192.168.1.5", "192.168.1.6"}},
+		{StrategyLastFree, []string{"192.168.1.6", "192.168.1.5", "192.168.1.4", "192.168.1.2"}},
+		{StrategyLeastRecentlyReleased, []string{"192.168.1.5", "192.168.1.6", "192.168.1.4", "192.168.1.2"}},
+		{StrategyRandom, nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			p, err := NewPicker(tt.strategy, network, ipNet, inUse, history)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for {
+				ip, err := p.Next()
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if ip == nil || len(got) > 4 {
+					break
+				}
+				got = append(got, ip.String())
+			}
+			if tt.want == nil {
+				// Random picks yield every free address once, in any order.
+				slices.SortFunc(got, compareAddresses)
+				tt.want = tests[0].want
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRandomPickerNearlyFull(t *testing.T) {
+	// With a single free address in a /20, sampling misses and the picker
+	// has to fall back to walking the network.
+	network := &Network{CIDR: "10.0.0.0/20", Gateway: net.ParseIP("10.0.0.1")}
+	free := net.ParseIP("10.0.8.0")
+	p, err := NewPicker(StrategyRandom, network, mustParseCIDR(t, network.CIDR), func(ip net.IP) bool { return !ip.Equal(free) }, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip, err := p.Next(); err != nil || !ip.Equal(free) {
+		t.Errorf("expected %s, got %s (%v)", free, ip, err)
+	}
+}
@@ -0,0 +1,147 @@
+package domain
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Utilization reports how much of the address space of a network is in
+// use. Counts are big integers since IPv6 networks outgrow int64.
+type Utilization struct {
+	// Network is the network reported on, or nil for a sum over several.
+	Network *Network
+	// Total counts the addresses hosts can be given: all addresses of the
+	// network but the network, broadcast, subnet-router anycast and
+	// gateway addresses.
+	Total *big.Int
+	// Allocated counts the addresses held by hosts, deprecated included.
+	Allocated *big.Int
+	// Reserved counts the addresses kept from hosts otherwise: those in
+	// reserved ranges, in status reserved, or released and in quarantine.
+	Reserved *big.Int
+	// Free counts the addresses left for allocation.
+	Free *big.Int
+	// Level grades the utilization against the configured thresholds.
+	Level UtilizationLevel
+}
+
+// PercentUsed returns the share of Total that is allocated or reserved,
+// in percent. It is 0 if there are no usable addresses, so that such
+// networks, like a /32 holding only its gateway, are never flagged.
+func (u *Utilization) PercentUsed() float64 {
+	if u.Total.Sign() == 0 {
+		return 0
+	}
+	used := new(big.Float).SetInt(new(big.Int).Sub(u.Total, u.Free))
+	percent, _ := used.Quo(used.Mul(used, big.NewFloat(100)), new(big.Float).SetInt(u.Total)).Float64()
+	return percent
+}
+
+// Add adds the counts of other to u.
+func (u *Utilization) Add(other *Utilization) {
+	u.Total.Add(u.Total, other.Total)
+	u.Allocated.Add(u.Allocated, other.Allocated)
+	u.Reserved.Add(u.Reserved, other.Reserved)
+	u.Free.Add(u.Free, other.Free)
+}
+
+// NewUtilizationSum returns an empty Utilization to Add networks to.
+func NewUtilizationSum() *Utilization {
+	return &Utilization{Total: new(big.Int), Allocated: new(big.Int), Reserved: new(big.Int), Free: new(big.Int)}
+}
+
+// AddressCounts tallies the address records of a network for
+// NewUtilization.
+type AddressCounts struct {
+	// Allocated counts records that are allocated or deprecated.
+	Allocated int64
+	// Held counts records that are reserved or still in quarantine.
+	Held int64
+	// InReserved counts the records of either kind inside a reserved
+	// range, which are already part of the range's addresses.
+	InReserved int64
+}
+
+// Add counts ip, a record of network. Released records are only counted
+// if they were released after cutoff, the end of the quarantine period;
+// the others are free.
+func (c *AddressCounts) Add(network *Network, ip *IPAddress, cutoff time.Time) {
+	switch {
+	case ip.Status == StatusAllocated || ip.Status == StatusDeprecated:
+		c.Allocated++
+	case ip.Status.Released() && ip.ReleasedAt != nil && !ip.ReleasedAt.After(cutoff):
+		return
+	default:
+		c.Held++
+	}
+	for _, r := range network.Reserved {
+		if r.Contains(ip.Address) {
+			c.InReserved++
+			return
+		}
+	}
+}
+
+// NewUtilization computes the utilization of network from the counts of
+// its address records.
+func NewUtilization(network *Network, counts AddressCounts) (*Utilization, error) {
+	_, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network CIDR: %v", err)
+	}
+	unreserved := *network
+	unreserved.Reserved = nil
+	total := rangesSize(AllocatableRanges(&unreserved, ipNet))
+
+	reserved := new(big.Int).Sub(total, rangesSize(AllocatableRanges(network, ipNet)))
+	reserved.Add(reserved, big.NewInt(counts.Held-counts.InReserved))
+	allocated := big.NewInt(counts.Allocated)
+	free := new(big.Int).Sub(total, allocated)
+	free.Sub(free, reserved)
+	if free.Sign() < 0 {
+		// Records the network no longer leaves room for, such as one on a
+		// gateway that was moved, are not free space to begin with.
+		free.SetInt64(0)
+	}
+	return &Utilization{Network: network, Total: total, Allocated: allocated, Reserved: reserved, Free: free}, nil
+}
+
+// rangesSize returns the number of addresses in ranges.
+func rangesSize(ranges []IPRange) *big.Int {
+	size := new(big.Int)
+	for _, r := range ranges {
+		size.Add(size, new(big.Int).Sub(ipToInt(r.End), ipToInt(r.Start)))
+		size.Add(size, big.NewInt(1))
+	}
+	return size
+}
+
+// UtilizationLevel grades how close a network is to exhaustion.
+type UtilizationLevel string
+
+const (
+	UtilizationOK       UtilizationLevel = "ok"
+	UtilizationWarning  UtilizationLevel = "warning"
+	UtilizationCritical UtilizationLevel = "critical"
+)
+
+// UtilizationThresholds are the high-water marks, in percent used, at
+// which a network is flagged. A zero threshold is never reached.
+type UtilizationThresholds struct {
+	Warning  float64
+	Critical float64
+}
+
+// Level returns the level of u under the thresholds.
+func (t UtilizationThresholds) Level(u *Utilization) UtilizationLevel {
+	percent := u.PercentUsed()
+	switch {
+	case t.Critical > 0 && percent >= t.Critical:
+		return UtilizationCritical
+	case t.Warning > 0 && percent >= t.Warning:
+		return UtilizationWarning
+	}
+	return UtilizationOK
+}
@@ -0,0 +1,39 @@
+package domain
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewUtilization(t *testing.T) {
+	tests := []struct {
+		name    string
+		network *Network
+		counts  AddressCounts
+		want    [4]string // total, allocated, reserved, free
+		percent float64
+	}{
+		{"Reserved range and records", &Network{CIDR: "192.168.1.0/24", Gateway: net.ParseIP("192.168.1.1"),
+			Reserved: []IPRange{{Start: net.ParseIP("192.168.1.10"), End: net.ParseIP("192.168.1.19")}}},
+			AddressCounts{Allocated: 5, Held: 3, InReserved: 1}, [4]string{"253", "5", "12", "236"}, 6.719367588932807},
+		{"Host /32 holding the gateway", &Network{CIDR: "10.0.0.5/32", Gateway: net.ParseIP("10.0.0.5")},
+			AddressCounts{}, [4]string{"0", "0", "0", "0"}, 0},
+		{"IPv6 /64", &Network{CIDR: "2001:db8::/64", Gateway: net.ParseIP("2001:db8::1")},
+			AddressCounts{Allocated: 2, Held: 1}, [4]string{"18446744073709551614", "2", "1", "18446744073709551611"}, 1.6263032587282567e-17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := NewUtilization(tt.network, tt.counts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := [4]string{u.Total.String(), u.Allocated.String(), u.Reserved.String(), u.Free.String()}
+			if got != tt.want {
+				t.Errorf("expected total, allocated, reserved and free %v, got %v", tt.want, got)
+			}
+			if percent := u.PercentUsed(); percent != tt.percent {
+				t.Errorf("expected %g%% used, got %g%%", tt.percent, percent)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KVPair is a single entry of the Consul KV store.
+type KVPair struct {
+	Key         string
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+}
+
+// TxnOp is a KV operation executed as part of a Consul transaction.
+// Verbs used by this package are "cas", "delete", "delete-cas" and "get".
+type TxnOp struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+	Index uint64 `json:",omitempty"`
+}
+
+// Client is a minimal client for the Consul KV and transaction HTTP API.
+type Client struct {
+	address    string
+	token      string
+	datacenter string
+	httpClient *http.Client
+}
+
+func NewClient(address, token, datacenter string) *Client {
+	return &Client{
+		address:    strings.TrimRight(address, "/"),
+		token:      token,
+		datacenter: datacenter,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Get returns the pair stored at key, or nil if the key does not exist.
+func (c *Client) Get(key string) (*KVPair, error) {
+	pairs, err := c.get(key, false)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	return pairs[0], nil
+}
+
+// List returns every pair whose key starts with prefix.
+func (c *Client) List(prefix string) ([]*KVPair, error) {
+	return c.get(prefix, true)
+}
+
+// Txn executes ops atomically. It returns false without an error when
+// Consul rolled the transaction back, e.g. because a check-and-set index
+// no longer matched.
+func (c *Client) Txn(ops []TxnOp) (bool, []*KVPair, error) {
+	body := make([]struct{ KV TxnOp }, len(ops))
+	for i, op := range ops {
+		body[i].KV = op
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to encode transaction: %v", err)
+	}
+
+	resp, err := c.do(http.MethodPut, "/v1/txn", nil, bytes.NewReader(buf))
+	if err != nil {
+		return false, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return false, nil, nil
+	default:
+		return false, nil, unexpectedStatus(resp)
+	}
+
+	var result struct {
+		Results []struct{ KV *KVPair }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, nil, fmt.Errorf("failed to decode transaction response: %v", err)
+	}
+	pairs := make([]*KVPair, 0, len(result.Results))
+	for _, r := range result.Results {
+		if r.KV != nil {
+			pairs = append(pairs, r.KV)
+		}
+	}
+	return true, pairs, nil
+}
+
+func (c *Client) get(key string, recurse bool) ([]*KVPair, error) {
+	query := url.Values{}
+	if recurse {
+		query.Set("recurse", "")
+	}
+	resp, err := c.do(http.MethodGet, "/v1/kv/"+key, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, unexpectedStatus(resp)
+	}
+
+	var pairs []*KVPair
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, fmt.Errorf("failed to decode KV response: %v", err)
+	}
+	return pairs, nil
+}
+
+func (c *Client) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.datacenter != "" {
+		query.Set("dc", c.datacenter)
+	}
+	u := c.address + (&url.URL{Path: path}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build consul request: %v", err)
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("consul request failed: %v", err)
+	}
+	return resp, nil
+}
+
+func unexpectedStatus(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("consul returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,137 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeConsul is an in-process stand-in for the subset of the Consul HTTP
+// API used by Client: KV reads and KV transactions.
+type fakeConsul struct {
+	mu    sync.Mutex
+	index uint64
+	kv    map[string]*KVPair
+}
+
+func newFakeConsul(t *testing.T) *httptest.Server {
+	t.Helper()
+	f := &fakeConsul{kv: make(map[string]*KVPair)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.get(w, r)
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/txn":
+		f.txn(w, r)
+	default:
+		http.Error(w, "unsupported", http.StatusNotFound)
+	}
+}
+
+func (f *fakeConsul) get(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	var pairs []*KVPair
+	if _, recurse := r.URL.Query()["recurse"]; recurse {
+		for k, pair := range f.kv {
+			if strings.HasPrefix(k, key) {
+				pairs = append(pairs, pair)
+			}
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	} else if pair, ok := f.kv[key]; ok {
+		pairs = append(pairs, pair)
+	}
+
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func (f *fakeConsul) txn(w http.ResponseWriter, r *http.Request) {
+	var ops []struct{ KV TxnOp }
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	type txnError struct {
+		OpIndex int
+		What    string
+	}
+	var errs []txnError
+	for i, op := range ops {
+		current, exists := f.kv[op.KV.Key]
+		switch op.KV.Verb {
+		case "cas":
+			if op.KV.Index == 0 && exists {
+				errs = append(errs, txnError{i, "key exists"})
+			} else if op.KV.Index != 0 && (!exists || current.ModifyIndex != op.KV.Index) {
+				errs = append(errs, txnError{i, "index mismatch"})
+			}
+		case "check-index", "delete-cas":
+			if !exists || current.ModifyIndex != op.KV.Index {
+				errs = append(errs, txnError{i, "index mismatch"})
+			}
+		case "get":
+			if !exists {
+				errs = append(errs, txnError{i, "key not found"})
+			}
+		case "check-not-exists":
+			if exists {
+				errs = append(errs, txnError{i, "key exists"})
+			}
+		case "set", "delete", "delete-tree":
+		default:
+			errs = append(errs, txnError{i, "unsupported verb " + op.KV.Verb})
+		}
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Errors": errs})
+		return
+	}
+
+	f.index++
+	var results []map[string]*KVPair
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case "cas", "set":
+			pair, exists := f.kv[op.KV.Key]
+			if !exists {
+				pair = &KVPair{Key: op.KV.Key, CreateIndex: f.index}
+				f.kv[op.KV.Key] = pair
+			}
+			pair.Value = op.KV.Value
+			pair.ModifyIndex = f.index
+			results = append(results, map[string]*KVPair{"KV": {Key: pair.Key, CreateIndex: pair.CreateIndex, ModifyIndex: pair.ModifyIndex}})
+		case "get", "check-index":
+			results = append(results, map[string]*KVPair{"KV": f.kv[op.KV.Key]})
+		case "delete", "delete-cas":
+			delete(f.kv, op.KV.Key)
+		case "delete-tree":
+			for k := range f.kv {
+				if strings.HasPrefix(k, op.KV.Key) {
+					delete(f.kv, k)
+				}
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+}
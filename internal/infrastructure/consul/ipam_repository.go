@@ -0,0 +1,1225 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+)
+
+// maxTxnAttempts bounds how often a write is retried after another
+// server instance won a check-and-set race.
+const maxTxnAttempts = 16
+
+// maxTxnOps is the number of operations Consul accepts in one transaction.
+const maxTxnOps = 64
+
+// idBlockSize is the number of IP IDs a server reserves from the sequence
+// at once.
+const idBlockSize = 64
+
+// IPAMRepository stores networks and allocations in the Consul KV store.
+//
+// Keys are laid out below the configured prefix as follows:
+//
+//	<prefix>/sequences/{networks,ips}        last issued or reserved ID
+//	<prefix>/networks/<id>                   domain.Network as JSON
+//	<prefix>/revisions/<network>             count of allocations and releases
+//	<prefix>/ips/<id>                        domain.IPAddress as JSON
+//	<prefix>/addresses/<network>/<address>   ID of the IP holding the address
+//	<prefix>/hostnames/<network>/<hostname>  ID of the IP holding the hostname
+//	<prefix>/idempotency/<network>/<key>     ID of the IP allocated with the key
+//	<prefix>/recycle/<network>/<id>          release time of a released IP
+//	<prefix>/released/<network>/<address>    time the address was last released
+//
+// Every write is a single transaction guarded by check-and-set indexes,
+// so concurrent allocations from several servers never hand out the same
+// address, hostname or idempotency key twice. A released address keeps
+// its address key until the quarantine has passed and the next
+// allocation recycles it.
+type IPAMRepository struct {
+	client     *Client
+	prefix     string
+	quarantine time.Duration
+
+	// mu guards the block of reserved IP IDs, nextIPID up to endIPID.
+	mu       sync.Mutex
+	nextIPID int
+	endIPID  int
+}
+
+type Option func(*IPAMRepository)
+
+// WithQuarantine keeps released addresses out of allocation for d.
+func WithQuarantine(d time.Duration) Option {
+	return func(r *IPAMRepository) {
+		r.quarantine = d
+	}
+}
+
+func NewIPAMRepository(client *Client, prefix string, opts ...Option) *IPAMRepository {
+	r := &IPAMRepository{client: client, prefix: strings.Trim(prefix, "/")}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *IPAMRepository) CreateNetwork(network *domain.Network) error {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		id, seqOp, err := r.nextID("networks", 1)
+		if err != nil {
+			return fmt.Errorf("failed to create network: %v", err)
+		}
+		// Every creation moves the network sequence, so a network created
+		// after this listing makes the transaction below fail and the check
+		// run again.
+		networks, _, err := r.ListNetworks(nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := domain.CheckOverlap(network, networks); err != nil {
+			return err
+		}
+
+		created := *network
+		created.ID = id
+		value, err := json.Marshal(&created)
+		if err != nil {
+			return fmt.Errorf("failed to encode network: %v", err)
+		}
+		ops := []TxnOp{
+			seqOp,
+			{Verb: "cas", Key: r.networkKey(id), Value: value},
+		}
+		if network.ParentID != nil {
+			parentOp, err := r.touchParentOp(*network.ParentID)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, parentOp)
+		}
+
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return fmt.Errorf("failed to create network: %v", err)
+		}
+		if ok {
+			network.ID = id
+			return nil
+		}
+	}
+	return errTooManyUpdates("create network")
+}
+
+func (r *IPAMRepository) AllocateChildNetwork(parentID, ones int) (*domain.Network, error) {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		parent, parentIndex, err := r.getNetwork(parentID)
+		if err != nil {
+			return nil, err
+		}
+		id, seqOp, err := r.nextID("networks", 1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create network: %v", err)
+		}
+		networks, _, err := r.ListNetworks(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		child, err := domain.CarveChild(parent, networks, ones)
+		if err != nil {
+			return nil, err
+		}
+
+		child.ID = id
+		value, err := json.Marshal(child)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode network: %v", err)
+		}
+		parentValue, err := json.Marshal(parent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode network: %v", err)
+		}
+		ok, _, err := r.client.Txn([]TxnOp{
+			seqOp,
+			{Verb: "cas", Key: r.networkKey(parentID), Value: parentValue, Index: parentIndex},
+			{Verb: "cas", Key: r.networkKey(id), Value: value},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create network: %v", err)
+		}
+		if ok {
+			return child, nil
+		}
+	}
+	return nil, errTooManyUpdates("create network")
+}
+
+func (r *IPAMRepository) GetNetwork(id int) (*domain.Network, error) {
+	network, _, err := r.getNetwork(id)
+	return network, err
+}
+
+func (r *IPAMRepository) ListNetworks(filter *domain.NetworkFilter, page *domain.Page) ([]*domain.Network, string, error) {
+	pairs, err := r.client.List(r.key("networks") + "/")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list networks: %v", err)
+	}
+
+	var networks []*domain.Network
+	for _, pair := range pairs {
+		var network domain.Network
+		if err := json.Unmarshal(pair.Value, &network); err != nil {
+			return nil, "", fmt.Errorf("failed to decode network %s: %v", pair.Key, err)
+		}
+		if filter.Matches(&network) {
+			networks = append(networks, &network)
+		}
+	}
+	return domain.PageNetworks(networks, page)
+}
+
+func (r *IPAMRepository) UpdateNetwork(network *domain.Network) error {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		current, index, err := r.getNetwork(network.ID)
+		if err != nil {
+			return err
+		}
+
+		updated := *network
+		updated.CIDR = current.CIDR
+		updated.VRF = current.VRF
+		updated.ParentID = current.ParentID
+		value, err := json.Marshal(&updated)
+		if err != nil {
+			return fmt.Errorf("failed to encode network: %v", err)
+		}
+		ops := []TxnOp{
+			{Verb: "cas", Key: r.networkKey(network.ID), Value: value, Index: index},
+		}
+
+		// The new gateway must not be held by an allocated address, and
+		// must stay that way until the update is committed.
+		addressKey := r.addressKey(network.ID, network.Gateway)
+		pair, err := r.client.Get(addressKey)
+		if err != nil {
+			return fmt.Errorf("failed to check gateway address: %v", err)
+		}
+		if pair == nil {
+			ops = append(ops, TxnOp{Verb: "check-not-exists", Key: addressKey})
+		} else {
+			ipID, err := strconv.Atoi(string(pair.Value))
+			if err != nil {
+				return fmt.Errorf("invalid address key %s: %v", pair.Key, err)
+			}
+			ip, _, err := r.getIP(ipID)
+			if err != nil {
+				return err
+			}
+			if ip != nil && !ip.Status.Released() {
+				return domain.NewError(domain.ErrConflict, "gateway %s is allocated to IP address %d", network.Gateway, ip.ID).
+					WithDetail("address", network.Gateway.String())
+			}
+			ops = append(ops, TxnOp{Verb: "check-index", Key: addressKey, Index: pair.ModifyIndex})
+		}
+
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return fmt.Errorf("failed to update network: %v", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errTooManyUpdates("update network")
+}
+
+func (r *IPAMRepository) DeleteNetwork(id int, force bool) error {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		_, index, err := r.getNetwork(id)
+		if err != nil {
+			return err
+		}
+		// Creating a child rewrites its parent, so a child created after
+		// this listing makes the delete below fail and start over.
+		networks, _, err := r.ListNetworks(nil, nil)
+		if err != nil {
+			return err
+		}
+		for _, child := range networks {
+			if child.ParentID != nil && *child.ParentID == id {
+				return domain.NewError(domain.ErrConflict, "network %d has child networks", id).
+					WithDetail("child_id", strconv.Itoa(child.ID))
+			}
+		}
+
+		// Allocations and releases bump the revision, so one committed
+		// after this read makes the delete below fail and start over.
+		revision, err := r.client.Get(r.revisionKey(id))
+		if err != nil {
+			return fmt.Errorf("failed to get revision of network %d: %v", id, err)
+		}
+		revisionCheck := TxnOp{Verb: "check-not-exists", Key: r.revisionKey(id)}
+		if revision != nil {
+			revisionCheck = TxnOp{Verb: "check-index", Key: r.revisionKey(id), Index: revision.ModifyIndex}
+		}
+
+		ips, indexes, err := r.listIPs(id)
+		if err != nil {
+			return err
+		}
+		if !force {
+			allocated := 0
+			for _, ip := range ips {
+				if !ip.Status.Released() {
+					allocated++
+				}
+			}
+			if allocated > 0 {
+				return domain.NewError(domain.ErrConflict, "network %d has %d allocated IP addresses", id, allocated).
+					WithDetail("allocated", strconv.Itoa(allocated))
+			}
+		}
+
+		ops := []TxnOp{
+			{Verb: "delete-cas", Key: r.networkKey(id), Index: index},
+			revisionCheck,
+			{Verb: "delete", Key: r.revisionKey(id)},
+			{Verb: "delete-tree", Key: r.key("addresses", strconv.Itoa(id)) + "/"},
+			{Verb: "delete-tree", Key: r.key("hostnames", strconv.Itoa(id)) + "/"},
+			{Verb: "delete-tree", Key: r.key("idempotency", strconv.Itoa(id)) + "/"},
+			{Verb: "delete-tree", Key: r.key("released", strconv.Itoa(id)) + "/"},
+			{Verb: "delete-tree", Key: r.key("recycle", strconv.Itoa(id)) + "/"},
+		}
+		// The records go in the same transaction as the network, so none
+		// outlives it. When there are too many for one transaction, they
+		// are removed in batches first and the delete starts over with
+		// whatever is left.
+		if len(ops)+len(ips) > maxTxnOps {
+			if err := r.purgeIPs(ips, indexes); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, ip := range ips {
+			ops = append(ops, TxnOp{Verb: "delete-cas", Key: r.ipKey(ip.ID), Index: indexes[ip.ID]})
+		}
+
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return fmt.Errorf("failed to delete network: %v", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errTooManyUpdates("delete network")
+}
+
+// purgeIPs deletes IP records together with their address, hostname and
+// idempotency keys, batching as many records per transaction as Consul
+// accepts. A batch holding a record changed since it was read is rolled
+// back and left for the caller to retry.
+func (r *IPAMRepository) purgeIPs(ips []*domain.IPAddress, indexes map[int]uint64) error {
+	var batch []TxnOp
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, _, err := r.client.Txn(batch); err != nil {
+			return fmt.Errorf("failed to delete IP addresses: %v", err)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for _, ip := range ips {
+		ops := []TxnOp{
+			{Verb: "delete-cas", Key: r.ipKey(ip.ID), Index: indexes[ip.ID]},
+			{Verb: "delete", Key: r.addressKey(ip.NetworkID, ip.Address)},
+		}
+		if ip.Hostname != "" {
+			ops = append(ops, TxnOp{Verb: "delete", Key: r.hostnameKey(ip.NetworkID, ip.Hostname)})
+		}
+		if ip.IdempotencyKey != "" {
+			ops = append(ops, TxnOp{Verb: "delete", Key: r.idempotencyKey(ip.NetworkID, ip.IdempotencyKey)})
+		}
+		if ip.Status.Released() {
+			ops = append(ops, TxnOp{Verb: "delete", Key: r.recycleKey(ip.NetworkID, ip.ID)})
+		}
+		if len(batch)+len(ops) > maxTxnOps {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, ops...)
+	}
+	return flush()
+}
+
+func (r *IPAMRepository) AllocateIP(req *domain.AllocationRequest) (*domain.IPAddress, error) {
+	networkID, hostname := req.NetworkID, req.Hostname
+	ids, err := r.reserveIPIDs(1)
+	if err != nil {
+		return nil, err
+	}
+	id := ids[0]
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		network, networkIndex, err := r.getNetwork(networkID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := r.recycleReleased(networkID); err != nil {
+			return nil, err
+		}
+
+		if hostname != "" {
+			pair, err := r.client.Get(r.hostnameKey(networkID, hostname))
+			if err != nil {
+				return nil, fmt.Errorf("failed to check hostname uniqueness: %v", err)
+			}
+			if pair != nil {
+				return nil, domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", hostname).
+					WithDetail("hostname", hostname)
+			}
+		}
+
+		if req.IdempotencyKey != "" {
+			pair, err := r.client.Get(r.idempotencyKey(networkID, req.IdempotencyKey))
+			if err != nil {
+				return nil, fmt.Errorf("failed to check idempotency key uniqueness: %v", err)
+			}
+			if pair != nil {
+				return nil, domain.NewError(domain.ErrConflict, "idempotency key %s is already in use in this network", req.IdempotencyKey).
+					WithDetail("idempotency_key", req.IdempotencyKey)
+			}
+		}
+
+		used, err := r.usedAddresses(networkID)
+		if err != nil {
+			return nil, err
+		}
+
+		address, err := domain.SelectAddress(network, req, func(ip net.IP) bool { return used[ip.String()] }, r.history(networkID))
+		if err != nil {
+			return nil, err
+		}
+
+		revisionOp, err := r.revisionOp(networkID)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now().UTC()
+		ip := &domain.IPAddress{
+			ID:             id,
+			NetworkID:      networkID,
+			Address:        address,
+			Hostname:       hostname,
+			Status:         req.InitialStatus(),
+			MAC:            req.MAC,
+			Description:    req.Description,
+			Owner:          req.Owner,
+			Tags:           req.Tags,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+			LeaseExpiresAt: domain.LeaseExpiry(now, req.Lease),
+			IdempotencyKey: req.IdempotencyKey,
+		}
+		value, err := json.Marshal(ip)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode IP address: %v", err)
+		}
+
+		ops := []TxnOp{
+			revisionOp,
+			{Verb: "check-index", Key: r.networkKey(networkID), Index: networkIndex},
+			{Verb: "cas", Key: r.addressKey(networkID, address), Value: []byte(strconv.Itoa(id))},
+			{Verb: "cas", Key: r.ipKey(id), Value: value},
+		}
+		if hostname != "" {
+			ops = append(ops, TxnOp{Verb: "cas", Key: r.hostnameKey(networkID, hostname), Value: []byte(strconv.Itoa(id))})
+		}
+		if req.IdempotencyKey != "" {
+			ops = append(ops, TxnOp{Verb: "cas", Key: r.idempotencyKey(networkID, req.IdempotencyKey), Value: []byte(strconv.Itoa(id))})
+		}
+
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate IP address: %v", err)
+		}
+		if ok {
+			return ip, nil
+		}
+	}
+	return nil, errTooManyUpdates("allocate IP address")
+}
+
+// AllocateIPs writes all records in one transaction, so the size of a
+// bulk allocation is limited by the number of operations Consul accepts.
+func (r *IPAMRepository) AllocateIPs(req *domain.BulkAllocationRequest) ([]*domain.IPAddress, error) {
+	networkID, n := req.NetworkID, req.Size()
+
+	opsPerIP := 2
+	if len(req.Hostnames) > 0 {
+		opsPerIP = 3
+	}
+	if limit := (maxTxnOps - 2) / opsPerIP; n > limit {
+		return nil, domain.NewError(domain.ErrInvalid, "the Consul backend cannot allocate more than %d IP addresses at once", limit).
+			WithDetail("count", strconv.Itoa(n)).
+			WithDetail("limit", strconv.Itoa(limit))
+	}
+
+	ids, err := r.reserveIPIDs(n)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		network, networkIndex, err := r.getNetwork(networkID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := r.recycleReleased(networkID); err != nil {
+			return nil, err
+		}
+
+		for _, hostname := range req.Hostnames {
+			pair, err := r.client.Get(r.hostnameKey(networkID, hostname))
+			if err != nil {
+				return nil, fmt.Errorf("failed to check hostname uniqueness: %v", err)
+			}
+			if pair != nil {
+				return nil, domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", hostname).
+					WithDetail("hostname", hostname)
+			}
+		}
+
+		used, err := r.usedAddresses(networkID)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses, err := domain.SelectAddresses(network, req, func(ip net.IP) bool { return used[ip.String()] }, r.history(networkID))
+		if err != nil {
+			return nil, err
+		}
+
+		revisionOp, err := r.revisionOp(networkID)
+		if err != nil {
+			return nil, err
+		}
+
+		ops := []TxnOp{
+			revisionOp,
+			{Verb: "check-index", Key: r.networkKey(networkID), Index: networkIndex},
+		}
+		now := time.Now().UTC()
+		ips := make([]*domain.IPAddress, n)
+		for i, address := range addresses {
+			ip := &domain.IPAddress{
+				ID:             ids[i],
+				NetworkID:      networkID,
+				Address:        address,
+				Hostname:       req.Hostname(i),
+				Status:         req.InitialStatus(),
+				Description:    req.Description,
+				Owner:          req.Owner,
+				Tags:           req.Tags,
+				CreatedAt:      now,
+				UpdatedAt:      now,
+				LeaseExpiresAt: domain.LeaseExpiry(now, req.Lease),
+			}
+			value, err := json.Marshal(ip)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode IP address: %v", err)
+			}
+			ops = append(ops,
+				TxnOp{Verb: "cas", Key: r.addressKey(networkID, address), Value: []byte(strconv.Itoa(ip.ID))},
+				TxnOp{Verb: "cas", Key: r.ipKey(ip.ID), Value: value},
+			)
+			if ip.Hostname != "" {
+				ops = append(ops, TxnOp{Verb: "cas", Key: r.hostnameKey(networkID, ip.Hostname), Value: []byte(strconv.Itoa(ip.ID))})
+			}
+			ips[i] = ip
+		}
+
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate IP addresses: %v", err)
+		}
+		if ok {
+			return ips, nil
+		}
+	}
+	return nil, errTooManyUpdates("allocate IP addresses")
+}
+
+func (r *IPAMRepository) ReleaseIP(id int) error {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		ip, index, err := r.getIP(id)
+		if err != nil {
+			return err
+		}
+		if ip == nil {
+			return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+		}
+		if ip.Status.Released() {
+			return domain.NewError(domain.ErrConflict, "IP address %d has been released", id).
+				WithDetail("status", string(ip.Status))
+		}
+
+		ops, err := r.releaseOps(ip, index, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return fmt.Errorf("failed to release IP address: %v", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errTooManyUpdates("release IP address")
+}
+
+func (r *IPAMRepository) RenewLease(id int, expiresAt time.Time) error {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		ip, index, err := r.getIP(id)
+		if err != nil {
+			return err
+		}
+		if ip == nil {
+			return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+		}
+		if ip.Status.Released() {
+			return domain.NewError(domain.ErrConflict, "IP address %d has been released", id).
+				WithDetail("status", string(ip.Status))
+		}
+
+		renewed := *ip
+		expiresAt = expiresAt.UTC()
+		renewed.LeaseExpiresAt = &expiresAt
+		renewed.UpdatedAt = time.Now().UTC()
+		value, err := json.Marshal(&renewed)
+		if err != nil {
+			return fmt.Errorf("failed to encode IP address: %v", err)
+		}
+
+		ok, _, err := r.client.Txn([]TxnOp{
+			{Verb: "cas", Key: r.ipKey(id), Value: value, Index: index},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to renew lease: %v", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errTooManyUpdates("renew lease")
+}
+
+// ExpireLeases releases each expired address in its own transaction. An
+// address renewed or released concurrently fails its check-and-set and is
+// left alone; if it is still expired, the next call picks it up.
+func (r *IPAMRepository) ExpireLeases(now time.Time) ([]*domain.IPAddress, error) {
+	pairs, err := r.client.List(r.key("ips") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IP addresses: %v", err)
+	}
+
+	var expired []*domain.IPAddress
+	for _, pair := range pairs {
+		var ip domain.IPAddress
+		if err := json.Unmarshal(pair.Value, &ip); err != nil {
+			return nil, fmt.Errorf("failed to decode IP address %s: %v", pair.Key, err)
+		}
+		if !domain.LeaseExpired(&ip, now) {
+			continue
+		}
+
+		ops, err := r.releaseOps(&ip, pair.ModifyIndex, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expire lease of IP address %d: %v", ip.ID, err)
+		}
+		if ok {
+			expired = append(expired, &ip)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ID < expired[j].ID })
+	return expired, nil
+}
+
+// releaseOps returns the transaction releasing ip, guarded by the
+// ModifyIndex of its record.
+func (r *IPAMRepository) releaseOps(ip *domain.IPAddress, index uint64, now time.Time) ([]TxnOp, error) {
+	released := *ip
+	released.Hostname = ""
+	released.Status = domain.ReleasedStatus(r.quarantine > 0)
+	released.MAC = nil
+	released.Description = ""
+	released.Owner = ""
+	released.Tags = nil
+	released.UpdatedAt = now
+	released.ReleasedAt = &now
+	released.LeaseExpiresAt = nil
+	released.IdempotencyKey = ""
+	value, err := json.Marshal(&released)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode IP address: %v", err)
+	}
+
+	revisionOp, err := r.revisionOp(ip.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The address key stays in place until recycleReleased removes it.
+	ops := []TxnOp{
+		{Verb: "cas", Key: r.ipKey(ip.ID), Value: value, Index: index},
+		revisionOp,
+		{Verb: "set", Key: r.recycleKey(ip.NetworkID, ip.ID), Value: []byte(now.Format(time.RFC3339Nano))},
+	}
+	if ip.Hostname != "" {
+		ops = append(ops, TxnOp{Verb: "delete", Key: r.hostnameKey(ip.NetworkID, ip.Hostname)})
+	}
+	if ip.IdempotencyKey != "" {
+		ops = append(ops, TxnOp{Verb: "delete", Key: r.idempotencyKey(ip.NetworkID, ip.IdempotencyKey)})
+	}
+	return ops, nil
+}
+
+func (r *IPAMRepository) UpdateIPStatus(id int, from, to domain.AddressStatus) error {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		ip, index, err := r.getIP(id)
+		if err != nil {
+			return err
+		}
+		if ip == nil {
+			return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+		}
+		if ip.Status != from {
+			return domain.NewError(domain.ErrConflict, "IP address %d is %s, not %s", id, ip.Status, from).
+				WithDetail("status", string(ip.Status))
+		}
+
+		updated := *ip
+		updated.Status = to
+		updated.UpdatedAt = time.Now().UTC()
+		value, err := json.Marshal(&updated)
+		if err != nil {
+			return fmt.Errorf("failed to encode IP address: %v", err)
+		}
+
+		ok, _, err := r.client.Txn([]TxnOp{
+			{Verb: "cas", Key: r.ipKey(id), Value: value, Index: index},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update IP status: %v", err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errTooManyUpdates("update IP status")
+}
+
+func (r *IPAMRepository) GetIP(id int) (*domain.IPAddress, error) {
+	ip, _, err := r.getIP(id)
+	if err == nil && ip == nil {
+		return nil, domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
+	return ip, err
+}
+
+func (r *IPAMRepository) GetIPByHostname(networkID int, hostname string) (*domain.IPAddress, error) {
+	ip, err := r.getIPByIndexKey(r.hostnameKey(networkID, hostname))
+	if err == nil && ip == nil {
+		return nil, domain.NewError(domain.ErrNotFound, "no IP address with hostname %s in network %d", hostname, networkID)
+	}
+	return ip, err
+}
+
+func (r *IPAMRepository) GetIPByIdempotencyKey(networkID int, key string) (*domain.IPAddress, error) {
+	ip, err := r.getIPByIndexKey(r.idempotencyKey(networkID, key))
+	if err == nil && ip == nil {
+		return nil, domain.NewError(domain.ErrNotFound, "no IP address with idempotency key %s in network %d", key, networkID)
+	}
+	return ip, err
+}
+
+func (r *IPAMRepository) ListIPs(networkID int, filter *domain.IPFilter, page *domain.Page) ([]*domain.IPAddress, string, error) {
+	ips, _, err := r.listIPs(networkID)
+	if err != nil {
+		return nil, "", err
+	}
+	var matching []*domain.IPAddress
+	for _, ip := range ips {
+		if filter.Matches(ip) {
+			matching = append(matching, ip)
+		}
+	}
+	return domain.PageIPs(matching, page)
+}
+
+func (r *IPAMRepository) UpdateIP(ip *domain.IPAddress) error {
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		current, index, err := r.getIP(ip.ID)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return domain.NewError(domain.ErrNotFound, "IP address %d not found", ip.ID)
+		}
+		if current.Status.Released() {
+			return domain.NewError(domain.ErrConflict, "IP address %d has been released", ip.ID).
+				WithDetail("status", string(current.Status))
+		}
+
+		hostnameChanged := ip.Hostname != current.Hostname
+		if hostnameChanged && ip.Hostname != "" {
+			pair, err := r.client.Get(r.hostnameKey(current.NetworkID, ip.Hostname))
+			if err != nil {
+				return fmt.Errorf("failed to check hostname uniqueness: %v", err)
+			}
+			if pair != nil {
+				return domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", ip.Hostname).
+					WithDetail("hostname", ip.Hostname)
+			}
+		}
+
+		updated := *current
+		updated.Hostname = ip.Hostname
+		updated.MAC = ip.MAC
+		updated.Description = ip.Description
+		updated.Owner = ip.Owner
+		updated.Tags = ip.Tags
+		updated.UpdatedAt = time.Now().UTC()
+		value, err := json.Marshal(&updated)
+		if err != nil {
+			return fmt.Errorf("failed to encode IP address: %v", err)
+		}
+
+		ops := []TxnOp{
+			{Verb: "cas", Key: r.ipKey(ip.ID), Value: value, Index: index},
+		}
+		if hostnameChanged && ip.Hostname != "" {
+			ops = append(ops, TxnOp{Verb: "cas", Key: r.hostnameKey(current.NetworkID, ip.Hostname), Value: []byte(strconv.Itoa(ip.ID))})
+		}
+		if hostnameChanged && current.Hostname != "" {
+			ops = append(ops, TxnOp{Verb: "delete", Key: r.hostnameKey(current.NetworkID, current.Hostname)})
+		}
+
+		ok, _, err := r.client.Txn(ops)
+		if err != nil {
+			return fmt.Errorf("failed to update IP address: %v", err)
+		}
+		if ok {
+			ip.UpdatedAt = updated.UpdatedAt
+			return nil
+		}
+	}
+	return errTooManyUpdates("update IP address")
+}
+
+func (r *IPAMRepository) GetUtilization(networkID int) (*domain.Utilization, error) {
+	network, err := r.GetNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := r.addressCounts([]*domain.Network{network})
+	if err != nil {
+		return nil, err
+	}
+	return domain.NewUtilization(network, counts[networkID])
+}
+
+func (r *IPAMRepository) ListUtilization(filter *domain.NetworkFilter) ([]*domain.Utilization, error) {
+	networks, _, err := r.ListNetworks(filter, nil)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := r.addressCounts(networks)
+	if err != nil {
+		return nil, err
+	}
+
+	var utilization []*domain.Utilization
+	for _, network := range networks {
+		u, err := domain.NewUtilization(network, counts[network.ID])
+		if err != nil {
+			return nil, err
+		}
+		utilization = append(utilization, u)
+	}
+	return utilization, nil
+}
+
+func (r *IPAMRepository) Search(query *domain.SearchQuery) (*domain.SearchResult, error) {
+	networks, _, err := r.ListNetworks(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := r.client.List(r.key("ips") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IP addresses: %v", err)
+	}
+
+	var ips []*domain.IPAddress
+	for _, pair := range pairs {
+		var ip domain.IPAddress
+		if err := json.Unmarshal(pair.Value, &ip); err != nil {
+			return nil, fmt.Errorf("failed to decode IP address %s: %v", pair.Key, err)
+		}
+		if query.Matches(&ip) {
+			ips = append(ips, &ip)
+		}
+	}
+	return domain.Search(query, networks, ips)
+}
+
+// addressCounts tallies the IP records of networks, reading all records
+// in a single listing.
+func (r *IPAMRepository) addressCounts(networks []*domain.Network) (map[int]domain.AddressCounts, error) {
+	byID := make(map[int]*domain.Network, len(networks))
+	for _, network := range networks {
+		byID[network.ID] = network
+	}
+	pairs, err := r.client.List(r.key("ips") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list IP addresses: %v", err)
+	}
+
+	cutoff := time.Now().Add(-r.quarantine)
+	counts := make(map[int]domain.AddressCounts)
+	for _, pair := range pairs {
+		var ip domain.IPAddress
+		if err := json.Unmarshal(pair.Value, &ip); err != nil {
+			return nil, fmt.Errorf("failed to decode IP address %s: %v", pair.Key, err)
+		}
+		network, ok := byID[ip.NetworkID]
+		if !ok {
+			continue
+		}
+		c := counts[ip.NetworkID]
+		c.Add(network, &ip, cutoff)
+		counts[ip.NetworkID] = c
+	}
+	return counts, nil
+}
+
+// touchParentOp returns an operation rewriting the parent of a new
+// network unchanged. It moves the parent's index, so a concurrent delete
+// of the parent fails its transaction and sees the child when it starts
+// over, and the child is not created if the parent is gone.
+func (r *IPAMRepository) touchParentOp(parentID int) (TxnOp, error) {
+	pair, err := r.client.Get(r.networkKey(parentID))
+	if err != nil {
+		return TxnOp{}, fmt.Errorf("failed to get network: %v", err)
+	}
+	if pair == nil {
+		return TxnOp{}, domain.NewError(domain.ErrConflict, "parent network %d was deleted", parentID).
+			WithDetail("parent_id", strconv.Itoa(parentID))
+	}
+	return TxnOp{Verb: "cas", Key: pair.Key, Value: pair.Value, Index: pair.ModifyIndex}, nil
+}
+
+func (r *IPAMRepository) getNetwork(id int) (*domain.Network, uint64, error) {
+	pair, err := r.client.Get(r.networkKey(id))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get network: %v", err)
+	}
+	if pair == nil {
+		return nil, 0, domain.NewError(domain.ErrNotFound, "network %d not found", id)
+	}
+	var network domain.Network
+	if err := json.Unmarshal(pair.Value, &network); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode network %d: %v", id, err)
+	}
+	return &network, pair.ModifyIndex, nil
+}
+
+func (r *IPAMRepository) getIP(id int) (*domain.IPAddress, uint64, error) {
+	pair, err := r.client.Get(r.ipKey(id))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get IP address: %v", err)
+	}
+	if pair == nil {
+		return nil, 0, nil
+	}
+	var ip domain.IPAddress
+	if err := json.Unmarshal(pair.Value, &ip); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode IP address %d: %v", id, err)
+	}
+	return &ip, pair.ModifyIndex, nil
+}
+
+// getIPByIndexKey returns the IP record whose ID is stored under key, or
+// nil if there is none.
+func (r *IPAMRepository) getIPByIndexKey(key string) (*domain.IPAddress, error) {
+	pair, err := r.client.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IP address: %v", err)
+	}
+	if pair == nil {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(string(pair.Value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP address ID in %s: %v", key, err)
+	}
+	ip, _, err := r.getIP(id)
+	return ip, err
+}
+
+// listIPs returns the IP records of a network sorted by ID, together with
+// the ModifyIndex of each record.
+func (r *IPAMRepository) listIPs(networkID int) ([]*domain.IPAddress, map[int]uint64, error) {
+	pairs, err := r.client.List(r.key("ips") + "/")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list IP addresses: %v", err)
+	}
+
+	var ips []*domain.IPAddress
+	indexes := make(map[int]uint64)
+	for _, pair := range pairs {
+		var ip domain.IPAddress
+		if err := json.Unmarshal(pair.Value, &ip); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode IP address %s: %v", pair.Key, err)
+		}
+		if ip.NetworkID == networkID {
+			ips = append(ips, &ip)
+			indexes[ip.ID] = pair.ModifyIndex
+		}
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].ID < ips[j].ID })
+	return ips, indexes, nil
+}
+
+// recycleReleased deletes released records of a network whose quarantine
+// has passed, freeing their address keys. Only the records listed under
+// the network's recycle keys are read. Losing a race against another
+// server doing the same is harmless, so rolled back transactions are
+// ignored.
+func (r *IPAMRepository) recycleReleased(networkID int) error {
+	prefix := r.key("recycle", strconv.Itoa(networkID)) + "/"
+	pairs, err := r.client.List(prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list released IP addresses: %v", err)
+	}
+
+	cutoff := time.Now().Add(-r.quarantine)
+	var batch []TxnOp
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, _, err := r.client.Txn(batch); err != nil {
+			return fmt.Errorf("failed to recycle released IP addresses: %v", err)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for _, pair := range pairs {
+		releasedAt, err := time.Parse(time.RFC3339Nano, string(pair.Value))
+		if err != nil {
+			return fmt.Errorf("failed to decode release time of %s: %v", pair.Key, err)
+		}
+		if releasedAt.After(cutoff) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(pair.Key, prefix))
+		if err != nil {
+			return fmt.Errorf("invalid recycle key %s: %v", pair.Key, err)
+		}
+		ip, index, err := r.getIP(id)
+		if err != nil {
+			return err
+		}
+
+		ops := []TxnOp{{Verb: "delete-cas", Key: pair.Key, Index: pair.ModifyIndex}}
+		if ip != nil && ip.Status.Released() {
+			ops = append(ops,
+				TxnOp{Verb: "delete-cas", Key: r.ipKey(ip.ID), Index: index},
+				TxnOp{Verb: "delete", Key: r.addressKey(networkID, ip.Address)},
+				TxnOp{Verb: "set", Key: r.releasedKey(networkID, ip.Address), Value: []byte(releasedAt.Format(time.RFC3339Nano))},
+			)
+		}
+		// Consul limits the number of operations per transaction; the
+		// operations of a record stay in the same one.
+		if len(batch)+len(ops) > maxTxnOps {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, ops...)
+	}
+	return flush()
+}
+
+// history returns a function reading the release history of a network.
+func (r *IPAMRepository) history(networkID int) func() (domain.ReleaseHistory, error) {
+	return func() (domain.ReleaseHistory, error) {
+		prefix := r.key("released", strconv.Itoa(networkID)) + "/"
+		pairs, err := r.client.List(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list released addresses: %v", err)
+		}
+		history := make(domain.ReleaseHistory, len(pairs))
+		for _, pair := range pairs {
+			releasedAt, err := time.Parse(time.RFC3339Nano, string(pair.Value))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode release time of %s: %v", pair.Key, err)
+			}
+			history[strings.TrimPrefix(pair.Key, prefix)] = releasedAt
+		}
+		return history, nil
+	}
+}
+
+// usedAddresses returns the set of addresses currently held in a network,
+// keyed by their string form.
+func (r *IPAMRepository) usedAddresses(networkID int) (map[string]bool, error) {
+	prefix := r.key("addresses", strconv.Itoa(networkID)) + "/"
+	pairs, err := r.client.List(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list allocated addresses: %v", err)
+	}
+	used := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		used[strings.TrimPrefix(pair.Key, prefix)] = true
+	}
+	return used, nil
+}
+
+// revisionOp returns an operation bumping the revision of the IP records
+// of a network, guarded by the index it was read at.
+func (r *IPAMRepository) revisionOp(networkID int) (TxnOp, error) {
+	key := r.revisionKey(networkID)
+	pair, err := r.client.Get(key)
+	if err != nil {
+		return TxnOp{}, fmt.Errorf("failed to get revision of network %d: %v", networkID, err)
+	}
+
+	revision, index := 0, uint64(0)
+	if pair != nil {
+		revision, err = strconv.Atoi(string(pair.Value))
+		if err != nil {
+			return TxnOp{}, fmt.Errorf("invalid revision %s: %v", key, err)
+		}
+		index = pair.ModifyIndex
+	}
+	return TxnOp{Verb: "cas", Key: key, Value: []byte(strconv.Itoa(revision + 1)), Index: index}, nil
+}
+
+// reserveIPIDs returns n IDs for new IP records. IDs are taken from blocks
+// reserved in the "ips" sequence, so allocations contend for the sequence
+// once per block rather than on every write. IDs left over when the
+// server stops are never used.
+func (r *IPAMRepository) reserveIPIDs(n int) ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.endIPID-r.nextIPID < n {
+		size := max(n, idBlockSize)
+		reserved := false
+		for attempt := 0; attempt < maxTxnAttempts && !reserved; attempt++ {
+			first, seqOp, err := r.nextID("ips", size)
+			if err != nil {
+				return nil, fmt.Errorf("failed to reserve IP address IDs: %v", err)
+			}
+			ok, _, err := r.client.Txn([]TxnOp{seqOp})
+			if err != nil {
+				return nil, fmt.Errorf("failed to reserve IP address IDs: %v", err)
+			}
+			if ok {
+				r.nextIPID, r.endIPID, reserved = first, first+size, true
+			}
+		}
+		if !reserved {
+			return nil, errTooManyUpdates("reserve IP address IDs")
+		}
+	}
+
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = r.nextIPID + i
+	}
+	r.nextIPID += n
+	return ids, nil
+}
+
+// errTooManyUpdates reports a write that lost the check-and-set race on
+// every attempt. Retrying it later may succeed, so it is a conflict.
+func errTooManyUpdates(action string) error {
+	return domain.NewError(domain.ErrConflict, "failed to %s: too many concurrent updates", action)
+}
+
+// nextID reads the named sequence and returns the next ID together with
+// the check-and-set operation that claims it and the n-1 IDs following it.
+func (r *IPAMRepository) nextID(name string, n int) (int, TxnOp, error) {
+	key := r.key("sequences", name)
+	pair, err := r.client.Get(key)
+	if err != nil {
+		return 0, TxnOp{}, err
+	}
+
+	current, index := 0, uint64(0)
+	if pair != nil {
+		current, err = strconv.Atoi(string(pair.Value))
+		if err != nil {
+			return 0, TxnOp{}, fmt.Errorf("invalid sequence %s: %v", key, err)
+		}
+		index = pair.ModifyIndex
+	}
+
+	return current + 1, TxnOp{Verb: "cas", Key: key, Value: []byte(strconv.Itoa(current + n)), Index: index}, nil
+}
+
+func (r *IPAMRepository) key(parts ...string) string {
+	return r.prefix + "/" + strings.Join(parts, "/")
+}
+
+func (r *IPAMRepository) networkKey(id int) string {
+	return r.key("networks", strconv.Itoa(id))
+}
+
+func (r *IPAMRepository) ipKey(id int) string {
+	return r.key("ips", strconv.Itoa(id))
+}
+
+func (r *IPAMRepository) revisionKey(networkID int) string {
+	return r.key("revisions", strconv.Itoa(networkID))
+}
+
+func (r *IPAMRepository) addressKey(networkID int, address net.IP) string {
+	return r.key("addresses", strconv.Itoa(networkID), address.String())
+}
+
+func (r *IPAMRepository) hostnameKey(networkID int, hostname string) string {
+	return r.key("hostnames", strconv.Itoa(networkID), url.PathEscape(hostname))
+}
+
+func (r *IPAMRepository) releasedKey(networkID int, address net.IP) string {
+	return r.key("released", strconv.Itoa(networkID), address.String())
+}
+
+func (r *IPAMRepository) recycleKey(networkID, id int) string {
+	return r.key("recycle", strconv.Itoa(networkID), strconv.Itoa(id))
+}
+
+func (r *IPAMRepository) idempotencyKey(networkID int, key string) string {
+	return r.key("idempotency", strconv.Itoa(networkID), url.PathEscape(key))
+}
@@ -0,0 +1,122 @@
+package consul
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/repotest"
+)
+
+func newTestRepository(t *testing.T) *IPAMRepository {
+	t.Helper()
+	srv := newFakeConsul(t)
+	return NewIPAMRepository(NewClient(srv.URL, "", ""), "ipam")
+}
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) domain.IPAMRepository {
+		return newTestRepository(t)
+	})
+}
+
+func TestQuarantine(t *testing.T) {
+	repotest.RunQuarantine(t, func(t *testing.T, quarantine time.Duration) domain.IPAMRepository {
+		srv := newFakeConsul(t)
+		return NewIPAMRepository(NewClient(srv.URL, "", ""), "ipam", WithQuarantine(quarantine))
+	})
+}
+
+func TestAllocateIPConcurrently(t *testing.T) {
+	srv := newFakeConsul(t)
+	network := &domain.Network{CIDR: "10.1.0.0/24", Gateway: net.ParseIP("10.1.0.1")}
+	if err := NewIPAMRepository(NewClient(srv.URL, "", ""), "ipam").CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error creating network: %v", err)
+	}
+
+	// Each goroutine uses its own repository to mimic separate servers.
+	const workers = 8
+	var wg sync.WaitGroup
+	results := make(chan string, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			repo := NewIPAMRepository(NewClient(srv.URL, "", ""), "ipam")
+			ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			results <- ip.Address.String()
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	seen := make(map[string]bool)
+	for address := range results {
+		if seen[address] {
+			t.Errorf("address %s was allocated twice", address)
+		}
+		seen[address] = true
+	}
+}
+
+func TestDeleteNetworkLeavesNoRecords(t *testing.T) {
+	repo := newTestRepository(t)
+	network := &domain.Network{CIDR: "10.2.0.0/24", Gateway: net.ParseIP("10.2.0.1")}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error creating network: %v", err)
+	}
+	// More records than fit in one transaction along with the network.
+	for i := 0; i < 4; i++ {
+		if _, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 25}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := repo.DeleteNetwork(network.ID, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// An allocation racing a delete either makes the delete fail or is
+	// removed with the network.
+	for i := 0; i < 8; i++ {
+		network := &domain.Network{CIDR: "10.2.0.0/24", Gateway: net.ParseIP("10.2.0.1")}
+		if err := repo.CreateNetwork(network); err != nil {
+			t.Fatalf("unexpected error creating network: %v", err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID}); err != nil && !errors.Is(err, domain.ErrNotFound) {
+				t.Errorf("unexpected error allocating: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := repo.DeleteNetwork(network.ID, false); err != nil && !errors.Is(err, domain.ErrConflict) {
+				t.Errorf("unexpected error deleting: %v", err)
+			}
+		}()
+		wg.Wait()
+		if err := repo.DeleteNetwork(network.ID, true); err != nil && !errors.Is(err, domain.ErrNotFound) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	pairs, err := repo.client.List("ipam/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, pair := range pairs {
+		if !strings.HasPrefix(pair.Key, "ipam/sequences/") {
+			t.Errorf("expected only sequences to remain, got %s", pair.Key)
+		}
+	}
+}
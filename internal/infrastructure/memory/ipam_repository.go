@@ -0,0 +1,771 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+)
+
+// IPAMRepository keeps networks and allocations in process memory.
+//
+// When a snapshot path is configured, the whole state is loaded from that
+// JSON file on start and rewritten after every successful change, which is
+// enough for labs and single-node deployments.
+type IPAMRepository struct {
+	mu           sync.RWMutex
+	snapshotPath string
+	quarantine   time.Duration
+
+	nextNetworkID int
+	nextIPID      int
+	networks      map[int]*domain.Network
+	ips           map[int]*domain.IPAddress
+	// released holds the release history of each network, which outlives
+	// the records dropped by recycle.
+	released map[int]domain.ReleaseHistory
+}
+
+type snapshot struct {
+	NextNetworkID int                           `json:"next_network_id"`
+	NextIPID      int                           `json:"next_ip_id"`
+	Networks      []*domain.Network             `json:"networks"`
+	IPs           []*domain.IPAddress           `json:"ips"`
+	Released      map[int]domain.ReleaseHistory `json:"released,omitempty"`
+}
+
+type Option func(*IPAMRepository)
+
+// WithQuarantine keeps released addresses out of allocation for d.
+func WithQuarantine(d time.Duration) Option {
+	return func(r *IPAMRepository) {
+		r.quarantine = d
+	}
+}
+
+// NewIPAMRepository returns an empty repository, or one restored from
+// snapshotPath if it is non-empty and the file exists.
+func NewIPAMRepository(snapshotPath string, opts ...Option) (*IPAMRepository, error) {
+	r := &IPAMRepository{
+		snapshotPath: snapshotPath,
+		networks:     make(map[int]*domain.Network),
+		ips:          make(map[int]*domain.IPAddress),
+		released:     make(map[int]domain.ReleaseHistory),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if snapshotPath == "" {
+		return r, nil
+	}
+
+	buf, err := os.ReadFile(snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, fmt.Errorf("in file %q: %v", snapshotPath, err)
+	}
+	r.nextNetworkID = s.NextNetworkID
+	r.nextIPID = s.NextIPID
+	for _, network := range s.Networks {
+		r.networks[network.ID] = network
+	}
+	for _, ip := range s.IPs {
+		r.ips[ip.ID] = ip
+	}
+	for id, history := range s.Released {
+		r.released[id] = history
+	}
+	return r, nil
+}
+
+func (r *IPAMRepository) CreateNetwork(network *domain.Network) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if network.ParentID != nil {
+		if _, ok := r.networks[*network.ParentID]; !ok {
+			return domain.NewError(domain.ErrConflict, "parent network %d was deleted", *network.ParentID).
+				WithDetail("parent_id", strconv.Itoa(*network.ParentID))
+		}
+	}
+	if err := domain.CheckOverlap(network, r.networkList()); err != nil {
+		return err
+	}
+	return r.insertNetwork(network)
+}
+
+func (r *IPAMRepository) AllocateChildNetwork(parentID, ones int) (*domain.Network, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	parent, ok := r.networks[parentID]
+	if !ok {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", parentID)
+	}
+	child, err := domain.CarveChild(parent, r.networkList(), ones)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.insertNetwork(child); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// insertNetwork stores a copy of network under the next ID. Callers must
+// hold r.mu.
+func (r *IPAMRepository) insertNetwork(network *domain.Network) error {
+	r.nextNetworkID++
+	created := copyNetwork(network)
+	created.ID = r.nextNetworkID
+	r.networks[created.ID] = created
+
+	if err := r.save(); err != nil {
+		delete(r.networks, created.ID)
+		r.nextNetworkID--
+		return fmt.Errorf("failed to create network: %v", err)
+	}
+	network.ID = created.ID
+	return nil
+}
+
+func (r *IPAMRepository) GetNetwork(id int) (*domain.Network, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	network, ok := r.networks[id]
+	if !ok {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", id)
+	}
+	return copyNetwork(network), nil
+}
+
+func (r *IPAMRepository) ListNetworks(filter *domain.NetworkFilter, page *domain.Page) ([]*domain.Network, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var networks []*domain.Network
+	for _, network := range r.networks {
+		if filter.Matches(network) {
+			networks = append(networks, copyNetwork(network))
+		}
+	}
+	return domain.PageNetworks(networks, page)
+}
+
+func (r *IPAMRepository) UpdateNetwork(network *domain.Network) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.networks[network.ID]
+	if !ok {
+		return domain.NewError(domain.ErrNotFound, "network %d not found", network.ID)
+	}
+	for _, ip := range r.ips {
+		if ip.NetworkID == network.ID && !ip.Status.Released() && ip.Address.Equal(network.Gateway) {
+			return domain.NewError(domain.ErrConflict, "gateway %s is allocated to IP address %d", network.Gateway, ip.ID).
+				WithDetail("address", network.Gateway.String())
+		}
+	}
+
+	// Only the mutable fields are taken over; CIDR, VRF and parent stay.
+	updated := copyNetwork(network)
+	updated.CIDR = current.CIDR
+	updated.VRF = current.VRF
+	updated.ParentID = current.ParentID
+	r.networks[network.ID] = updated
+
+	if err := r.save(); err != nil {
+		r.networks[network.ID] = current
+		return fmt.Errorf("failed to update network: %v", err)
+	}
+	return nil
+}
+
+func (r *IPAMRepository) DeleteNetwork(id int, force bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	network, ok := r.networks[id]
+	if !ok {
+		return domain.NewError(domain.ErrNotFound, "network %d not found", id)
+	}
+	for _, child := range r.networks {
+		if child.ParentID != nil && *child.ParentID == id {
+			return domain.NewError(domain.ErrConflict, "network %d has child networks", id).
+				WithDetail("child_id", strconv.Itoa(child.ID))
+		}
+	}
+
+	removed := make(map[int]*domain.IPAddress)
+	allocated := 0
+	for _, ip := range r.ips {
+		if ip.NetworkID != id {
+			continue
+		}
+		removed[ip.ID] = ip
+		if !ip.Status.Released() {
+			allocated++
+		}
+	}
+	if allocated > 0 && !force {
+		return domain.NewError(domain.ErrConflict, "network %d has %d allocated IP addresses", id, allocated).
+			WithDetail("allocated", strconv.Itoa(allocated))
+	}
+
+	delete(r.networks, id)
+	for ipID := range removed {
+		delete(r.ips, ipID)
+	}
+	history := r.released[id]
+	delete(r.released, id)
+
+	if err := r.save(); err != nil {
+		r.networks[id] = network
+		for ipID, ip := range removed {
+			r.ips[ipID] = ip
+		}
+		if history != nil {
+			r.released[id] = history
+		}
+		return fmt.Errorf("failed to delete network: %v", err)
+	}
+	return nil
+}
+
+func (r *IPAMRepository) AllocateIP(req *domain.AllocationRequest) (*domain.IPAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	networkID, hostname := req.NetworkID, req.Hostname
+
+	network, ok := r.networks[networkID]
+	if !ok {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", networkID)
+	}
+
+	for _, ip := range r.ips {
+		if ip.NetworkID != networkID {
+			continue
+		}
+		if hostname != "" && ip.Hostname == hostname {
+			return nil, domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", hostname).
+				WithDetail("hostname", hostname)
+		}
+		if req.IdempotencyKey != "" && ip.IdempotencyKey == req.IdempotencyKey {
+			return nil, domain.NewError(domain.ErrConflict, "idempotency key %s is already in use in this network", req.IdempotencyKey).
+				WithDetail("idempotency_key", req.IdempotencyKey)
+		}
+	}
+
+	used := r.recycle(networkID)
+	address, err := domain.SelectAddress(network, req, func(ip net.IP) bool { return used[ip.String()] }, r.history(networkID))
+	if err != nil {
+		return nil, err
+	}
+
+	r.nextIPID++
+	now := time.Now().UTC()
+	ip := copyIP(&domain.IPAddress{
+		ID:             r.nextIPID,
+		NetworkID:      networkID,
+		Address:        address,
+		Hostname:       hostname,
+		Status:         req.InitialStatus(),
+		MAC:            req.MAC,
+		Description:    req.Description,
+		Owner:          req.Owner,
+		Tags:           req.Tags,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		LeaseExpiresAt: domain.LeaseExpiry(now, req.Lease),
+		IdempotencyKey: req.IdempotencyKey,
+	})
+	r.ips[ip.ID] = ip
+
+	if err := r.save(); err != nil {
+		delete(r.ips, ip.ID)
+		r.nextIPID--
+		return nil, fmt.Errorf("failed to allocate IP address: %v", err)
+	}
+	return copyIP(ip), nil
+}
+
+func (r *IPAMRepository) AllocateIPs(req *domain.BulkAllocationRequest) ([]*domain.IPAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	networkID := req.NetworkID
+	network, ok := r.networks[networkID]
+	if !ok {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", networkID)
+	}
+
+	hostnames := make(map[string]bool, len(req.Hostnames))
+	for _, hostname := range req.Hostnames {
+		hostnames[hostname] = true
+	}
+	for _, ip := range r.ips {
+		if ip.NetworkID == networkID && ip.Hostname != "" && hostnames[ip.Hostname] {
+			return nil, domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", ip.Hostname).
+				WithDetail("hostname", ip.Hostname)
+		}
+	}
+
+	used := r.recycle(networkID)
+	addresses, err := domain.SelectAddresses(network, req, func(ip net.IP) bool { return used[ip.String()] }, r.history(networkID))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	ips := make([]*domain.IPAddress, len(addresses))
+	for i, address := range addresses {
+		ips[i] = copyIP(&domain.IPAddress{
+			ID:             r.nextIPID + i + 1,
+			NetworkID:      networkID,
+			Address:        address,
+			Hostname:       req.Hostname(i),
+			Status:         req.InitialStatus(),
+			Description:    req.Description,
+			Owner:          req.Owner,
+			Tags:           req.Tags,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+			LeaseExpiresAt: domain.LeaseExpiry(now, req.Lease),
+		})
+		r.ips[ips[i].ID] = ips[i]
+	}
+	r.nextIPID += len(ips)
+
+	if err := r.save(); err != nil {
+		for _, ip := range ips {
+			delete(r.ips, ip.ID)
+		}
+		r.nextIPID -= len(ips)
+		return nil, fmt.Errorf("failed to allocate IP addresses: %v", err)
+	}
+
+	result := make([]*domain.IPAddress, len(ips))
+	for i, ip := range ips {
+		result[i] = copyIP(ip)
+	}
+	return result, nil
+}
+
+func (r *IPAMRepository) ReleaseIP(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ip, ok := r.ips[id]
+	if !ok {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
+	if ip.Status.Released() {
+		return domain.NewError(domain.ErrConflict, "IP address %d has been released", id).
+			WithDetail("status", string(ip.Status))
+	}
+
+	previous := *ip
+	r.release(ip, time.Now().UTC())
+
+	if err := r.save(); err != nil {
+		*ip = previous
+		return fmt.Errorf("failed to release IP address: %v", err)
+	}
+	return nil
+}
+
+func (r *IPAMRepository) RenewLease(id int, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ip, ok := r.ips[id]
+	if !ok {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
+	if ip.Status.Released() {
+		return domain.NewError(domain.ErrConflict, "IP address %d has been released", id).
+			WithDetail("status", string(ip.Status))
+	}
+
+	previous := *ip
+	expiresAt = expiresAt.UTC()
+	ip.LeaseExpiresAt = &expiresAt
+	ip.UpdatedAt = time.Now().UTC()
+
+	if err := r.save(); err != nil {
+		*ip = previous
+		return fmt.Errorf("failed to renew lease: %v", err)
+	}
+	return nil
+}
+
+func (r *IPAMRepository) ExpireLeases(now time.Time) ([]*domain.IPAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var expired []*domain.IPAddress
+	previous := make(map[int]domain.IPAddress)
+	releasedAt := time.Now().UTC()
+	for id, ip := range r.ips {
+		if !domain.LeaseExpired(ip, now) {
+			continue
+		}
+		expired = append(expired, copyIP(ip))
+		previous[id] = *ip
+		r.release(ip, releasedAt)
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	if err := r.save(); err != nil {
+		for id, ip := range previous {
+			*r.ips[id] = ip
+		}
+		return nil, fmt.Errorf("failed to expire leases: %v", err)
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ID < expired[j].ID })
+	return expired, nil
+}
+
+func (r *IPAMRepository) UpdateIPStatus(id int, from, to domain.AddressStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ip, ok := r.ips[id]
+	if !ok {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
+	if ip.Status != from {
+		return domain.NewError(domain.ErrConflict, "IP address %d is %s, not %s", id, ip.Status, from).
+			WithDetail("status", string(ip.Status))
+	}
+
+	previous := *ip
+	ip.Status = to
+	ip.UpdatedAt = time.Now().UTC()
+
+	if err := r.save(); err != nil {
+		*ip = previous
+		return fmt.Errorf("failed to update IP status: %v", err)
+	}
+	return nil
+}
+
+func (r *IPAMRepository) GetIP(id int) (*domain.IPAddress, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ip, ok := r.ips[id]
+	if !ok {
+		return nil, domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
+	return copyIP(ip), nil
+}
+
+func (r *IPAMRepository) GetIPByHostname(networkID int, hostname string) (*domain.IPAddress, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, ip := range r.ips {
+		if ip.NetworkID == networkID && hostname != "" && ip.Hostname == hostname {
+			return copyIP(ip), nil
+		}
+	}
+	return nil, domain.NewError(domain.ErrNotFound, "no IP address with hostname %s in network %d", hostname, networkID)
+}
+
+func (r *IPAMRepository) GetIPByIdempotencyKey(networkID int, key string) (*domain.IPAddress, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, ip := range r.ips {
+		if ip.NetworkID == networkID && key != "" && ip.IdempotencyKey == key {
+			return copyIP(ip), nil
+		}
+	}
+	return nil, domain.NewError(domain.ErrNotFound, "no IP address with idempotency key %s in network %d", key, networkID)
+}
+
+func (r *IPAMRepository) ListIPs(networkID int, filter *domain.IPFilter, page *domain.Page) ([]*domain.IPAddress, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var ips []*domain.IPAddress
+	for _, ip := range r.ips {
+		if ip.NetworkID == networkID && filter.Matches(ip) {
+			ips = append(ips, copyIP(ip))
+		}
+	}
+	return domain.PageIPs(ips, page)
+}
+
+func (r *IPAMRepository) UpdateIP(ip *domain.IPAddress) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.ips[ip.ID]
+	if !ok {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", ip.ID)
+	}
+	if current.Status.Released() {
+		return domain.NewError(domain.ErrConflict, "IP address %d has been released", ip.ID).
+			WithDetail("status", string(current.Status))
+	}
+
+	if ip.Hostname != "" {
+		for _, other := range r.ips {
+			if other.ID != ip.ID && other.NetworkID == current.NetworkID && other.Hostname == ip.Hostname {
+				return domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", ip.Hostname).
+					WithDetail("hostname", ip.Hostname)
+			}
+		}
+	}
+
+	updated := copyIP(current)
+	changes := copyIP(ip)
+	updated.Hostname = changes.Hostname
+	updated.MAC = changes.MAC
+	updated.Description = changes.Description
+	updated.Owner = changes.Owner
+	updated.Tags = changes.Tags
+	updated.UpdatedAt = time.Now().UTC()
+	r.ips[ip.ID] = updated
+
+	if err := r.save(); err != nil {
+		r.ips[ip.ID] = current
+		return fmt.Errorf("failed to update IP address: %v", err)
+	}
+	ip.UpdatedAt = updated.UpdatedAt
+	return nil
+}
+
+func (r *IPAMRepository) GetUtilization(networkID int) (*domain.Utilization, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	network, ok := r.networks[networkID]
+	if !ok {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", networkID)
+	}
+	return domain.NewUtilization(copyNetwork(network), r.addressCounts()[networkID])
+}
+
+func (r *IPAMRepository) ListUtilization(filter *domain.NetworkFilter) ([]*domain.Utilization, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := r.addressCounts()
+	var utilization []*domain.Utilization
+	for _, network := range r.networks {
+		if !filter.Matches(network) {
+			continue
+		}
+		u, err := domain.NewUtilization(copyNetwork(network), counts[network.ID])
+		if err != nil {
+			return nil, err
+		}
+		utilization = append(utilization, u)
+	}
+	sort.Slice(utilization, func(i, j int) bool { return utilization[i].Network.ID < utilization[j].Network.ID })
+	return utilization, nil
+}
+
+func (r *IPAMRepository) Search(query *domain.SearchQuery) (*domain.SearchResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	networks := make([]*domain.Network, 0, len(r.networks))
+	for _, network := range r.networks {
+		networks = append(networks, copyNetwork(network))
+	}
+	var ips []*domain.IPAddress
+	for _, ip := range r.ips {
+		if query.Matches(ip) {
+			ips = append(ips, copyIP(ip))
+		}
+	}
+	return domain.Search(query, networks, ips)
+}
+
+// networkList returns the stored networks themselves, not copies. Callers
+// must hold r.mu.
+func (r *IPAMRepository) networkList() []*domain.Network {
+	networks := make([]*domain.Network, 0, len(r.networks))
+	for _, network := range r.networks {
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// addressCounts tallies the address records of every network. Callers
+// must hold r.mu.
+func (r *IPAMRepository) addressCounts() map[int]domain.AddressCounts {
+	cutoff := time.Now().Add(-r.quarantine)
+	counts := make(map[int]domain.AddressCounts)
+	for _, ip := range r.ips {
+		network, ok := r.networks[ip.NetworkID]
+		if !ok {
+			continue
+		}
+		c := counts[ip.NetworkID]
+		c.Add(network, ip, cutoff)
+		counts[ip.NetworkID] = c
+	}
+	return counts
+}
+
+// release clears ip as ReleaseIP does. Callers must hold r.mu.
+func (r *IPAMRepository) release(ip *domain.IPAddress, now time.Time) {
+	ip.Hostname = ""
+	ip.Status = domain.ReleasedStatus(r.quarantine > 0)
+	ip.MAC = nil
+	ip.Description = ""
+	ip.Owner = ""
+	ip.Tags = nil
+	ip.UpdatedAt = now
+	ip.ReleasedAt = &now
+	ip.LeaseExpiresAt = nil
+	ip.IdempotencyKey = ""
+}
+
+// recycle drops the released records of a network whose quarantine has
+// passed, noting their release in the network's history, and returns the
+// addresses still held by the remaining records, including quarantined
+// ones.
+func (r *IPAMRepository) recycle(networkID int) map[string]bool {
+	cutoff := time.Now().Add(-r.quarantine)
+	used := make(map[string]bool)
+	for id, ip := range r.ips {
+		if ip.NetworkID != networkID {
+			continue
+		}
+		if ip.Status.Released() && ip.ReleasedAt != nil && !ip.ReleasedAt.After(cutoff) {
+			if r.released[networkID] == nil {
+				r.released[networkID] = make(domain.ReleaseHistory)
+			}
+			r.released[networkID][ip.Address.String()] = *ip.ReleasedAt
+			delete(r.ips, id)
+			continue
+		}
+		used[ip.Address.String()] = true
+	}
+	return used
+}
+
+// history returns a function yielding the release history of a network.
+func (r *IPAMRepository) history(networkID int) func() (domain.ReleaseHistory, error) {
+	return func() (domain.ReleaseHistory, error) {
+		return r.released[networkID], nil
+	}
+}
+
+// save writes the current state to the snapshot file, if one is
+// configured. The file is replaced atomically. Callers must hold r.mu.
+func (r *IPAMRepository) save() error {
+	if r.snapshotPath == "" {
+		return nil
+	}
+
+	s := snapshot{
+		NextNetworkID: r.nextNetworkID,
+		NextIPID:      r.nextIPID,
+		Networks:      make([]*domain.Network, 0, len(r.networks)),
+		IPs:           make([]*domain.IPAddress, 0, len(r.ips)),
+		Released:      r.released,
+	}
+	for _, network := range r.networks {
+		s.Networks = append(s.Networks, network)
+	}
+	for _, ip := range r.ips {
+		s.IPs = append(s.IPs, ip)
+	}
+	sort.Slice(s.Networks, func(i, j int) bool { return s.Networks[i].ID < s.Networks[j].ID })
+	sort.Slice(s.IPs, func(i, j int) bool { return s.IPs[i].ID < s.IPs[j].ID })
+
+	buf, err := json.MarshalIndent(&s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.snapshotPath), filepath.Base(r.snapshotPath)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), r.snapshotPath); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	return nil
+}
+
+func copyNetwork(network *domain.Network) *domain.Network {
+	c := *network
+	c.Gateway = append(net.IP(nil), network.Gateway...)
+	if network.ParentID != nil {
+		parentID := *network.ParentID
+		c.ParentID = &parentID
+	}
+	c.Reserved = nil
+	for _, r := range network.Reserved {
+		c.Reserved = append(c.Reserved, domain.IPRange{
+			Start: append(net.IP(nil), r.Start...),
+			End:   append(net.IP(nil), r.End...),
+		})
+	}
+	c.Tags = copyTags(network.Tags)
+	return &c
+}
+
+func copyIP(ip *domain.IPAddress) *domain.IPAddress {
+	c := *ip
+	c.Address = append(net.IP(nil), ip.Address...)
+	if ip.MAC != nil {
+		c.MAC = append(net.HardwareAddr(nil), ip.MAC...)
+	}
+	c.Tags = copyTags(ip.Tags)
+	if ip.ReleasedAt != nil {
+		releasedAt := *ip.ReleasedAt
+		c.ReleasedAt = &releasedAt
+	}
+	if ip.LeaseExpiresAt != nil {
+		leaseExpiresAt := *ip.LeaseExpiresAt
+		c.LeaseExpiresAt = &leaseExpiresAt
+	}
+	return &c
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
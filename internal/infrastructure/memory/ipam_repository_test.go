@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) domain.IPAMRepository {
+		repo, err := NewIPAMRepository(filepath.Join(t.TempDir(), "ipam.json"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return repo
+	})
+}
+
+func TestQuarantine(t *testing.T) {
+	repotest.RunQuarantine(t, func(t *testing.T, quarantine time.Duration) domain.IPAMRepository {
+		repo, err := NewIPAMRepository("", WithQuarantine(quarantine))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return repo
+	})
+}
+
+func TestReturnedRecordsAreCopies(t *testing.T) {
+	repo, err := NewIPAMRepository("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	network := &domain.Network{CIDR: "192.168.1.0/24", Gateway: net.ParseIP("192.168.1.1")}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ip.Hostname = "mutated"
+	ip.Address[len(ip.Address)-1] = 99
+
+	stored, err := repo.GetIP(ip.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.Hostname != "host-a" || stored.Address.String() != "192.168.1.2" {
+		t.Errorf("expected stored allocation to be unchanged, got %+v", stored)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+
+	repo, err := NewIPAMRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	allocated, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored, err := NewIPAMRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ip, err := restored.GetIP(allocated.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip == nil || !ip.Address.Equal(allocated.Address) || ip.Hostname != "host-a" {
+		t.Errorf("expected restored allocation %+v, got %+v", allocated, ip)
+	}
+
+	// IDs continue from the snapshot instead of starting over.
+	next, err := restored.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next.ID != allocated.ID+1 {
+		t.Errorf("expected ID %d, got %d", allocated.ID+1, next.ID)
+	}
+	if next.Address.String() != "10.0.0.3" {
+		t.Errorf("expected IP 10.0.0.3, got %s", next.Address)
+	}
+}
@@ -0,0 +1,245 @@
+// Package migration applies the PostgreSQL schema migrations embedded in
+// the binary and records them in the schema_version table.
+package migration
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/db"
+)
+
+//go:embed migrations/*.sql
+var embedded embed.FS
+
+// lockID is the advisory lock key held while migrating, so servers
+// starting at the same time do not apply a migration twice.
+const lockID = 7_351_002
+
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	db         *db.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *db.DB) (*Migrator, error) {
+	migrations, err := load(embedded)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Up applies every pending migration in version order and returns the
+// versions it applied.
+func (m *Migrator) Up() ([]int, error) {
+	tx, err := m.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	applied, err := appliedVersions(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if _, err := tx.Exec(migration.Up); err != nil {
+			return nil, fmt.Errorf("failed to apply migration %d_%s: %v", migration.Version, migration.Name, withHint(err))
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+			return nil, fmt.Errorf("failed to record migration %d: %v", migration.Version, err)
+		}
+		versions = append(versions, migration.Version)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return versions, nil
+}
+
+// Down reverts the most recently applied migrations, at most steps of
+// them, and returns the versions it reverted.
+func (m *Migrator) Down(steps int) ([]int, error) {
+	tx, err := m.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	applied, err := appliedVersions(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for i := len(m.migrations) - 1; i >= 0 && len(versions) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if _, err := tx.Exec(migration.Down); err != nil {
+			return nil, fmt.Errorf("failed to revert migration %d_%s: %v", migration.Version, migration.Name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_version WHERE version = $1`, migration.Version); err != nil {
+			return nil, fmt.Errorf("failed to record migration %d: %v", migration.Version, err)
+		}
+		versions = append(versions, migration.Version)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return versions, nil
+}
+
+// Status reports every known migration and when it was applied, if ever.
+func (m *Migrator) Status() ([]Status, error) {
+	tx, err := m.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	applied, err := appliedVersions(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// begin starts a transaction holding the migration lock, creating the
+// schema_version table on first use.
+func (m *Migrator) begin() (*sql.Tx, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`
+	if _, err := tx.Exec(query); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+	return tx, nil
+}
+
+func appliedVersions(tx *sql.Tx) (map[int]time.Time, error) {
+	rows, err := tx.Query(`SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema version row: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// load reads the up/down pairs from fsys and sorts them by version.
+func load(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, p := range paths {
+		match := fileName.FindStringSubmatch(path.Base(p))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", p)
+		}
+		version, _ := strconv.Atoi(match[1])
+		buf, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(buf)
+		} else {
+			migration.Down = string(buf)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down files", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withHint appends the hint of a PostgreSQL error to its message. The
+// checks in migrations use hints to tell how to fix the data they reject.
+func withHint(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Hint != "" {
+		return fmt.Errorf("%v (%s)", err, pqErr.Hint)
+	}
+	return err
+}
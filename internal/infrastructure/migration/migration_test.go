@@ -0,0 +1,138 @@
+package migration
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/db"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := load(embedded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected embedded migrations, got none")
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("expected migration %d to have version %d, got %d", i, i+1, migration.Version)
+		}
+	}
+}
+
+func TestLoadRejectsIncompleteMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0001_init.up.sql": {Data: []byte("CREATE TABLE t (id INT);")},
+	}
+	if _, err := load(fsys); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
+
+func newTestMigrator(t *testing.T) (*Migrator, sqlmock.Sqlmock) {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(func() { mockDB.Close() })
+
+	m := &Migrator{
+		db: db.NewDB(mockDB),
+		migrations: []Migration{
+			{Version: 1, Name: "first", Up: "CREATE TABLE first (id INT)", Down: "DROP TABLE first"},
+			{Version: 2, Name: "second", Up: "CREATE TABLE second (id INT)", Down: "DROP TABLE second"},
+		},
+	}
+	return m, mock
+}
+
+func expectBegin(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WithArgs(lockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestUp(t *testing.T) {
+	m, mock := newTestMigrator(t)
+
+	expectBegin(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE second (id INT)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version").WithArgs(2, "second").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	applied, err := m.Up()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(applied) != 1 || applied[0] != 2 {
+		t.Errorf("expected only version 2 to be applied, got %v", applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpReportsHint(t *testing.T) {
+	m, mock := newTestMigrator(t)
+
+	expectBegin(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE second (id INT)")).
+		WillReturnError(&pq.Error{Message: "networks overlap", Hint: "Delete one network of each pair."})
+	mock.ExpectRollback()
+
+	_, err := m.Up()
+	if err == nil || !strings.Contains(err.Error(), "networks overlap (Delete one network of each pair.)") {
+		t.Errorf("expected the error with its hint, got %v", err)
+	}
+}
+
+func TestDown(t *testing.T) {
+	m, mock := newTestMigrator(t)
+
+	expectBegin(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()).AddRow(2, time.Now()))
+	mock.ExpectExec("DROP TABLE second").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_version").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	reverted, err := m.Down(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reverted) != 1 || reverted[0] != 2 {
+		t.Errorf("expected only version 2 to be reverted, got %v", reverted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	m, mock := newTestMigrator(t)
+
+	expectBegin(mock)
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectRollback()
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) != 2 || statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+}
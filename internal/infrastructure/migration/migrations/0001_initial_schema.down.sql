@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS ip_addresses;
+DROP TABLE IF EXISTS networks;
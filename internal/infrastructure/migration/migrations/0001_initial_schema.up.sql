@@ -0,0 +1,15 @@
+-- Matches the tables previously created by hand from README.md, so
+-- existing databases adopt this migration without changes.
+CREATE TABLE IF NOT EXISTS networks (
+    id SERIAL PRIMARY KEY,
+    cidr CIDR NOT NULL,
+    gateway INET NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ip_addresses (
+    id SERIAL PRIMARY KEY,
+    network_id INTEGER REFERENCES networks(id),
+    address INET NOT NULL,
+    hostname TEXT,
+    status TEXT NOT NULL
+);
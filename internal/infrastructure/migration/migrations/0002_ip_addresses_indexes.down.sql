@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS ip_addresses_network_id_hostname_idx;
+DROP INDEX IF EXISTS ip_addresses_network_id_address_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS ip_addresses_network_id_address_idx ON ip_addresses (network_id, address);
+CREATE INDEX IF NOT EXISTS ip_addresses_network_id_hostname_idx ON ip_addresses (network_id, hostname);
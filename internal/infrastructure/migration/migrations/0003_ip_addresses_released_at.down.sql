@@ -0,0 +1 @@
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS released_at;
@@ -0,0 +1,5 @@
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS released_at TIMESTAMPTZ;
+
+-- Rows released before this migration were never handed out again.
+-- Start their quarantine now so they become reusable.
+UPDATE ip_addresses SET released_at = now() WHERE status = 'available' AND released_at IS NULL;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS network_reserved_ranges;
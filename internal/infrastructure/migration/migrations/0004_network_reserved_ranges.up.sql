@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS network_reserved_ranges (
+    id SERIAL PRIMARY KEY,
+    network_id INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+    start_address INET NOT NULL,
+    end_address INET NOT NULL,
+    CHECK (start_address <= end_address)
+);
+
+CREATE INDEX IF NOT EXISTS network_reserved_ranges_network_id_idx ON network_reserved_ranges (network_id);
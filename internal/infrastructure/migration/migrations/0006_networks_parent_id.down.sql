@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS networks_parent_id_idx;
+ALTER TABLE networks DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,3 @@
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES networks(id);
+
+CREATE INDEX IF NOT EXISTS networks_parent_id_idx ON networks (parent_id);
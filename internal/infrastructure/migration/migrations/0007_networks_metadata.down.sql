@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS networks_tags_idx;
+DROP INDEX IF EXISTS networks_site_idx;
+ALTER TABLE networks DROP COLUMN IF EXISTS tags;
+ALTER TABLE networks DROP COLUMN IF EXISTS site;
+ALTER TABLE networks DROP COLUMN IF EXISTS vlan_id;
+ALTER TABLE networks DROP COLUMN IF EXISTS description;
+ALTER TABLE networks DROP COLUMN IF EXISTS name;
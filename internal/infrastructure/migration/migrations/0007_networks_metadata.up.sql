@@ -0,0 +1,8 @@
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '';
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS vlan_id INTEGER CHECK (vlan_id BETWEEN 1 AND 4094);
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS site TEXT NOT NULL DEFAULT '';
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS networks_site_idx ON networks (site);
+CREATE INDEX IF NOT EXISTS networks_tags_idx ON networks USING GIN (tags);
@@ -0,0 +1,6 @@
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS created_at;
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS tags;
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS owner;
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS description;
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS mac;
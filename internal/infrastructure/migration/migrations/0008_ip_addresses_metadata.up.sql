@@ -0,0 +1,6 @@
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS mac TEXT;
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
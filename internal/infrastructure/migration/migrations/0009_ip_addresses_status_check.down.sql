@@ -0,0 +1 @@
+ALTER TABLE ip_addresses DROP CONSTRAINT IF EXISTS ip_addresses_status_check;
@@ -0,0 +1,3 @@
+ALTER TABLE ip_addresses DROP CONSTRAINT IF EXISTS ip_addresses_status_check;
+ALTER TABLE ip_addresses ADD CONSTRAINT ip_addresses_status_check
+    CHECK (status IN ('available', 'reserved', 'allocated', 'deprecated', 'quarantined'));
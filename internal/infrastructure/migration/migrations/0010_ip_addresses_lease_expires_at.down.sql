@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS ip_addresses_lease_expires_at_idx;
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS lease_expires_at;
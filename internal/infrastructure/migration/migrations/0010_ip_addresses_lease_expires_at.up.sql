@@ -0,0 +1,2 @@
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS ip_addresses_lease_expires_at_idx ON ip_addresses (lease_expires_at) WHERE lease_expires_at IS NOT NULL;
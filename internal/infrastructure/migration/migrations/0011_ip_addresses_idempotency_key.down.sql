@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS ip_addresses_network_id_idempotency_key_idx;
+ALTER TABLE ip_addresses DROP COLUMN IF EXISTS idempotency_key;
@@ -0,0 +1,3 @@
+ALTER TABLE ip_addresses ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS ip_addresses_network_id_idempotency_key_idx
+    ON ip_addresses (network_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
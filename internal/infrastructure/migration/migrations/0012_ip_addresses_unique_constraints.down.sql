@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS ip_addresses_network_id_hostname_idx;
+CREATE INDEX ip_addresses_network_id_hostname_idx ON ip_addresses (network_id, hostname);
+DROP INDEX IF EXISTS ip_addresses_network_id_address_idx;
+CREATE INDEX ip_addresses_network_id_address_idx ON ip_addresses (network_id, address);
@@ -0,0 +1,32 @@
+-- Older versions could hand out an address or hostname twice under
+-- concurrent allocations. Name the duplicates rather than failing on the
+-- index with a bare unique violation.
+DO $$
+DECLARE
+    duplicates TEXT;
+BEGIN
+    SELECT string_agg(format('network %s %s (IP addresses %s)', network_id, value, ids), '; ')
+    INTO duplicates
+    FROM (
+        SELECT network_id, 'address ' || host(address) AS value, string_agg(id::text, ', ' ORDER BY id) AS ids
+        FROM ip_addresses
+        GROUP BY network_id, address
+        HAVING count(*) > 1
+        UNION ALL
+        SELECT network_id, 'hostname ' || hostname, string_agg(id::text, ', ' ORDER BY id)
+        FROM ip_addresses
+        WHERE hostname <> ''
+        GROUP BY network_id, hostname
+        HAVING count(*) > 1
+    ) AS duplicate;
+
+    IF duplicates IS NOT NULL THEN
+        RAISE EXCEPTION 'ip_addresses holds duplicates: %', duplicates
+            USING HINT = 'Delete or rename all but one IP address of each duplicate, then run the migration again.';
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS ip_addresses_network_id_address_idx;
+CREATE UNIQUE INDEX ip_addresses_network_id_address_idx ON ip_addresses (network_id, address);
+DROP INDEX IF EXISTS ip_addresses_network_id_hostname_idx;
+CREATE UNIQUE INDEX ip_addresses_network_id_hostname_idx ON ip_addresses (network_id, hostname) WHERE hostname <> '';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS address_releases;
+ALTER TABLE networks DROP COLUMN IF EXISTS allocation_strategy;
@@ -0,0 +1,8 @@
+ALTER TABLE networks ADD COLUMN IF NOT EXISTS allocation_strategy TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS address_releases (
+    network_id INTEGER NOT NULL REFERENCES networks(id) ON DELETE CASCADE,
+    address INET NOT NULL,
+    released_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (network_id, address)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS ip_addresses_network_id_hostname_sort_idx;
+DROP INDEX IF EXISTS ip_addresses_network_id_created_at_idx;
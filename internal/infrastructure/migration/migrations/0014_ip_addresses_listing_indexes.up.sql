@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS ip_addresses_network_id_created_at_idx ON ip_addresses (network_id, created_at, id);
+CREATE INDEX IF NOT EXISTS ip_addresses_network_id_hostname_sort_idx ON ip_addresses (network_id, (COALESCE(hostname, '')) COLLATE "C", id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS networks_cidr_gist_idx;
+DROP INDEX IF EXISTS ip_addresses_mac_idx;
+DROP INDEX IF EXISTS ip_addresses_hostname_pattern_idx;
+DROP INDEX IF EXISTS ip_addresses_address_gist_idx;
@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS ip_addresses_address_gist_idx ON ip_addresses USING GIST (address inet_ops);
+CREATE INDEX IF NOT EXISTS ip_addresses_hostname_pattern_idx ON ip_addresses (hostname text_pattern_ops);
+CREATE INDEX IF NOT EXISTS ip_addresses_mac_idx ON ip_addresses (mac);
+CREATE INDEX IF NOT EXISTS networks_cidr_gist_idx ON networks USING GIST (cidr inet_ops);
@@ -0,0 +1 @@
+ALTER TABLE networks DROP CONSTRAINT IF EXISTS networks_no_overlap;
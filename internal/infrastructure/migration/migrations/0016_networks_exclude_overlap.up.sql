@@ -0,0 +1,27 @@
+-- Name the networks that overlap already rather than failing on the
+-- constraint with a bare exclusion violation.
+DO $$
+DECLARE
+    overlaps TEXT;
+BEGIN
+    SELECT string_agg(format('%s (network %s) and %s (network %s) in VRF %L', a.cidr, a.id, b.cidr, b.id, a.vrf), '; ')
+    INTO overlaps
+    FROM networks a
+    JOIN networks b ON a.id < b.id
+        AND a.vrf = b.vrf
+        AND COALESCE(a.parent_id, 0) = COALESCE(b.parent_id, 0)
+        AND a.cidr && b.cidr;
+
+    IF overlaps IS NOT NULL THEN
+        RAISE EXCEPTION 'networks overlap: %', overlaps
+            USING HINT = 'Delete one network of each pair, or set parent_id of the smaller to the network containing it, then run the migration again.';
+    END IF;
+END $$;
+
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+-- Networks nest inside their parents, so overlaps are only ruled out
+-- between networks with the same parent. Since every child lies inside
+-- its parent, this rules out all overlaps but those with ancestors.
+ALTER TABLE networks ADD CONSTRAINT networks_no_overlap
+    EXCLUDE USING gist (vrf WITH =, (COALESCE(parent_id, 0)) WITH =, cidr inet_ops WITH &&);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS address_releases_released_at_idx;
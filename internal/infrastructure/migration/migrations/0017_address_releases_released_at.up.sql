@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS address_releases_released_at_idx ON address_releases (network_id, released_at, address);
@@ -2,103 +2,418 @@ package persistence
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/zinrai/ipam-mvp-go/internal/domain"
 	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/db"
 )
 
+// maxTxAttempts bounds how often an allocation is retried after PostgreSQL
+// aborted it because of a concurrent transaction.
+const maxTxAttempts = 8
+
+// PostgreSQL error codes the repository acts on.
+const (
+	foreignKeyViolation  = "23503"
+	uniqueViolation      = "23505"
+	exclusionViolation   = "23P01"
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+)
+
 type IPAMRepository struct {
-	db *db.DB
+	db         *db.DB
+	quarantine time.Duration
+}
+
+type Option func(*IPAMRepository)
+
+// WithQuarantine keeps released addresses out of allocation for d, so ARP
+// caches and DNS records pointing at the previous host can expire.
+func WithQuarantine(d time.Duration) Option {
+	return func(r *IPAMRepository) {
+		r.quarantine = d
+	}
 }
 
-func NewIPAMRepository(db *db.DB) *IPAMRepository {
-	return &IPAMRepository{db: db}
+func NewIPAMRepository(db *db.DB, opts ...Option) *IPAMRepository {
+	r := &IPAMRepository{db: db}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 func (r *IPAMRepository) CreateNetwork(network *domain.Network) error {
-	query := `INSERT INTO networks (cidr, gateway) VALUES ($1, $2) RETURNING id`
-	err := r.db.QueryRow(query, network.CIDR, network.Gateway.String()).Scan(&network.ID)
+	tx, err := r.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to create network: %v", err)
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := insertNetwork(tx, network); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 	return nil
 }
 
+// AllocateChildNetwork carves the child in a transaction that holds a
+// lock on the parent row, so concurrent carves run one after another.
+// Networks created inside the parent by other means are kept out by the
+// overlap constraint.
+func (r *IPAMRepository) AllocateChildNetwork(parentID, ones int) (*domain.Network, error) {
+	var child *domain.Network
+	err := r.retry(func() (err error) {
+		child, err = r.allocateChildNetwork(parentID, ones)
+		return err
+	})
+	return child, err
+}
+
+func (r *IPAMRepository) allocateChildNetwork(parentID, ones int) (*domain.Network, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	parent, err := scanNetwork(tx.QueryRow(`SELECT `+networkColumns+` FROM networks WHERE id = $1 FOR UPDATE`, parentID))
+	if err == sql.ErrNoRows {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", parentID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network: %w", err)
+	}
+	inside, err := queryNetworks(tx, `SELECT `+networkColumns+` FROM networks WHERE vrf = $1 AND cidr << $2::inet`, parent.VRF, parent.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	child, err := domain.CarveChild(parent, inside, ones)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertNetwork(tx, child); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return child, nil
+}
+
+// insertNetwork stores network and its reserved ranges and sets its ID.
+func insertNetwork(tx *sql.Tx, network *domain.Network) error {
+	var parentID sql.NullInt64
+	if network.ParentID != nil {
+		parentID = sql.NullInt64{Int64: int64(*network.ParentID), Valid: true}
+	}
+	tags, err := encodeTags(network.Tags)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO networks (cidr, gateway, vrf, parent_id, name, description, vlan_id, site, tags, allocation_strategy)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id`
+	err = tx.QueryRow(query, network.CIDR, network.Gateway.String(), network.VRF, parentID,
+		network.Name, network.Description, nullableVLAN(network.VLAN), network.Site, tags, network.Strategy).Scan(&network.ID)
+	if err != nil {
+		return networkConflictError(err, network)
+	}
+	return insertReservedRanges(tx, network)
+}
+
+// networkColumns are the columns read by scanNetwork.
+const networkColumns = `id, cidr, gateway, vrf, parent_id, name, description, vlan_id, site, tags, allocation_strategy`
+
 func (r *IPAMRepository) GetNetwork(id int) (*domain.Network, error) {
-	query := `SELECT id, cidr, gateway FROM networks WHERE id = $1`
-	var network domain.Network
-	var gatewayStr string
-	err := r.db.QueryRow(query, id).Scan(&network.ID, &network.CIDR, &gatewayStr)
+	query := `SELECT ` + networkColumns + ` FROM networks WHERE id = $1`
+	network, err := scanNetwork(r.db.QueryRow(query, id))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil
+			return nil, domain.NewError(domain.ErrNotFound, "network %d not found", id)
 		}
 		return nil, fmt.Errorf("failed to get network: %v", err)
 	}
-	network.Gateway = net.ParseIP(gatewayStr)
-	return &network, nil
+
+	reserved, err := reservedRanges(r.db, "WHERE network_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	network.Reserved = reserved[id]
+	return network, nil
 }
 
-func (r *IPAMRepository) ListNetworks() ([]*domain.Network, error) {
-	query := `SELECT id, cidr, gateway FROM networks`
-	rows, err := r.db.Query(query)
+func (r *IPAMRepository) ListNetworks(filter *domain.NetworkFilter, page *domain.Page) ([]*domain.Network, string, error) {
+	var conditions []string
+	var args []interface{}
+	if filter != nil {
+		if filter.Site != "" {
+			args = append(args, filter.Site)
+			conditions = append(conditions, fmt.Sprintf("site = $%d", len(args)))
+		}
+		if filter.VLAN != 0 {
+			args = append(args, filter.VLAN)
+			conditions = append(conditions, fmt.Sprintf("vlan_id = $%d", len(args)))
+		}
+		if len(filter.Tags) > 0 {
+			tags, err := encodeTags(filter.Tags)
+			if err != nil {
+				return nil, "", err
+			}
+			args = append(args, tags)
+			conditions = append(conditions, fmt.Sprintf("tags @> $%d", len(args)))
+		}
+	}
+	order, err := pageQuery(page, networkSortColumns, &conditions, &args)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list networks: %v", err)
+		return nil, "", err
 	}
-	defer rows.Close()
 
-	var networks []*domain.Network
-	for rows.Next() {
-		var network domain.Network
-		var gatewayStr string
-		if err := rows.Scan(&network.ID, &network.CIDR, &gatewayStr); err != nil {
-			return nil, fmt.Errorf("failed to scan network row: %v", err)
+	query := `SELECT ` + networkColumns + ` FROM networks`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	networks, err := queryNetworks(r.db, query+order, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if page != nil && page.Limit > 0 && len(networks) > page.Limit {
+		networks = networks[:page.Limit]
+		next = page.NextNetworkCursor(networks[len(networks)-1])
+	}
+	if err := r.loadReservedRanges(networks); err != nil {
+		return nil, "", err
+	}
+	return networks, next, nil
+}
+
+func (r *IPAMRepository) UpdateNetwork(network *domain.Network) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	tags, err := encodeTags(network.Tags)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+		UPDATE networks
+		SET gateway = $2, name = $3, description = $4, vlan_id = $5, site = $6, tags = $7, allocation_strategy = $8
+		WHERE id = $1
+	`, network.ID, network.Gateway.String(), network.Name, network.Description, nullableVLAN(network.VLAN), network.Site, tags, network.Strategy)
+	if err != nil {
+		return fmt.Errorf("failed to update network: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return domain.NewError(domain.ErrNotFound, "network %d not found", network.ID)
+	}
+
+	var ipID int
+	err = tx.QueryRow(`
+		SELECT id FROM ip_addresses
+		WHERE network_id = $1 AND address = $2 AND status NOT IN ('available', 'quarantined')
+	`, network.ID, network.Gateway.String()).Scan(&ipID)
+	if err == nil {
+		return domain.NewError(domain.ErrConflict, "gateway %s is allocated to IP address %d", network.Gateway, ipID).
+			WithDetail("address", network.Gateway.String())
+	} else if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check gateway address: %v", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM network_reserved_ranges WHERE network_id = $1`, network.ID); err != nil {
+		return fmt.Errorf("failed to update reserved ranges: %v", err)
+	}
+	if err := insertReservedRanges(tx, network); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (r *IPAMRepository) DeleteNetwork(id int, force bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Locking the network row keeps allocations out until the delete is
+	// committed.
+	err = tx.QueryRow(`SELECT id FROM networks WHERE id = $1 FOR UPDATE`, id).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return domain.NewError(domain.ErrNotFound, "network %d not found", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get network: %v", err)
+	}
+
+	// A child inserted meanwhile holds a key share lock on the network row
+	// for its foreign key, so it is either visible here or waits until the
+	// delete is committed and then fails.
+	var childID int
+	err = tx.QueryRow(`SELECT id FROM networks WHERE parent_id = $1 LIMIT 1`, id).Scan(&childID)
+	if err == nil {
+		return domain.NewError(domain.ErrConflict, "network %d has child networks", id).
+			WithDetail("child_id", strconv.Itoa(childID))
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check child networks: %v", err)
+	}
+
+	if !force {
+		var allocated int
+		err := tx.QueryRow(`
+			SELECT count(*) FROM ip_addresses
+			WHERE network_id = $1 AND status NOT IN ('available', 'quarantined')
+		`, id).Scan(&allocated)
+		if err != nil {
+			return fmt.Errorf("failed to count allocated IP addresses: %v", err)
+		}
+		if allocated > 0 {
+			return domain.NewError(domain.ErrConflict, "network %d has %d allocated IP addresses", id, allocated).
+				WithDetail("allocated", strconv.Itoa(allocated))
 		}
-		network.Gateway = net.ParseIP(gatewayStr)
-		networks = append(networks, &network)
 	}
-	return networks, nil
+
+	if _, err := tx.Exec(`DELETE FROM ip_addresses WHERE network_id = $1`, id); err != nil {
+		return fmt.Errorf("failed to delete IP addresses: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM networks WHERE id = $1`, id); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation {
+			return domain.NewError(domain.ErrConflict, "network %d has child networks", id)
+		}
+		return fmt.Errorf("failed to delete network: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
 }
 
-func (r *IPAMRepository) AllocateIP(networkID int, requestedIP net.IP, hostname string) (*domain.IPAddress, error) {
+// AllocateIP allocates an address in a transaction that holds a lock on
+// the network, so concurrent allocations in it run one after another and
+// always see each other's addresses and hostnames.
+func (r *IPAMRepository) AllocateIP(req *domain.AllocationRequest) (*domain.IPAddress, error) {
+	var ip *domain.IPAddress
+	err := r.retry(func() (err error) {
+		ip, err = r.allocateIP(req)
+		return err
+	})
+	return ip, err
+}
+
+func (r *IPAMRepository) allocateIP(req *domain.AllocationRequest) (*domain.IPAddress, error) {
+	networkID, requestedIP, hostname := req.NetworkID, req.RequestedIP, req.Hostname
+
 	tx, err := r.db.Begin()
 	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	// Check if hostname is already in use for this network
+	// Get the network details including the gateway, locking the network
+	// until the allocation commits. The checks below run under the lock.
+	var networkCIDR, gatewayStr string
+	var strategy domain.Strategy
+	err = tx.QueryRow("SELECT cidr, gateway, allocation_strategy FROM networks WHERE id = $1 FOR UPDATE", networkID).Scan(&networkCIDR, &gatewayStr, &strategy)
+	if err == sql.ErrNoRows {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", networkID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network details: %w", err)
+	}
+
+	gatewayIP := net.ParseIP(gatewayStr)
+	if gatewayIP == nil {
+		return nil, fmt.Errorf("invalid gateway IP: %s", gatewayStr)
+	}
+
+	_, ipNet, err := net.ParseCIDR(networkCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse network CIDR: %w", err)
+	}
+
+	// Check if hostname is already in use for this network. Addresses
+	// without a hostname, such as reservations, never conflict.
 	var existingHostname string
-	err = tx.QueryRow("SELECT hostname FROM ip_addresses WHERE network_id = $1 AND hostname = $2", networkID, hostname).Scan(&existingHostname)
+	err = tx.QueryRow("SELECT hostname FROM ip_addresses WHERE network_id = $1 AND hostname = $2 AND hostname <> ''", networkID, hostname).Scan(&existingHostname)
 	if err != sql.ErrNoRows {
 		if err == nil {
-			return nil, fmt.Errorf("hostname %s is already in use in this network", hostname)
+			return nil, domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", hostname).
+				WithDetail("hostname", hostname)
+		}
+		return nil, fmt.Errorf("failed to check hostname uniqueness: %w", err)
+	}
+
+	if req.IdempotencyKey != "" {
+		err = tx.QueryRow("SELECT id FROM ip_addresses WHERE network_id = $1 AND idempotency_key = $2", networkID, req.IdempotencyKey).Scan(new(int))
+		if err == nil {
+			return nil, domain.NewError(domain.ErrConflict, "idempotency key %s is already in use in this network", req.IdempotencyKey).
+				WithDetail("idempotency_key", req.IdempotencyKey)
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to check idempotency key uniqueness: %w", err)
 		}
-		return nil, fmt.Errorf("failed to check hostname uniqueness: %v", err)
 	}
 
 	var ipAddress domain.IPAddress
 	var addressStr string
+	mac := nullableMAC(req.MAC)
+	status := req.InitialStatus()
+	leaseExpiresAt := domain.LeaseExpiry(time.Now().UTC(), req.Lease)
+	idempotencyKey := sql.NullString{String: req.IdempotencyKey, Valid: req.IdempotencyKey != ""}
+	tags, err := encodeTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
 
-	// First, get the network details including the gateway
-	var networkCIDR, gatewayStr string
-	err = tx.QueryRow("SELECT cidr, gateway FROM networks WHERE id = $1", networkID).Scan(&networkCIDR, &gatewayStr)
+	reserved, err := reservedRanges(tx, "WHERE network_id = $1", networkID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get network details: %v", err)
+		return nil, err
 	}
+	network := &domain.Network{ID: networkID, CIDR: networkCIDR, Gateway: gatewayIP, Reserved: reserved[networkID], Strategy: strategy}
 
-	gatewayIP := net.ParseIP(gatewayStr)
-	if gatewayIP == nil {
-		return nil, fmt.Errorf("invalid gateway IP: %s", gatewayStr)
+	// In IPv6 networks a host's MAC pins it to its EUI-64 address
+	if requestedIP == nil && len(req.MAC) > 0 && ipNet.IP.To4() == nil {
+		if requestedIP, err = domain.EUI64(ipNet, req.MAC); err != nil {
+			return nil, err
+		}
+	}
+
+	// Released addresses whose quarantine has passed are removed, which
+	// makes them available to the checks below.
+	if err := r.recycleReleased(tx, networkID); err != nil {
+		return nil, err
 	}
 
 	if requestedIP != nil {
-		// Check if the requested IP is available and not the gateway
-		if requestedIP.Equal(gatewayIP) {
-			return nil, fmt.Errorf("cannot allocate gateway address %s", gatewayStr)
+		if err := domain.ValidateRequested(network, ipNet, requestedIP); err != nil {
+			return nil, err
 		}
 
 		query := `
@@ -109,58 +424,51 @@ func (r *IPAMRepository) AllocateIP(networkID int, requestedIP net.IP, hostname
 		`
 		err = tx.QueryRow(query, networkID, requestedIP.String()).Scan(&ipAddress.ID, &addressStr)
 		if err == nil {
-			return nil, fmt.Errorf("IP address %s is already allocated", requestedIP.String())
+			return nil, domain.NewError(domain.ErrConflict, "IP address %s is already allocated", requestedIP.String()).
+				WithDetail("address", requestedIP.String())
 		} else if err != sql.ErrNoRows {
-			return nil, fmt.Errorf("failed to check IP address: %v", err)
+			return nil, fmt.Errorf("failed to check IP address: %w", err)
 		}
 
 		// If we reach here, the IP is not allocated and not the gateway, so we can allocate it
 		query = `
-			INSERT INTO ip_addresses (network_id, address, hostname, status)
-			VALUES ($1, $2, $3, 'allocated')
-			RETURNING id, address::text
+			INSERT INTO ip_addresses (network_id, address, hostname, status, mac, description, owner, tags, lease_expires_at, idempotency_key)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id, address::text, created_at
 		`
-		err = tx.QueryRow(query, networkID, requestedIP.String(), hostname).Scan(&ipAddress.ID, &addressStr)
+		err = tx.QueryRow(query, networkID, requestedIP.String(), hostname, status, mac, req.Description, req.Owner, tags, leaseExpiresAt, idempotencyKey).
+			Scan(&ipAddress.ID, &addressStr, &ipAddress.CreatedAt)
 	} else {
-		// Get the first available IP address, excluding the gateway
-		_, ipNet, err := net.ParseCIDR(networkCIDR)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse network CIDR: %v", err)
+		var searches []addressSearch
+		if searches, err = addressSearches(network, ipNet, req.Strategy); err != nil {
+			return nil, err
 		}
-
-		for ip := nextIP(ipNet.IP); ipNet.Contains(ip); ip = nextIP(ip) {
-			if ip.Equal(gatewayIP) {
-				continue
-			}
-
-			query := `
-				INSERT INTO ip_addresses (network_id, address, hostname, status)
-				SELECT $1, $2, $3, 'allocated'
-				WHERE NOT EXISTS (
-					SELECT 1 FROM ip_addresses WHERE network_id = $1 AND address = $2
-				)
-				RETURNING id, address::text
-			`
-			err = tx.QueryRow(query, networkID, ip.String(), hostname).Scan(&ipAddress.ID, &addressStr)
-			if err == nil {
-				break
+		for _, search := range searches {
+			starts, ends := make([]string, len(search.ranges)), make([]string, len(search.ranges))
+			for i, r := range search.ranges {
+				starts[i], ends[i] = r.Start.String(), r.End.String()
 			}
+			err = tx.QueryRow(search.query, networkID, pq.Array(starts), pq.Array(ends), hostname, status, mac, req.Description, req.Owner, tags, leaseExpiresAt, idempotencyKey).
+				Scan(&ipAddress.ID, &addressStr, &ipAddress.CreatedAt)
 			if err != sql.ErrNoRows {
-				return nil, fmt.Errorf("failed to allocate IP address: %v", err)
+				break
 			}
 		}
+		if err != nil && err != sql.ErrNoRows {
+			return nil, conflictError(err, "", hostname, req.IdempotencyKey)
+		}
 
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("no available IP addresses in the network")
+			return nil, domain.NewError(domain.ErrExhausted, "no available IP addresses in network %d", networkID)
 		}
 	}
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to allocate IP address: %v", err)
+		return nil, conflictError(err, requestedIP.String(), hostname, req.IdempotencyKey)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	// CIDR表記からIPアドレス部分のみを抽出
@@ -172,63 +480,335 @@ func (r *IPAMRepository) AllocateIP(networkID int, requestedIP net.IP, hostname
 		return nil, fmt.Errorf("failed to parse allocated IP address: %s", ipOnly)
 	}
 	ipAddress.Hostname = hostname
-	ipAddress.Status = "allocated"
+	ipAddress.Status = status
+	ipAddress.MAC = req.MAC
+	ipAddress.Description = req.Description
+	ipAddress.Owner = req.Owner
+	ipAddress.Tags = req.Tags
+	ipAddress.UpdatedAt = ipAddress.CreatedAt
+	ipAddress.LeaseExpiresAt = leaseExpiresAt
+	ipAddress.IdempotencyKey = req.IdempotencyKey
 	return &ipAddress, nil
 }
 
+func (r *IPAMRepository) AllocateIPs(req *domain.BulkAllocationRequest) ([]*domain.IPAddress, error) {
+	var ips []*domain.IPAddress
+	err := r.retry(func() (err error) {
+		ips, err = r.allocateIPs(req)
+		return err
+	})
+	return ips, err
+}
+
+func (r *IPAMRepository) allocateIPs(req *domain.BulkAllocationRequest) ([]*domain.IPAddress, error) {
+	networkID := req.NetworkID
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Locking the network serializes allocations in it, so the set of
+	// used addresses read below stays accurate.
+	network, err := scanNetwork(tx.QueryRow("SELECT "+networkColumns+" FROM networks WHERE id = $1 FOR UPDATE", networkID))
+	if err == sql.ErrNoRows {
+		return nil, domain.NewError(domain.ErrNotFound, "network %d not found", networkID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network details: %w", err)
+	}
+	reserved, err := reservedRanges(tx, "WHERE network_id = $1", networkID)
+	if err != nil {
+		return nil, err
+	}
+	network.Reserved = reserved[networkID]
+
+	for _, hostname := range req.Hostnames {
+		var existingHostname string
+		err = tx.QueryRow("SELECT hostname FROM ip_addresses WHERE network_id = $1 AND hostname = $2 AND hostname <> ''", networkID, hostname).Scan(&existingHostname)
+		if err == nil {
+			return nil, domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", hostname).
+				WithDetail("hostname", hostname)
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to check hostname uniqueness: %w", err)
+		}
+	}
+
+	if err := r.recycleReleased(tx, networkID); err != nil {
+		return nil, err
+	}
+	used, err := usedAddresses(tx, networkID)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := domain.SelectAddresses(network, req, func(ip net.IP) bool { return used[ip.String()] }, releaseHistory(tx, networkID))
+	if err != nil {
+		return nil, err
+	}
+
+	status := req.InitialStatus()
+	leaseExpiresAt := domain.LeaseExpiry(time.Now().UTC(), req.Lease)
+	tags, err := encodeTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]*domain.IPAddress, len(addresses))
+	for i, address := range addresses {
+		ip := &domain.IPAddress{
+			NetworkID:      networkID,
+			Address:        address,
+			Hostname:       req.Hostname(i),
+			Status:         status,
+			Description:    req.Description,
+			Owner:          req.Owner,
+			Tags:           req.Tags,
+			LeaseExpiresAt: leaseExpiresAt,
+		}
+		err = tx.QueryRow(`
+			INSERT INTO ip_addresses (network_id, address, hostname, status, mac, description, owner, tags, lease_expires_at)
+			VALUES ($1, $2, $3, $4, NULL, $5, $6, $7, $8)
+			RETURNING id, created_at
+		`, networkID, address.String(), ip.Hostname, status, req.Description, req.Owner, tags, leaseExpiresAt).Scan(&ip.ID, &ip.CreatedAt)
+		if err != nil {
+			return nil, conflictError(err, address.String(), ip.Hostname, "")
+		}
+		ip.UpdatedAt = ip.CreatedAt
+		ips[i] = ip
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return ips, nil
+}
+
 func (r *IPAMRepository) ReleaseIP(id int) error {
-	query := `UPDATE ip_addresses SET status = 'available', hostname = NULL WHERE id = $1`
-	result, err := r.db.Exec(query, id)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var status domain.AddressStatus
+	err = tx.QueryRow(`SELECT status FROM ip_addresses WHERE id = $1 FOR UPDATE`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
 	if err != nil {
+		return fmt.Errorf("failed to get IP status: %v", err)
+	}
+	if status.Released() {
+		return domain.NewError(domain.ErrConflict, "IP address %d has been released", id).
+			WithDetail("status", string(status))
+	}
+
+	query := `
+		UPDATE ip_addresses
+		SET status = $2, hostname = NULL, mac = NULL, description = '', owner = '', tags = '{}',
+			updated_at = now(), released_at = now(), lease_expires_at = NULL, idempotency_key = NULL
+		WHERE id = $1`
+	if _, err := tx.Exec(query, id, domain.ReleasedStatus(r.quarantine > 0)); err != nil {
 		return fmt.Errorf("failed to release IP address: %v", err)
 	}
-	rowsAffected, err := result.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+func (r *IPAMRepository) RenewLease(id int, expiresAt time.Time) error {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %v", err)
+		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("IP address not found")
+	defer tx.Rollback()
+
+	var status domain.AddressStatus
+	err = tx.QueryRow(`SELECT status FROM ip_addresses WHERE id = $1 FOR UPDATE`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get IP status: %v", err)
+	}
+	if status.Released() {
+		return domain.NewError(domain.ErrConflict, "IP address %d has been released", id).
+			WithDetail("status", string(status))
+	}
+
+	if _, err := tx.Exec(`UPDATE ip_addresses SET lease_expires_at = $2, updated_at = now() WHERE id = $1`, id, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("failed to renew lease: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// ExpireLeases releases the expired addresses in a single statement. The
+// rows are locked and read in a subquery, whose values are the ones from
+// before the update.
+func (r *IPAMRepository) ExpireLeases(now time.Time) ([]*domain.IPAddress, error) {
+	query := `
+		UPDATE ip_addresses
+		SET status = $2, hostname = NULL, mac = NULL, description = '', owner = '', tags = '{}',
+			updated_at = now(), released_at = now(), lease_expires_at = NULL, idempotency_key = NULL
+		FROM (
+			SELECT ` + ipColumns + ` FROM ip_addresses
+			WHERE lease_expires_at <= $1 AND status NOT IN ('available', 'quarantined')
+			FOR UPDATE
+		) AS expired
+		WHERE ip_addresses.id = expired.id
+		RETURNING expired.*`
+	rows, err := r.db.Query(query, now.UTC(), domain.ReleasedStatus(r.quarantine > 0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire leases: %v", err)
+	}
+	defer rows.Close()
+
+	var expired []*domain.IPAddress
+	for rows.Next() {
+		ip, err := scanIP(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan IP address row: %v", err)
+		}
+		expired = append(expired, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to expire leases: %v", err)
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ID < expired[j].ID })
+	return expired, nil
+}
+
+func (r *IPAMRepository) UpdateIPStatus(id int, from, to domain.AddressStatus) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var current domain.AddressStatus
+	err = tx.QueryRow(`SELECT status FROM ip_addresses WHERE id = $1 FOR UPDATE`, id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get IP status: %v", err)
+	}
+	if current != from {
+		return domain.NewError(domain.ErrConflict, "IP address %d is %s, not %s", id, current, from).
+			WithDetail("status", string(current))
+	}
+
+	if _, err := tx.Exec(`UPDATE ip_addresses SET status = $2, updated_at = now() WHERE id = $1`, id, to); err != nil {
+		return fmt.Errorf("failed to update IP status: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 	return nil
 }
 
+// ipColumns are the columns read by scanIP.
+const ipColumns = `id, network_id, address::text, COALESCE(hostname, ''), status, mac, description, owner, tags, created_at, updated_at, released_at, lease_expires_at, COALESCE(idempotency_key, '')`
+
 func (r *IPAMRepository) GetIP(id int) (*domain.IPAddress, error) {
-    query := `SELECT id, network_id, address::text, hostname, status FROM ip_addresses WHERE id = $1`
-    var ip domain.IPAddress
-    var addressStr string
-    err := r.db.QueryRow(query, id).Scan(&ip.ID, &ip.NetworkID, &addressStr, &ip.Hostname, &ip.Status)
-    if err != nil {
-        if err == sql.ErrNoRows {
-            return nil, nil
-        }
-        return nil, fmt.Errorf("failed to get IP address: %v", err)
-    }
-    ip.Address = net.ParseIP(strings.Split(addressStr, "/")[0])
-    return &ip, nil
-}
-
-func (r *IPAMRepository) ListIPs(networkID int) ([]*domain.IPAddress, error) {
-    query := `SELECT id, network_id, address::text, hostname, status FROM ip_addresses WHERE network_id = $1`
-    rows, err := r.db.Query(query, networkID)
-    if err != nil {
-        return nil, fmt.Errorf("failed to list IP addresses: %v", err)
-    }
-    defer rows.Close()
-
-    var ips []*domain.IPAddress
-    for rows.Next() {
-        var ip domain.IPAddress
-        var addressStr string
-        if err := rows.Scan(&ip.ID, &ip.NetworkID, &addressStr, &ip.Hostname, &ip.Status); err != nil {
-            return nil, fmt.Errorf("failed to scan IP address row: %v", err)
-        }
-        ip.Address = net.ParseIP(strings.Split(addressStr, "/")[0])
-        ips = append(ips, &ip)
-    }
-    return ips, nil
-}
-
-func (r *IPAMRepository) UpdateIPHostname(id int, hostname string) error {
+	query := `SELECT ` + ipColumns + ` FROM ip_addresses WHERE id = $1`
+	ip, err := scanIP(r.db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, domain.NewError(domain.ErrNotFound, "IP address %d not found", id)
+		}
+		return nil, fmt.Errorf("failed to get IP address: %v", err)
+	}
+	return ip, nil
+}
+
+func (r *IPAMRepository) GetIPByHostname(networkID int, hostname string) (*domain.IPAddress, error) {
+	query := `SELECT ` + ipColumns + ` FROM ip_addresses WHERE network_id = $1 AND hostname = $2 AND hostname <> ''`
+	ip, err := scanIP(r.db.QueryRow(query, networkID, hostname))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, domain.NewError(domain.ErrNotFound, "no IP address with hostname %s in network %d", hostname, networkID)
+		}
+		return nil, fmt.Errorf("failed to get IP address: %v", err)
+	}
+	return ip, nil
+}
+
+func (r *IPAMRepository) GetIPByIdempotencyKey(networkID int, key string) (*domain.IPAddress, error) {
+	query := `SELECT ` + ipColumns + ` FROM ip_addresses WHERE network_id = $1 AND idempotency_key = $2`
+	ip, err := scanIP(r.db.QueryRow(query, networkID, key))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, domain.NewError(domain.ErrNotFound, "no IP address with idempotency key %s in network %d", key, networkID)
+		}
+		return nil, fmt.Errorf("failed to get IP address: %v", err)
+	}
+	return ip, nil
+}
+
+func (r *IPAMRepository) ListIPs(networkID int, filter *domain.IPFilter, page *domain.Page) ([]*domain.IPAddress, string, error) {
+	conditions := []string{"network_id = $1"}
+	args := []interface{}{networkID}
+	if filter != nil {
+		if filter.Status != "" {
+			args = append(args, filter.Status)
+			conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+		}
+		if filter.HostnamePrefix != "" {
+			args = append(args, likePrefix(filter.HostnamePrefix))
+			conditions = append(conditions, fmt.Sprintf("hostname LIKE $%d", len(args)))
+		}
+		if len(filter.Tags) > 0 {
+			tags, err := encodeTags(filter.Tags)
+			if err != nil {
+				return nil, "", err
+			}
+			args = append(args, tags)
+			conditions = append(conditions, fmt.Sprintf("tags @> $%d", len(args)))
+		}
+	}
+	order, err := pageQuery(page, ipSortColumns, &conditions, &args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	query := `SELECT ` + ipColumns + ` FROM ip_addresses WHERE ` + strings.Join(conditions, " AND ") + order
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list IP addresses: %v", err)
+	}
+	defer rows.Close()
+
+	var ips []*domain.IPAddress
+	for rows.Next() {
+		ip, err := scanIP(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan IP address row: %v", err)
+		}
+		ips = append(ips, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list IP addresses: %v", err)
+	}
+	var next string
+	if page != nil && page.Limit > 0 && len(ips) > page.Limit {
+		ips = ips[:page.Limit]
+		next = page.NextIPCursor(ips[len(ips)-1])
+	}
+	return ips, next, nil
+}
+
+func (r *IPAMRepository) UpdateIP(ip *domain.IPAddress) error {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
@@ -236,32 +816,45 @@ func (r *IPAMRepository) UpdateIPHostname(id int, hostname string) error {
 	defer tx.Rollback()
 
 	var networkID int
-	err = tx.QueryRow("SELECT network_id FROM ip_addresses WHERE id = $1", id).Scan(&networkID)
+	var status domain.AddressStatus
+	err = tx.QueryRow("SELECT network_id, status FROM ip_addresses WHERE id = $1 FOR UPDATE", ip.ID).Scan(&networkID, &status)
+	if err == sql.ErrNoRows {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", ip.ID)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get network ID: %v", err)
 	}
+	if status.Released() {
+		return domain.NewError(domain.ErrConflict, "IP address %d has been released", ip.ID).
+			WithDetail("status", string(status))
+	}
 
 	// Check if hostname is already in use for this network
 	var existingHostname string
-	err = tx.QueryRow("SELECT hostname FROM ip_addresses WHERE network_id = $1 AND hostname = $2 AND id != $3", networkID, hostname, id).Scan(&existingHostname)
+	err = tx.QueryRow("SELECT hostname FROM ip_addresses WHERE network_id = $1 AND hostname = $2 AND hostname <> '' AND id != $3", networkID, ip.Hostname, ip.ID).Scan(&existingHostname)
 	if err != sql.ErrNoRows {
 		if err == nil {
-			return fmt.Errorf("hostname %s is already in use in this network", hostname)
+			return domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", ip.Hostname).
+				WithDetail("hostname", ip.Hostname)
 		}
 		return fmt.Errorf("failed to check hostname uniqueness: %v", err)
 	}
 
-	query := `UPDATE ip_addresses SET hostname = $1 WHERE id = $2`
-	result, err := tx.Exec(query, hostname, id)
+	tags, err := encodeTags(ip.Tags)
 	if err != nil {
-		return fmt.Errorf("failed to update IP hostname: %v", err)
+		return err
 	}
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %v", err)
+	query := `
+		UPDATE ip_addresses
+		SET hostname = $2, mac = $3, description = $4, owner = $5, tags = $6, updated_at = now()
+		WHERE id = $1
+		RETURNING updated_at`
+	err = tx.QueryRow(query, ip.ID, ip.Hostname, nullableMAC(ip.MAC), ip.Description, ip.Owner, tags).Scan(&ip.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return domain.NewError(domain.ErrNotFound, "IP address %d not found", ip.ID)
 	}
-	if rowsAffected == 0 {
-		return fmt.Errorf("IP address not found")
+	if err != nil {
+		return conflictError(err, "", ip.Hostname, "")
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -271,15 +864,655 @@ func (r *IPAMRepository) UpdateIPHostname(id int, hostname string) error {
 	return nil
 }
 
-// nextIP returns the next IP address in the subnet
-func nextIP(ip net.IP) net.IP {
-	next := make(net.IP, len(ip))
-	copy(next, ip)
-	for j := len(next) - 1; j >= 0; j-- {
-		next[j]++
-		if next[j] > 0 {
-			break
+func (r *IPAMRepository) GetUtilization(networkID int) (*domain.Utilization, error) {
+	network, err := r.GetNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := r.addressCounts("AND a.network_id = $2", networkID)
+	if err != nil {
+		return nil, err
+	}
+	return domain.NewUtilization(network, counts[networkID])
+}
+
+func (r *IPAMRepository) ListUtilization(filter *domain.NetworkFilter) ([]*domain.Utilization, error) {
+	networks, _, err := r.ListNetworks(filter, nil)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := r.addressCounts("")
+	if err != nil {
+		return nil, err
+	}
+
+	var utilization []*domain.Utilization
+	for _, network := range networks {
+		u, err := domain.NewUtilization(network, counts[network.ID])
+		if err != nil {
+			return nil, err
+		}
+		utilization = append(utilization, u)
+	}
+	return utilization, nil
+}
+
+func (r *IPAMRepository) Search(query *domain.SearchQuery) (*domain.SearchResult, error) {
+	var condition string
+	var arg interface{}
+	switch {
+	case query.IP != nil:
+		condition, arg = "address = $1::inet", query.IP.String()
+	case query.Prefix != nil:
+		condition, arg = "address <<= $1::inet", query.Prefix.String()
+	case len(query.MAC) > 0:
+		condition, arg = "mac = $1", query.MAC.String()
+	case strings.Contains(query.Hostname, "*"):
+		condition, arg = "hostname LIKE $1", likeWildcard(query.Hostname)
+	default:
+		condition, arg = "hostname = $1", query.Hostname
+	}
+	sqlQuery := `SELECT ` + ipColumns + ` FROM ip_addresses
+		WHERE ` + condition + ` AND status NOT IN ('available', 'quarantined')
+		ORDER BY address, id`
+	args := []interface{}{arg}
+	if query.Limit > 0 {
+		args = append(args, query.Limit+1)
+		sqlQuery += ` LIMIT $2`
+	}
+	rows, err := r.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search IP addresses: %v", err)
+	}
+	defer rows.Close()
+
+	result := &domain.SearchResult{}
+	for rows.Next() {
+		ip, err := scanIP(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan IP address row: %v", err)
+		}
+		result.Addresses = append(result.Addresses, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search IP addresses: %v", err)
+	}
+	if query.Limit > 0 && len(result.Addresses) > query.Limit {
+		result.Addresses = result.Addresses[:query.Limit]
+		result.Truncated = true
+	}
+
+	if target := query.Target(); target != nil {
+		// DISTINCT ON keeps the first row of each VRF, which is its longest
+		// network containing the target.
+		result.Networks, err = queryNetworks(r.db, `
+			SELECT * FROM (
+				SELECT DISTINCT ON (vrf) `+networkColumns+`
+				FROM networks
+				WHERE cidr >>= $1::inet
+				ORDER BY vrf, masklen(cidr) DESC
+			) AS containing
+			ORDER BY id`, target.String())
+	} else {
+		ids := make([]int64, 0, len(result.Addresses))
+		for _, ip := range result.Addresses {
+			ids = append(ids, int64(ip.NetworkID))
+		}
+		result.Networks, err = queryNetworks(r.db, `SELECT `+networkColumns+` FROM networks WHERE id = ANY($1) ORDER BY id`, pq.Array(ids))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.loadReservedRanges(result.Networks); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// addressCounts tallies the address records of the networks selected by
+// the condition, keyed by network ID. Released records whose quarantine
+// has passed are free and left out. The condition may refer to the
+// records as a and to parameters from $2 on.
+func (r *IPAMRepository) addressCounts(condition string, args ...interface{}) (map[int]domain.AddressCounts, error) {
+	query := `
+		SELECT a.network_id,
+			count(*) FILTER (WHERE a.status IN ('allocated', 'deprecated')),
+			count(*) FILTER (WHERE a.status NOT IN ('allocated', 'deprecated')),
+			count(*) FILTER (WHERE EXISTS (
+				SELECT 1 FROM network_reserved_ranges rr
+				WHERE rr.network_id = a.network_id AND a.address BETWEEN rr.start_address AND rr.end_address
+			))
+		FROM ip_addresses a
+		WHERE (a.status NOT IN ('available', 'quarantined') OR a.released_at IS NULL
+			OR a.released_at > now() - make_interval(secs => $1))
+		` + condition + `
+		GROUP BY a.network_id`
+	rows, err := r.db.Query(query, append([]interface{}{r.quarantine.Seconds()}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count IP addresses: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int]domain.AddressCounts)
+	for rows.Next() {
+		var networkID int
+		var c domain.AddressCounts
+		if err := rows.Scan(&networkID, &c.Allocated, &c.Held, &c.InReserved); err != nil {
+			return nil, fmt.Errorf("failed to scan IP address counts: %v", err)
 		}
+		counts[networkID] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count IP addresses: %v", err)
+	}
+	return counts, nil
+}
+
+func nullableID(id sql.NullInt64) *int {
+	if !id.Valid {
+		return nil
+	}
+	v := int(id.Int64)
+	return &v
+}
+
+func nullableVLAN(vlan int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(vlan), Valid: vlan != 0}
+}
+
+// encodeTags returns tags as a JSON object for the jsonb tags column.
+func encodeTags(tags map[string]string) (string, error) {
+	if len(tags) == 0 {
+		return "{}", nil
+	}
+	buf, err := json.Marshal(tags)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode tags: %w", err)
+	}
+	return string(buf), nil
+}
+
+func nullableMAC(mac net.HardwareAddr) sql.NullString {
+	return sql.NullString{String: mac.String(), Valid: len(mac) > 0}
+}
+
+// decodeTags parses a jsonb tags column. An empty object yields nil.
+func decodeTags(buf []byte) (map[string]string, error) {
+	var tags map[string]string
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &tags); err != nil {
+			return nil, err
+		}
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanNetwork reads a row of networkColumns.
+func scanNetwork(row scanner) (*domain.Network, error) {
+	var network domain.Network
+	var gatewayStr string
+	var parentID, vlan sql.NullInt64
+	var tags []byte
+	err := row.Scan(&network.ID, &network.CIDR, &gatewayStr, &network.VRF, &parentID,
+		&network.Name, &network.Description, &vlan, &network.Site, &tags, &network.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	network.Gateway = net.ParseIP(gatewayStr)
+	network.ParentID = nullableID(parentID)
+	network.VLAN = int(vlan.Int64)
+	if network.Tags, err = decodeTags(tags); err != nil {
+		return nil, fmt.Errorf("failed to decode tags of network %d: %w", network.ID, err)
+	}
+	return &network, nil
+}
+
+// scanIP reads a row of ipColumns.
+func scanIP(row scanner) (*domain.IPAddress, error) {
+	var ip domain.IPAddress
+	var addressStr string
+	var mac sql.NullString
+	var tags []byte
+	var releasedAt, leaseExpiresAt sql.NullTime
+	err := row.Scan(&ip.ID, &ip.NetworkID, &addressStr, &ip.Hostname, &ip.Status,
+		&mac, &ip.Description, &ip.Owner, &tags, &ip.CreatedAt, &ip.UpdatedAt, &releasedAt, &leaseExpiresAt, &ip.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	ip.Address = net.ParseIP(strings.Split(addressStr, "/")[0])
+	if mac.Valid {
+		if ip.MAC, err = net.ParseMAC(mac.String); err != nil {
+			return nil, fmt.Errorf("invalid MAC address of IP address %d: %w", ip.ID, err)
+		}
+	}
+	if ip.Tags, err = decodeTags(tags); err != nil {
+		return nil, fmt.Errorf("failed to decode tags of IP address %d: %w", ip.ID, err)
+	}
+	if releasedAt.Valid {
+		ip.ReleasedAt = &releasedAt.Time
+	}
+	if leaseExpiresAt.Valid {
+		ip.LeaseExpiresAt = &leaseExpiresAt.Time
+	}
+	return &ip, nil
+}
+
+// retry runs fn until it succeeds, fails for a reason other than a
+// concurrent transaction, or maxTxAttempts is reached.
+func (r *IPAMRepository) retry(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		if err = fn(); !isRetryable(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("too many concurrent transactions: %v", err)
+}
+
+// isRetryable reports whether err aborted a transaction only because of
+// concurrent transactions, so that running it again may succeed.
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == serializationFailure || pqErr.Code == deadlockDetected
+}
+
+// conflictError maps a unique violation raised while writing an IP address
+// to ErrConflict, naming the address, hostname or idempotency key that is
+// already taken. Other errors are wrapped as they are.
+func conflictError(err error, address, hostname, key string) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != uniqueViolation {
+		return fmt.Errorf("failed to write IP address: %w", err)
+	}
+	switch {
+	case pqErr.Constraint == "ip_addresses_network_id_hostname_idx":
+		return domain.NewError(domain.ErrConflict, "hostname %s is already in use in this network", hostname).
+			WithDetail("hostname", hostname)
+	case pqErr.Constraint == "ip_addresses_network_id_idempotency_key_idx":
+		return domain.NewError(domain.ErrConflict, "idempotency key %s is already in use in this network", key).
+			WithDetail("idempotency_key", key)
+	case pqErr.Constraint == "ip_addresses_network_id_address_idx" && address != "":
+		return domain.NewError(domain.ErrConflict, "IP address %s is already allocated", address).
+			WithDetail("address", address)
+	}
+	return domain.NewError(domain.ErrConflict, "IP address conflicts with an existing one: %s", pqErr.Message)
+}
+
+// networkConflictError maps the violation of the constraint against
+// overlapping networks, or of the foreign key on a parent deleted
+// meanwhile, raised while writing network, to ErrConflict. Other errors
+// are wrapped as they are.
+func networkConflictError(err error, network *domain.Network) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == exclusionViolation && pqErr.Constraint == "networks_no_overlap" {
+		return domain.NewError(domain.ErrConflict, "network %s overlaps another network in its VRF", network.CIDR).
+			WithDetail("cidr", network.CIDR)
+	}
+	if errors.As(err, &pqErr) && pqErr.Code == foreignKeyViolation && network.ParentID != nil {
+		return domain.NewError(domain.ErrConflict, "parent network %d was deleted", *network.ParentID).
+			WithDetail("parent_id", strconv.Itoa(*network.ParentID))
+	}
+	return fmt.Errorf("failed to create network: %w", err)
+}
+
+// addressSearch is a statement allocating a free address in ranges.
+type addressSearch struct {
+	query  string
+	ranges []domain.IPRange
+}
+
+// addressSearches returns the statements AllocateIP runs in turn, until
+// one allocates an address, to allocate with the given strategy. None of
+// them reads the addresses of the network into Go. Random allocation
+// tries up to RandomProbes random addresses in the order they were drawn,
+// and then the lowest free address of a network that is not sparse.
+// Least recently released allocation takes the lowest address that was
+// never released, and then the one released longest ago.
+func addressSearches(network *domain.Network, ipNet *net.IPNet, requested domain.Strategy) ([]addressSearch, error) {
+	ranges := domain.AllocatableRanges(network, ipNet)
+	switch domain.ResolveStrategy(requested, network, ipNet) {
+	case domain.StrategyLastFree:
+		return []addressSearch{{freeAddressQuery(true, false), ranges}}, nil
+	case domain.StrategyRandom:
+		picker, err := domain.NewPicker(domain.StrategyRandom, network, ipNet, func(net.IP) bool { return false }, nil)
+		if err != nil {
+			return nil, err
+		}
+		var candidates []domain.IPRange
+		for len(candidates) < domain.RandomProbes {
+			ip, err := picker.Next()
+			if err != nil {
+				return nil, err
+			}
+			if ip == nil {
+				break
+			}
+			candidates = append(candidates, domain.IPRange{Start: ip, End: ip})
+		}
+		searches := []addressSearch{{candidateAddressQuery, candidates}}
+		if !domain.IsSparse(ipNet) {
+			searches = append(searches, addressSearch{freeAddressQuery(false, false), ranges})
+		}
+		return searches, nil
+	case domain.StrategyLeastRecentlyReleased:
+		return []addressSearch{
+			{freeAddressQuery(false, true), ranges},
+			{leastRecentlyReleasedQuery, ranges},
+		}, nil
+	}
+	return []addressSearch{{freeAddressQuery(false, false), ranges}}, nil
+}
+
+// freeAddressQuery returns the statement that allocates the lowest free
+// address in the ranges given as $2 and $3, or the highest one if last is
+// set. The lowest free address is either the start of a range or follows
+// a taken one, and the highest is the end of a range or precedes a taken
+// one, so a single query finds it no matter how full the network is. With
+// unreleased set, addresses in the release history count as taken too.
+func freeAddressQuery(last, unreleased bool) string {
+	bound, neighbour, order := "free.start_address", "used.address + 1", "ASC"
+	within := "used.address >= free.start_address AND used.address < free.end_address"
+	if last {
+		bound, neighbour, order = "free.end_address", "used.address - 1", "DESC"
+		within = "used.address > free.start_address AND used.address <= free.end_address"
+	}
+	taken := "SELECT address FROM ip_addresses WHERE network_id = $1"
+	if unreleased {
+		taken += " UNION ALL SELECT address FROM address_releases WHERE network_id = $1"
+	}
+	return `
+		INSERT INTO ip_addresses (network_id, address, hostname, status, mac, description, owner, tags, lease_expires_at, idempotency_key)
+		SELECT $1, candidate.address, $4, $5, $6, $7, $8, $9, $10, $11
+		FROM (
+			SELECT ` + bound + ` AS address
+			FROM unnest($2::inet[], $3::inet[]) AS free(start_address, end_address)
+			UNION ALL
+			SELECT ` + neighbour + `
+			FROM (` + taken + `) AS used
+			JOIN unnest($2::inet[], $3::inet[]) AS free(start_address, end_address)
+				ON ` + within + `
+		) AS candidate
+		WHERE NOT EXISTS (
+			SELECT 1 FROM (` + taken + `) AS used WHERE used.address = candidate.address
+		)
+		ORDER BY candidate.address ` + order + `
+		LIMIT 1
+		RETURNING id, address::text, created_at`
+}
+
+// candidateAddressQuery allocates the first free one of the single
+// address ranges given as $2 and $3, in the order they are given.
+const candidateAddressQuery = `
+	INSERT INTO ip_addresses (network_id, address, hostname, status, mac, description, owner, tags, lease_expires_at, idempotency_key)
+	SELECT $1, candidate.address, $4, $5, $6, $7, $8, $9, $10, $11
+	FROM unnest($2::inet[], $3::inet[]) WITH ORDINALITY AS candidate(address, end_address, n)
+	WHERE NOT EXISTS (
+		SELECT 1 FROM ip_addresses WHERE network_id = $1 AND address = candidate.address
+	)
+	ORDER BY candidate.n
+	LIMIT 1
+	RETURNING id, address::text, created_at`
+
+// leastRecentlyReleasedQuery allocates the free address in the ranges
+// given as $2 and $3 that was released longest ago. It reads the release
+// history in the order of address_releases_released_at_idx and stops at
+// the first address that is free.
+const leastRecentlyReleasedQuery = `
+	INSERT INTO ip_addresses (network_id, address, hostname, status, mac, description, owner, tags, lease_expires_at, idempotency_key)
+	SELECT $1, released.address, $4, $5, $6, $7, $8, $9, $10, $11
+	FROM address_releases released
+	WHERE released.network_id = $1
+		AND EXISTS (
+			SELECT 1 FROM unnest($2::inet[], $3::inet[]) AS free(start_address, end_address)
+			WHERE released.address BETWEEN free.start_address AND free.end_address
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM ip_addresses WHERE network_id = $1 AND address = released.address
+		)
+	ORDER BY released.released_at, released.address
+	LIMIT 1
+	RETURNING id, address::text, created_at`
+
+// recycleReleased removes the released addresses of a network whose
+// quarantine has passed, keeping the time of their release in
+// address_releases.
+func (r *IPAMRepository) recycleReleased(tx *sql.Tx, networkID int) error {
+	_, err := tx.Exec(`
+		WITH recycled AS (
+			DELETE FROM ip_addresses
+			WHERE network_id = $1 AND status IN ('available', 'quarantined')
+				AND released_at <= now() - make_interval(secs => $2)
+			RETURNING network_id, address, released_at
+		)
+		INSERT INTO address_releases (network_id, address, released_at)
+		SELECT network_id, address, released_at FROM recycled
+		ON CONFLICT (network_id, address) DO UPDATE SET released_at = EXCLUDED.released_at
+	`, networkID, r.quarantine.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to recycle released IP addresses: %w", err)
+	}
+	return nil
+}
+
+// usedAddresses returns the set of addresses held in a network, keyed by
+// their string form.
+func usedAddresses(tx *sql.Tx, networkID int) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT host(address) FROM ip_addresses WHERE network_id = $1", networkID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list allocated addresses: %w", err)
+	}
+	defer rows.Close()
+
+	used := make(map[string]bool)
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			return nil, fmt.Errorf("failed to scan allocated address: %w", err)
+		}
+		used[address] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list allocated addresses: %w", err)
+	}
+	return used, nil
+}
+
+// releaseHistory returns a function reading the release history of a
+// network.
+func releaseHistory(tx *sql.Tx, networkID int) func() (domain.ReleaseHistory, error) {
+	return func() (domain.ReleaseHistory, error) {
+		rows, err := tx.Query("SELECT host(address), released_at FROM address_releases WHERE network_id = $1", networkID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list released addresses: %w", err)
+		}
+		defer rows.Close()
+
+		history := make(domain.ReleaseHistory)
+		for rows.Next() {
+			var address string
+			var releasedAt time.Time
+			if err := rows.Scan(&address, &releasedAt); err != nil {
+				return nil, fmt.Errorf("failed to scan released address: %w", err)
+			}
+			history[address] = releasedAt
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list released addresses: %w", err)
+		}
+		return history, nil
+	}
+}
+
+func insertReservedRanges(tx *sql.Tx, network *domain.Network) error {
+	for _, reserved := range network.Reserved {
+		_, err := tx.Exec(`
+			INSERT INTO network_reserved_ranges (network_id, start_address, end_address)
+			VALUES ($1, $2, $3)
+		`, network.ID, reserved.Start.String(), reserved.End.String())
+		if err != nil {
+			return fmt.Errorf("failed to create reserved range: %w", err)
+		}
+	}
+	return nil
+}
+
+// sortColumn is the SQL expression a listing is sorted by, and the type
+// the key of a cursor is cast to for comparison with it.
+type sortColumn struct {
+	expr string
+	cast string
+}
+
+// networkSortColumns and ipSortColumns map the sort keys of the listings
+// other than domain.SortByID to their columns. Hostnames are compared
+// bytewise, as Go compares strings, whatever the database's collation.
+var (
+	networkSortColumns = map[domain.SortKey]sortColumn{
+		domain.SortByCIDR: {expr: "cidr", cast: "cidr"},
+	}
+	ipSortColumns = map[domain.SortKey]sortColumn{
+		domain.SortByAddress:   {expr: "address", cast: "inet"},
+		domain.SortByHostname:  {expr: `COALESCE(hostname, '') COLLATE "C"`, cast: "text"},
+		domain.SortByCreatedAt: {expr: "created_at", cast: "timestamptz"},
+	}
+)
+
+// pageQuery adds the condition selecting the rows after the cursor of page
+// to conditions and returns the ORDER BY and LIMIT clauses of the query.
+// One row more than the page holds is selected, which tells whether
+// another page follows. A nil page selects all rows in ID order.
+func pageQuery(page *domain.Page, columns map[domain.SortKey]sortColumn, conditions *[]string, args *[]interface{}) (string, error) {
+	if page == nil {
+		return " ORDER BY id", nil
+	}
+	column, sorted := columns[page.Sort]
+	if !sorted && page.Sort != domain.SortByID {
+		return "", domain.NewError(domain.ErrInvalid, "cannot sort by %q", page.Sort).
+			WithDetail("sort", string(page.Sort))
+	}
+	cursor, err := page.DecodeCursor()
+	if err != nil {
+		return "", err
+	}
+
+	direction, after := "ASC", ">"
+	if page.Descending {
+		direction, after = "DESC", "<"
+	}
+	if cursor != nil {
+		*args = append(*args, cursor.ID)
+		if sorted {
+			*args = append(*args, cursor.Key)
+			*conditions = append(*conditions, fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)", column.expr, after, len(*args), column.cast, len(*args)-1))
+		} else {
+			*conditions = append(*conditions, fmt.Sprintf("id %s $%d", after, len(*args)))
+		}
+	}
+
+	order := fmt.Sprintf(" ORDER BY id %s", direction)
+	if sorted {
+		order = fmt.Sprintf(" ORDER BY %s %s, id %s", column.expr, direction, direction)
+	}
+	if page.Limit > 0 {
+		*args = append(*args, page.Limit+1)
+		order += fmt.Sprintf(" LIMIT $%d", len(*args))
+	}
+	return order, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// likePrefix returns the LIKE pattern matching strings that start with
+// prefix.
+func likePrefix(prefix string) string {
+	return likeEscaper.Replace(prefix) + "%"
+}
+
+// likeWildcard returns the LIKE pattern for a pattern in which "*"
+// matches any run of characters.
+func likeWildcard(pattern string) string {
+	return strings.ReplaceAll(likeEscaper.Replace(pattern), "*", "%")
+}
+
+// queryNetworks returns the networks selected by a query of
+// networkColumns, without their reserved ranges.
+func queryNetworks(q queryer, query string, args ...interface{}) ([]*domain.Network, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	defer rows.Close()
+
+	var networks []*domain.Network
+	for rows.Next() {
+		network, err := scanNetwork(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan network row: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	return networks, nil
+}
+
+// loadReservedRanges sets the reserved ranges of networks in a single
+// query.
+func (r *IPAMRepository) loadReservedRanges(networks []*domain.Network) error {
+	ids := make([]int64, 0, len(networks))
+	for _, network := range networks {
+		ids = append(ids, int64(network.ID))
+	}
+	reserved, err := reservedRanges(r.db, "WHERE network_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		network.Reserved = reserved[network.ID]
+	}
+	return nil
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// reservedRanges returns the reserved ranges matching the where clause,
+// keyed by network ID.
+func reservedRanges(q queryer, where string, args ...interface{}) (map[int][]domain.IPRange, error) {
+	query := `
+		SELECT network_id, host(start_address), host(end_address)
+		FROM network_reserved_ranges
+		` + where + `
+		ORDER BY network_id, start_address`
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reserved ranges: %w", err)
+	}
+	defer rows.Close()
+
+	ranges := make(map[int][]domain.IPRange)
+	for rows.Next() {
+		var networkID int
+		var start, end string
+		if err := rows.Scan(&networkID, &start, &end); err != nil {
+			return nil, fmt.Errorf("failed to scan reserved range row: %w", err)
+		}
+		ranges[networkID] = append(ranges[networkID], domain.IPRange{Start: net.ParseIP(start), End: net.ParseIP(end)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get reserved ranges: %w", err)
 	}
-	return next
+	return ranges, nil
 }
@@ -2,15 +2,113 @@ package persistence
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/zinrai/ipam-mvp-go/internal/domain"
 	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/db"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/migration"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/repotest"
 )
 
+// openTestDB connects to the PostgreSQL database named by
+// IPAM_TEST_POSTGRES_DSN, skipping tb if it is not set. The database's
+// tables may be dropped.
+func openTestDB(tb testing.TB) *sql.DB {
+	dsn := os.Getenv("IPAM_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		tb.Skip("IPAM_TEST_POSTGRES_DSN not set")
+	}
+	sqlDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		tb.Fatalf("failed to open database: %v", err)
+	}
+	tb.Cleanup(func() { sqlDB.Close() })
+	return sqlDB
+}
+
+// resetSchema drops all tables and migrates the database from scratch.
+func resetSchema(tb testing.TB, sqlDB *sql.DB) {
+	if _, err := sqlDB.Exec(`DROP TABLE IF EXISTS ip_addresses, address_releases, network_reserved_ranges, networks, schema_version`); err != nil {
+		tb.Fatalf("failed to reset schema: %v", err)
+	}
+	migrator, err := migration.NewMigrator(db.NewDB(sqlDB))
+	if err != nil {
+		tb.Fatalf("failed to load migrations: %v", err)
+	}
+	if _, err := migrator.Up(); err != nil {
+		tb.Fatalf("failed to migrate: %v", err)
+	}
+}
+
+// TestConformance runs the shared repository suite against a real
+// PostgreSQL database. It is skipped unless IPAM_TEST_POSTGRES_DSN is set.
+func TestConformance(t *testing.T) {
+	sqlDB := openTestDB(t)
+	repotest.Run(t, func(t *testing.T) domain.IPAMRepository {
+		resetSchema(t, sqlDB)
+		return NewIPAMRepository(db.NewDB(sqlDB))
+	})
+	repotest.RunQuarantine(t, func(t *testing.T, quarantine time.Duration) domain.IPAMRepository {
+		resetSchema(t, sqlDB)
+		return NewIPAMRepository(db.NewDB(sqlDB), WithQuarantine(quarantine))
+	})
+}
+
+// BenchmarkAllocateIP measures automatic allocation in a /16 at several
+// fill levels with each strategy. No strategy reads the addresses of the
+// network into Go, so the time per allocation should not grow as the
+// network fills up. It is skipped unless IPAM_TEST_POSTGRES_DSN is set.
+func BenchmarkAllocateIP(b *testing.B) {
+	sqlDB := openTestDB(b)
+	for _, strategy := range []domain.Strategy{domain.StrategyFirstFree, domain.StrategyRandom, domain.StrategyLeastRecentlyReleased} {
+		for _, percent := range []int{0, 50, 90, 99} {
+			b.Run(fmt.Sprintf("%s/%d%%", strategy, percent), func(b *testing.B) {
+				resetSchema(b, sqlDB)
+				repo := NewIPAMRepository(db.NewDB(sqlDB))
+				network := &domain.Network{CIDR: "10.0.0.0/16", Gateway: net.ParseIP("10.0.0.1"), Strategy: strategy}
+				if err := repo.CreateNetwork(network); err != nil {
+					b.Fatalf("failed to create network: %v", err)
+				}
+
+				// Fill the bottom of the network, which is where automatic
+				// allocation looks first.
+				used := 65534 * percent / 100
+				_, err := sqlDB.Exec(`
+					INSERT INTO ip_addresses (network_id, address, hostname, status)
+					SELECT $1, '10.0.0.0'::inet + n, 'fill-' || n, 'allocated'
+					FROM generate_series(2, $2::int + 1) AS n
+				`, network.ID, used)
+				if err != nil {
+					b.Fatalf("failed to fill network: %v", err)
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID})
+					if err != nil {
+						b.Fatalf("failed to allocate IP address: %v", err)
+					}
+					// The released address is recycled by the next
+					// allocation, which keeps the fill level constant.
+					b.StopTimer()
+					if err := repo.ReleaseIP(ip.ID); err != nil {
+						b.Fatalf("failed to release IP address: %v", err)
+					}
+					b.StartTimer()
+				}
+			})
+		}
+	}
+}
+
 func TestAllocateIP(t *testing.T) {
 	mockDB, mock, err := sqlmock.New()
 	if err != nil {
@@ -22,28 +120,56 @@ func TestAllocateIP(t *testing.T) {
 
 	t.Run("Hostname already in use", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("test-host"))
 		mock.ExpectRollback()
 
-		_, err := repo.AllocateIP(1, nil, "test-host")
-		if err == nil {
-			t.Error("expected an error, got nil")
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Idempotency key already in use", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT id FROM ip_addresses WHERE network_id = \\$1 AND idempotency_key = \\$2").
+			WithArgs(1, "req-1").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		mock.ExpectRollback()
+
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host", IdempotencyKey: "req-1"})
+		if !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
 		}
 	})
 
 	t.Run("Gateway address allocation attempt", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnError(sql.ErrNoRows)
-		mock.ExpectQuery("SELECT cidr, gateway FROM networks").
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
 			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway"}).AddRow("192.168.1.0/24", "192.168.1.1"))
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
 		mock.ExpectRollback()
 
-		_, err := repo.AllocateIP(1, net.ParseIP("192.168.1.1"), "test-host")
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, RequestedIP: net.ParseIP("192.168.1.1"), Hostname: "test-host"})
 		if err == nil {
 			t.Error("expected an error, got nil")
 		}
@@ -51,21 +177,27 @@ func TestAllocateIP(t *testing.T) {
 
 	t.Run("Allocate requested IP", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnError(sql.ErrNoRows)
-		mock.ExpectQuery("SELECT cidr, gateway FROM networks").
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
 			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway"}).AddRow("192.168.1.0/24", "192.168.1.1"))
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
 		mock.ExpectQuery("SELECT id, address::text FROM ip_addresses").
 			WithArgs(1, "192.168.1.2").
 			WillReturnError(sql.ErrNoRows)
 		mock.ExpectQuery("INSERT INTO ip_addresses").
-			WithArgs(1, "192.168.1.2", "test-host").
-			WillReturnRows(sqlmock.NewRows([]string{"id", "address"}).AddRow(1, "192.168.1.2/32"))
+			WithArgs(1, "192.168.1.2", "test-host", "allocated", nil, "", "", "{}", nil, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.2/32", time.Now()))
 		mock.ExpectCommit()
 
-		ip, err := repo.AllocateIP(1, net.ParseIP("192.168.1.2"), "test-host")
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, RequestedIP: net.ParseIP("192.168.1.2"), Hostname: "test-host"})
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
@@ -74,20 +206,170 @@ func TestAllocateIP(t *testing.T) {
 		}
 	})
 
+	t.Run("Skip reserved range", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}).AddRow(1, "192.168.1.2", "192.168.1.10"))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("INSERT INTO ip_addresses").
+			WithArgs(1, pq.Array([]string{"192.168.1.11"}), pq.Array([]string{"192.168.1.254"}), "test-host", "allocated", nil, "", "", "{}", nil, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.11/32", time.Now()))
+		mock.ExpectCommit()
+
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if ip.Address.String() != "192.168.1.11" {
+			t.Errorf("expected IP 192.168.1.11, got %s", ip.Address.String())
+		}
+	})
+
+	t.Run("Least recently released after the unreleased addresses", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", "least_recently_released"))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		ranges := []driver.Value{1, pq.Array([]string{"192.168.1.2"}), pq.Array([]string{"192.168.1.254"}), "test-host", "allocated", nil, "", "", "{}", nil, nil}
+		mock.ExpectQuery("INSERT INTO ip_addresses .* UNION ALL SELECT address FROM address_releases WHERE network_id = \\$1").
+			WithArgs(ranges...).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}))
+		mock.ExpectQuery("INSERT INTO ip_addresses .* FROM address_releases released .* ORDER BY released.released_at, released.address").
+			WithArgs(ranges...).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.7/32", time.Now()))
+		mock.ExpectCommit()
+
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip.Address.String() != "192.168.1.7" {
+			t.Errorf("expected IP 192.168.1.7, got %s", ip.Address.String())
+		}
+	})
+
+	t.Run("Random falls back to the lowest free address", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", "random"))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("INSERT INTO ip_addresses .* WITH ORDINALITY .* ORDER BY candidate.n").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}))
+		mock.ExpectQuery("INSERT INTO ip_addresses").
+			WithArgs(1, pq.Array([]string{"192.168.1.2"}), pq.Array([]string{"192.168.1.254"}), "test-host", "allocated", nil, "", "", "{}", nil, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.200/32", time.Now()))
+		mock.ExpectCommit()
+
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip.Address.String() != "192.168.1.200" {
+			t.Errorf("expected IP 192.168.1.200, got %s", ip.Address.String())
+		}
+	})
+
+	t.Run("Allocate EUI-64 IPv6 address", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("2001:db8::/64", "2001:db8::1", ""))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT id, address::text FROM ip_addresses").
+			WithArgs(1, "2001:db8::5054:ff:fe12:3456").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("INSERT INTO ip_addresses").
+			WithArgs(1, "2001:db8::5054:ff:fe12:3456", "test-host", "allocated", "52:54:00:12:34:56", "", "", "{}", nil, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "2001:db8::5054:ff:fe12:3456/128", time.Now()))
+		mock.ExpectCommit()
+
+		mac, _ := net.ParseMAC("52:54:00:12:34:56")
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host", MAC: mac})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if ip.Address.String() != "2001:db8::5054:ff:fe12:3456" {
+			t.Errorf("expected IP 2001:db8::5054:ff:fe12:3456, got %s", ip.Address.String())
+		}
+	})
+
+	t.Run("Subnet-router anycast address allocation attempt", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("2001:db8::/64", "2001:db8::1", ""))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, RequestedIP: net.ParseIP("2001:db8::"), Hostname: "test-host"})
+		if !errors.Is(err, domain.ErrInvalid) {
+			t.Errorf("expected ErrInvalid, got %v", err)
+		}
+	})
+
 	t.Run("Allocate first available IP", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnError(sql.ErrNoRows)
-		mock.ExpectQuery("SELECT cidr, gateway FROM networks").
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
 			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway"}).AddRow("192.168.1.0/24", "192.168.1.1"))
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
 		mock.ExpectQuery("INSERT INTO ip_addresses").
-			WithArgs(1, "192.168.1.2", "test-host").
-			WillReturnRows(sqlmock.NewRows([]string{"id", "address"}).AddRow(1, "192.168.1.2/32"))
+			WithArgs(1, pq.Array([]string{"192.168.1.2"}), pq.Array([]string{"192.168.1.254"}), "test-host", "allocated", nil, "", "", "{}", nil, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.2/32", time.Now()))
 		mock.ExpectCommit()
 
-		ip, err := repo.AllocateIP(1, nil, "test-host")
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
@@ -96,33 +378,157 @@ func TestAllocateIP(t *testing.T) {
 		}
 	})
 
+	t.Run("Allocate last available IP", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", "last_free"))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("INSERT INTO ip_addresses .* ORDER BY candidate.address DESC").
+			WithArgs(1, pq.Array([]string{"192.168.1.2"}), pq.Array([]string{"192.168.1.254"}), "test-host", "allocated", nil, "", "", "{}", nil, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.254/32", time.Now()))
+		mock.ExpectCommit()
+
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if ip.Address.String() != "192.168.1.254" {
+			t.Errorf("expected IP 192.168.1.254, got %s", ip.Address.String())
+		}
+	})
+
 	t.Run("No available IP addresses", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/30", "192.168.1.1", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnError(sql.ErrNoRows)
-		mock.ExpectQuery("SELECT cidr, gateway FROM networks").
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
 			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway"}).AddRow("192.168.1.0/24", "192.168.1.1"))
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		// .0 and .3 are the network and broadcast addresses, .1 the gateway
 		mock.ExpectQuery("INSERT INTO ip_addresses").
-			WithArgs(1, sqlmock.AnyArg(), "test-host").
+			WithArgs(1, pq.Array([]string{"192.168.1.2"}), pq.Array([]string{"192.168.1.2"}), "test-host", "allocated", nil, "", "", "{}", nil, nil).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if !errors.Is(err, domain.ErrExhausted) {
+			t.Errorf("expected ErrExhausted, got %v", err)
+		}
+	})
+
+	// expectAutomatic expects an automatic allocation in 192.168.1.0/24 up
+	// to the insert, whose result is left to the caller.
+	expectAutomatic := func() *sqlmock.ExpectedQuery {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks WHERE id = \\$1 FOR UPDATE").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		return mock.ExpectQuery("INSERT INTO ip_addresses").
+			WithArgs(1, pq.Array([]string{"192.168.1.2"}), pq.Array([]string{"192.168.1.254"}), "test-host", "allocated", nil, "", "", "{}", nil, nil)
+	}
+
+	t.Run("Retry after deadlock", func(t *testing.T) {
+		expectAutomatic().WillReturnError(&pq.Error{Code: deadlockDetected})
+		mock.ExpectRollback()
+		expectAutomatic().
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.2/32", time.Now()))
+		mock.ExpectCommit()
+
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip.Address.String() != "192.168.1.2" {
+			t.Errorf("expected IP 192.168.1.2, got %s", ip.Address.String())
+		}
+	})
+
+	t.Run("Retry after serialization failure in a helper", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks WHERE id = \\$1 FOR UPDATE").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "test-host").
 			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnError(&pq.Error{Code: serializationFailure})
 		mock.ExpectRollback()
+		expectAutomatic().
+			WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.2/32", time.Now()))
+		mock.ExpectCommit()
+
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip.Address.String() != "192.168.1.2" {
+			t.Errorf("expected IP 192.168.1.2, got %s", ip.Address.String())
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unfulfilled expectations: %v", err)
+		}
+	})
 
-		_, err := repo.AllocateIP(1, nil, "test-host")
+	t.Run("Give up after repeated serialization failures", func(t *testing.T) {
+		for i := 0; i < maxTxAttempts; i++ {
+			expectAutomatic().WillReturnError(&pq.Error{Code: serializationFailure})
+			mock.ExpectRollback()
+		}
+
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
 		if err == nil {
 			t.Error("expected an error, got nil")
 		}
 	})
 
+	t.Run("Hostname taken concurrently", func(t *testing.T) {
+		expectAutomatic().WillReturnError(&pq.Error{Code: uniqueViolation, Constraint: "ip_addresses_network_id_hostname_idx"})
+		mock.ExpectRollback()
+
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
+		if !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
 	t.Run("Database error when checking hostname", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnError(fmt.Errorf("database error"))
 		mock.ExpectRollback()
 
-		_, err := repo.AllocateIP(1, nil, "test-host")
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
 		if err == nil {
 			t.Error("expected an error, got nil")
 		}
@@ -130,15 +536,15 @@ func TestAllocateIP(t *testing.T) {
 
 	t.Run("Invalid gateway IP", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "invalid-ip", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnError(sql.ErrNoRows)
-		mock.ExpectQuery("SELECT cidr, gateway FROM networks").
-			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway"}).AddRow("192.168.1.0/24", "invalid-ip"))
 		mock.ExpectRollback()
 
-		_, err := repo.AllocateIP(1, nil, "test-host")
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"})
 		if err == nil {
 			t.Error("expected an error, got nil")
 		}
@@ -146,24 +552,99 @@ func TestAllocateIP(t *testing.T) {
 
 	t.Run("Database error when inserting IP", func(t *testing.T) {
 		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "test-host").
 			WillReturnError(sql.ErrNoRows)
-		mock.ExpectQuery("SELECT cidr, gateway FROM networks").
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
 			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway"}).AddRow("192.168.1.0/24", "192.168.1.1"))
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
 		mock.ExpectQuery("INSERT INTO ip_addresses").
-			WithArgs(1, "192.168.1.2", "test-host").
+			WithArgs(1, "192.168.1.2", "test-host", "allocated", nil, "", "", "{}", nil, nil).
 			WillReturnError(fmt.Errorf("database error"))
 		mock.ExpectRollback()
 
-		_, err := repo.AllocateIP(1, net.ParseIP("192.168.1.2"), "test-host")
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, RequestedIP: net.ParseIP("192.168.1.2"), Hostname: "test-host"})
 		if err == nil {
 			t.Error("expected an error, got nil")
 		}
 	})
 }
 
+func TestAllocateIPs(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+	columns := []string{"id", "cidr", "gateway", "vrf", "parent_id", "name", "description", "vlan_id", "site", "tags", "allocation_strategy"}
+	req := &domain.BulkAllocationRequest{NetworkID: 1, Hostnames: []string{"node-1", "node-2"}, Contiguous: true}
+
+	expectSelection := func() {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FROM networks WHERE id = \$1 FOR UPDATE`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow(1, "192.168.1.0/29", "192.168.1.1", "", nil, "", "", nil, "", []byte(`{}`), ""))
+		mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+		for _, hostname := range req.Hostnames {
+			mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+				WithArgs(1, hostname).
+				WillReturnError(sql.ErrNoRows)
+		}
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1, 0.0).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT host\\(address\\) FROM ip_addresses").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"host"}).AddRow("192.168.1.2"))
+		mock.ExpectQuery("INSERT INTO ip_addresses").
+			WithArgs(1, "192.168.1.3", "node-1", "allocated", "", "", "{}", nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	}
+
+	t.Run("Allocate contiguous block", func(t *testing.T) {
+		expectSelection()
+		mock.ExpectQuery("INSERT INTO ip_addresses").
+			WithArgs(1, "192.168.1.4", "node-2", "allocated", "", "", "{}", nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(8, time.Now()))
+		mock.ExpectCommit()
+
+		ips, err := repo.AllocateIPs(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(ips) != 2 || ips[0].ID != 7 || ips[1].Address.String() != "192.168.1.4" || ips[1].Hostname != "node-2" {
+			t.Errorf("unexpected allocation %+v", ips)
+		}
+	})
+
+	t.Run("Address already taken", func(t *testing.T) {
+		expectSelection()
+		mock.ExpectQuery("INSERT INTO ip_addresses").
+			WithArgs(1, "192.168.1.4", "node-2", "allocated", "", "", "{}", nil).
+			WillReturnError(&pq.Error{Code: uniqueViolation, Constraint: "ip_addresses_network_id_address_idx"})
+		mock.ExpectRollback()
+
+		if _, err := repo.AllocateIPs(req); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestCreateNetwork(t *testing.T) {
 	mockDB, mock, err := sqlmock.New()
 	if err != nil {
@@ -179,9 +660,11 @@ func TestCreateNetwork(t *testing.T) {
 			Gateway: net.ParseIP("192.168.1.1"),
 		}
 
+		mock.ExpectBegin()
 		mock.ExpectQuery("INSERT INTO networks").
-			WithArgs(network.CIDR, network.Gateway.String()).
+			WithArgs(network.CIDR, network.Gateway.String(), network.VRF, nil, "", "", nil, "", "{}", "").
 			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectCommit()
 
 		err := repo.CreateNetwork(network)
 		if err != nil {
@@ -192,96 +675,772 @@ func TestCreateNetwork(t *testing.T) {
 		}
 	})
 
-	t.Run("Database error when creating network", func(t *testing.T) {
+	t.Run("Create network with reserved range", func(t *testing.T) {
 		network := &domain.Network{
-			CIDR:    "192.168.1.0/24",
-			Gateway: net.ParseIP("192.168.1.1"),
+			CIDR:     "192.168.1.0/24",
+			Gateway:  net.ParseIP("192.168.1.1"),
+			Reserved: []domain.IPRange{{Start: net.ParseIP("192.168.1.2"), End: net.ParseIP("192.168.1.10")}},
 		}
 
+		mock.ExpectBegin()
 		mock.ExpectQuery("INSERT INTO networks").
-			WithArgs(network.CIDR, network.Gateway.String()).
-			WillReturnError(fmt.Errorf("database error"))
+			WithArgs(network.CIDR, network.Gateway.String(), network.VRF, nil, "", "", nil, "", "{}", "").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+		mock.ExpectExec("INSERT INTO network_reserved_ranges").
+			WithArgs(2, "192.168.1.2", "192.168.1.10").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
 
-		err := repo.CreateNetwork(network)
-		if err == nil {
-			t.Error("expected an error, got nil")
+		if err := repo.CreateNetwork(network); err != nil {
+			t.Errorf("unexpected error: %v", err)
 		}
 	})
-}
-
-func TestUpdateIPHostname(t *testing.T) {
-	mockDB, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer mockDB.Close()
 
-	repo := NewIPAMRepository(db.NewDB(mockDB))
+	t.Run("Create network with metadata", func(t *testing.T) {
+		network := &domain.Network{
+			CIDR:        "10.20.30.0/24",
+			Gateway:     net.ParseIP("10.20.30.1"),
+			Name:        "tokyo-prod",
+			Description: "Production servers",
+			VLAN:        120,
+			Site:        "tokyo",
+			Tags:        map[string]string{"env": "prod"},
+		}
 
-	t.Run("Update hostname successfully", func(t *testing.T) {
 		mock.ExpectBegin()
-		mock.ExpectQuery("SELECT network_id FROM ip_addresses").
-			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"network_id"}).AddRow(1))
-		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
-			WithArgs(1, "new-host", 1).
-			WillReturnError(sql.ErrNoRows)
-		mock.ExpectExec("UPDATE ip_addresses").
-			WithArgs("new-host", 1).
-			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("INSERT INTO networks").
+			WithArgs(network.CIDR, network.Gateway.String(), network.VRF, nil, "tokyo-prod", "Production servers", 120, "tokyo", `{"env":"prod"}`, "").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
 		mock.ExpectCommit()
 
-		err := repo.UpdateIPHostname(1, "new-host")
-		if err != nil {
+		if err := repo.CreateNetwork(network); err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
 	})
 
-	t.Run("Hostname already in use", func(t *testing.T) {
+	t.Run("Database error when creating network", func(t *testing.T) {
+		network := &domain.Network{
+			CIDR:    "192.168.1.0/24",
+			Gateway: net.ParseIP("192.168.1.1"),
+		}
+
 		mock.ExpectBegin()
-		mock.ExpectQuery("SELECT network_id FROM ip_addresses").
-			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"network_id"}).AddRow(1))
-		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
-			WithArgs(1, "new-host", 1).
-			WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("new-host"))
+		mock.ExpectQuery("INSERT INTO networks").
+			WithArgs(network.CIDR, network.Gateway.String(), network.VRF, nil, "", "", nil, "", "{}", "").
+			WillReturnError(fmt.Errorf("database error"))
 		mock.ExpectRollback()
 
-		err := repo.UpdateIPHostname(1, "new-host")
+		err := repo.CreateNetwork(network)
 		if err == nil {
 			t.Error("expected an error, got nil")
 		}
 	})
 
-	t.Run("IP address not found", func(t *testing.T) {
+	t.Run("Overlapping network", func(t *testing.T) {
+		network := &domain.Network{
+			CIDR:    "192.168.1.0/25",
+			Gateway: net.ParseIP("192.168.1.1"),
+		}
+
 		mock.ExpectBegin()
-		mock.ExpectQuery("SELECT network_id FROM ip_addresses").
-			WithArgs(1).
-			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("INSERT INTO networks").
+			WithArgs(network.CIDR, network.Gateway.String(), network.VRF, nil, "", "", nil, "", "{}", "").
+			WillReturnError(&pq.Error{Code: exclusionViolation, Constraint: "networks_no_overlap"})
 		mock.ExpectRollback()
 
-		err := repo.UpdateIPHostname(1, "new-host")
-		if err == nil {
-			t.Error("expected an error, got nil")
+		if err := repo.CreateNetwork(network); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+}
+
+func TestAllocateChildNetwork(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+	columns := []string{"id", "cidr", "gateway", "vrf", "parent_id", "name", "description", "vlan_id", "site", "tags", "allocation_strategy"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM networks WHERE id = \$1 FOR UPDATE`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, "10.0.0.0/22", "10.0.0.1", "", nil, "", "", nil, "", []byte(`{}`), ""))
+	// 10.0.0.0/24 was created inside the parent without naming it as its
+	// parent; it is still taken.
+	mock.ExpectQuery(`FROM networks WHERE vrf = \$1 AND cidr << \$2::inet`).
+		WithArgs("", "10.0.0.0/22").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(2, "10.0.0.0/24", "10.0.0.1", "", nil, "", "", nil, "", []byte(`{}`), ""))
+	mock.ExpectQuery("INSERT INTO networks").
+		WithArgs("10.0.1.0/24", "10.0.1.1", "", sql.NullInt64{Int64: 1, Valid: true}, "", "", nil, "", "{}", "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+
+	child, err := repo.AllocateChildNetwork(1, 24)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if child.ID != 3 || child.CIDR != "10.0.1.0/24" {
+		t.Errorf("expected network 3 with 10.0.1.0/24, got %d with %s", child.ID, child.CIDR)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListNetworks(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+	columns := []string{"id", "cidr", "gateway", "vrf", "parent_id", "name", "description", "vlan_id", "site", "tags", "allocation_strategy"}
+
+	mock.ExpectQuery(`FROM networks WHERE site = \$1 AND tags @> \$2 ORDER BY id`).
+		WithArgs("tokyo", `{"env":"prod"}`).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, "10.20.30.0/24", "10.20.30.1", "", nil, "tokyo-prod", "", 120, "tokyo", []byte(`{"env":"prod","team":"web"}`), ""))
+	mock.ExpectQuery("FROM network_reserved_ranges WHERE network_id = ANY\\(\\$1\\)").
+		WithArgs(pq.Array([]int64{1})).
+		WillReturnRows(sqlmock.NewRows([]string{"network_id", "host", "host"}))
+
+	networks, _, err := repo.ListNetworks(&domain.NetworkFilter{Site: "tokyo", Tags: map[string]string{"env": "prod"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(networks) != 1 {
+		t.Fatalf("expected 1 network, got %d", len(networks))
+	}
+	network := networks[0]
+	if network.Name != "tokyo-prod" || network.VLAN != 120 || network.Site != "tokyo" || network.Tags["team"] != "web" {
+		t.Errorf("unexpected network %+v", network)
+	}
+	if network.ParentID != nil {
+		t.Errorf("expected no parent, got %d", *network.ParentID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListIPs(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+	columns := []string{"id", "network_id", "address", "hostname", "status", "mac", "description", "owner", "tags", "created_at", "updated_at", "released_at", "lease_expires_at", "idempotency_key"}
+	now := time.Now()
+	page := &domain.Page{Sort: domain.SortByHostname, Limit: 2}
+	page.Cursor = page.NextIPCursor(&domain.IPAddress{ID: 4, Hostname: "web-a"})
+
+	mock.ExpectQuery(`FROM ip_addresses WHERE network_id = \$1 AND status = \$2 AND hostname LIKE \$3 AND \(COALESCE\(hostname, ''\) COLLATE "C", id\) > \(\$5::text, \$4\) ORDER BY COALESCE\(hostname, ''\) COLLATE "C" ASC, id ASC LIMIT \$6`).
+		WithArgs(1, domain.StatusAllocated, `web\_%`, 4, "web-a", 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(7, 1, "192.168.1.7/32", "web_b", "allocated", nil, "", "", []byte(`{}`), now, now, nil, nil, "").
+			AddRow(5, 1, "192.168.1.5/32", "web_c", "allocated", nil, "", "", []byte(`{}`), now, now, nil, nil, "").
+			AddRow(9, 1, "192.168.1.9/32", "web_d", "allocated", nil, "", "", []byte(`{}`), now, now, nil, nil, ""))
+
+	ips, next, err := repo.ListIPs(1, &domain.IPFilter{Status: domain.StatusAllocated, HostnamePrefix: "web_"}, page)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 2 || ips[0].Hostname != "web_b" || ips[1].Hostname != "web_c" {
+		t.Fatalf("expected web_b and web_c, got %d addresses", len(ips))
+	}
+	if want := page.NextIPCursor(ips[1]); next != want {
+		t.Errorf("expected next cursor %q, got %q", want, next)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+	ipColumns := []string{"id", "network_id", "address", "hostname", "status", "mac", "description", "owner", "tags", "created_at", "updated_at", "released_at", "lease_expires_at", "idempotency_key"}
+	networkColumns := []string{"id", "cidr", "gateway", "vrf", "parent_id", "name", "description", "vlan_id", "site", "tags", "allocation_strategy"}
+	now := time.Now()
+
+	t.Run("By IP", func(t *testing.T) {
+		mock.ExpectQuery(`FROM ip_addresses\s+WHERE address = \$1::inet AND status NOT IN \('available', 'quarantined'\)\s+ORDER BY address, id LIMIT \$2`).
+			WithArgs("10.4.7.22", 3).
+			WillReturnRows(sqlmock.NewRows(ipColumns).
+				AddRow(7, 2, "10.4.7.22/32", "web-1", "allocated", nil, "", "", []byte(`{}`), now, now, nil, nil, "").
+				AddRow(9, 3, "10.4.7.22/32", "web-2", "allocated", nil, "", "", []byte(`{}`), now, now, nil, nil, ""))
+		mock.ExpectQuery(`SELECT DISTINCT ON \(vrf\) .* FROM networks\s+WHERE cidr >>= \$1::inet\s+ORDER BY vrf, masklen\(cidr\) DESC\s+\) AS containing\s+ORDER BY id`).
+			WithArgs("10.4.7.22/32").
+			WillReturnRows(sqlmock.NewRows(networkColumns).
+				AddRow(2, "10.4.7.0/24", "10.4.7.1", "", 1, "", "", nil, "", []byte(`{}`), "").
+				AddRow(3, "10.4.0.0/16", "10.4.0.1", "customer-a", nil, "", "", nil, "", []byte(`{}`), ""))
+		mock.ExpectQuery("FROM network_reserved_ranges WHERE network_id = ANY\\(\\$1\\)").
+			WithArgs(pq.Array([]int64{2, 3})).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "host", "host"}))
+
+		result, err := repo.Search(&domain.SearchQuery{IP: net.ParseIP("10.4.7.22"), Limit: 2})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result.Addresses) != 2 || result.Truncated {
+			t.Errorf("expected 2 addresses without truncation, got %d, truncated %v", len(result.Addresses), result.Truncated)
+		}
+		if len(result.Networks) != 2 || result.Networks[1].VRF != "customer-a" {
+			t.Errorf("expected the containing network of each VRF, got %+v", result.Networks)
+		}
+	})
+
+	t.Run("By hostname wildcard", func(t *testing.T) {
+		mock.ExpectQuery(`FROM ip_addresses\s+WHERE hostname LIKE \$1 AND status NOT IN \('available', 'quarantined'\)\s+ORDER BY address, id LIMIT \$2`).
+			WithArgs(`web\_%`, 2).
+			WillReturnRows(sqlmock.NewRows(ipColumns).
+				AddRow(4, 5, "10.0.0.4/32", "web_a", "allocated", nil, "", "", []byte(`{}`), now, now, nil, nil, "").
+				AddRow(6, 5, "10.0.0.6/32", "web_b", "allocated", nil, "", "", []byte(`{}`), now, now, nil, nil, ""))
+		mock.ExpectQuery(`FROM networks WHERE id = ANY\(\$1\) ORDER BY id`).
+			WithArgs(pq.Array([]int64{5})).
+			WillReturnRows(sqlmock.NewRows(networkColumns).
+				AddRow(5, "10.0.0.0/24", "10.0.0.1", "", nil, "", "", nil, "", []byte(`{}`), ""))
+		mock.ExpectQuery("FROM network_reserved_ranges WHERE network_id = ANY\\(\\$1\\)").
+			WithArgs(pq.Array([]int64{5})).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "host", "host"}))
+
+		result, err := repo.Search(&domain.SearchQuery{Hostname: "web_*", Limit: 1})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result.Addresses) != 1 || !result.Truncated {
+			t.Errorf("expected 1 address with truncation, got %d, truncated %v", len(result.Addresses), result.Truncated)
+		}
+		if len(result.Networks) != 1 || result.Networks[0].ID != 5 {
+			t.Errorf("expected network 5, got %+v", result.Networks)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUtilization(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB), WithQuarantine(time.Hour))
+	columns := []string{"id", "cidr", "gateway", "vrf", "parent_id", "name", "description", "vlan_id", "site", "tags", "allocation_strategy"}
+
+	t.Run("Count addresses by use", func(t *testing.T) {
+		mock.ExpectQuery("FROM networks WHERE id = \\$1").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "192.168.1.0/24", "192.168.1.1", "", nil, "", "", nil, "", []byte(`{}`), ""))
+		mock.ExpectQuery("FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "host", "host"}).AddRow(1, "192.168.1.2", "192.168.1.10"))
+		mock.ExpectQuery("FROM ip_addresses a .* AND a.network_id = \\$2 GROUP BY a.network_id").
+			WithArgs(3600.0, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "allocated", "held", "in_reserved"}).AddRow(1, 2, 1, 1))
+
+		u, err := repo.GetUtilization(1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if u.Total.Int64() != 253 || u.Allocated.Int64() != 2 || u.Reserved.Int64() != 9 || u.Free.Int64() != 242 {
+			t.Errorf("expected total 253, allocated 2, reserved 9, free 242, got %s, %s, %s, %s", u.Total, u.Allocated, u.Reserved, u.Free)
+		}
+	})
+
+	t.Run("Network not found", func(t *testing.T) {
+		mock.ExpectQuery("FROM networks WHERE id = \\$1").
+			WithArgs(2).
+			WillReturnError(sql.ErrNoRows)
+
+		if _, err := repo.GetUtilization(2); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateIP(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	ip := &domain.IPAddress{ID: 1, Hostname: "new-host", MAC: mac, Owner: "infra", Tags: map[string]string{"env": "prod"}}
+
+	t.Run("Update IP address successfully", func(t *testing.T) {
+		updatedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT network_id, status FROM ip_addresses WHERE id = \\$1 FOR UPDATE").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "status"}).AddRow(1, "allocated"))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "new-host", 1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("UPDATE ip_addresses").
+			WithArgs(1, "new-host", "52:54:00:12:34:56", "", "infra", `{"env":"prod"}`).
+			WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(updatedAt))
+		mock.ExpectCommit()
+
+		if err := repo.UpdateIP(ip); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if !ip.UpdatedAt.Equal(updatedAt) {
+			t.Errorf("expected updated_at %v, got %v", updatedAt, ip.UpdatedAt)
+		}
+	})
+
+	t.Run("Hostname already in use", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT network_id, status FROM ip_addresses WHERE id = \\$1 FOR UPDATE").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "status"}).AddRow(1, "allocated"))
+		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+			WithArgs(1, "new-host", 1).
+			WillReturnRows(sqlmock.NewRows([]string{"hostname"}).AddRow("new-host"))
+		mock.ExpectRollback()
+
+		if err := repo.UpdateIP(ip); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("IP address not found", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT network_id, status FROM ip_addresses").
+			WithArgs(1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		if err := repo.UpdateIP(ip); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Released address", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT network_id, status FROM ip_addresses").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "status"}).AddRow(1, "quarantined"))
+		mock.ExpectRollback()
+
+		if err := repo.UpdateIP(ip); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
 		}
 	})
 
 	t.Run("Database error when updating", func(t *testing.T) {
 		mock.ExpectBegin()
-		mock.ExpectQuery("SELECT network_id FROM ip_addresses").
+		mock.ExpectQuery("SELECT network_id, status FROM ip_addresses WHERE id = \\$1 FOR UPDATE").
 			WithArgs(1).
-			WillReturnRows(sqlmock.NewRows([]string{"network_id"}).AddRow(1))
+			WillReturnRows(sqlmock.NewRows([]string{"network_id", "status"}).AddRow(1, "allocated"))
 		mock.ExpectQuery("SELECT hostname FROM ip_addresses").
 			WithArgs(1, "new-host", 1).
 			WillReturnError(sql.ErrNoRows)
-		mock.ExpectExec("UPDATE ip_addresses").
-			WithArgs("new-host", 1).
+		mock.ExpectQuery("UPDATE ip_addresses").
+			WithArgs(1, "new-host", "52:54:00:12:34:56", "", "infra", `{"env":"prod"}`).
 			WillReturnError(fmt.Errorf("database error"))
 		mock.ExpectRollback()
 
-		err := repo.UpdateIPHostname(1, "new-host")
-		if err == nil {
+		if err := repo.UpdateIP(ip); err == nil {
 			t.Error("expected an error, got nil")
 		}
 	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReleaseIP(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+
+	t.Run("Release IP successfully", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT status FROM ip_addresses WHERE id = \$1 FOR UPDATE`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("allocated"))
+		mock.ExpectExec(`UPDATE ip_addresses SET status = \$2, hostname = NULL, mac = NULL`).
+			WithArgs(1, "available").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := repo.ReleaseIP(1); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("IP address not found", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT status FROM ip_addresses`).
+			WithArgs(1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		if err := repo.ReleaseIP(1); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Already released", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT status FROM ip_addresses`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("available"))
+		mock.ExpectRollback()
+
+		if err := repo.ReleaseIP(1); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Release into quarantine", func(t *testing.T) {
+		repo := NewIPAMRepository(db.NewDB(mockDB), WithQuarantine(time.Hour))
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT status FROM ip_addresses`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+		mock.ExpectExec("UPDATE ip_addresses").
+			WithArgs(1, "quarantined").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := repo.ReleaseIP(1); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateIPStatus(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+
+	t.Run("Deprecate allocated address", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT status FROM ip_addresses").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("allocated"))
+		mock.ExpectExec("UPDATE ip_addresses SET status").
+			WithArgs(1, "deprecated").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := repo.UpdateIPStatus(1, domain.StatusAllocated, domain.StatusDeprecated); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Status changed concurrently", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT status FROM ip_addresses").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("quarantined"))
+		mock.ExpectRollback()
+
+		if err := repo.UpdateIPStatus(1, domain.StatusAllocated, domain.StatusDeprecated); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("IP address not found", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT status FROM ip_addresses").
+			WithArgs(1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		if err := repo.UpdateIPStatus(1, domain.StatusAllocated, domain.StatusDeprecated); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateNetwork(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+	network := &domain.Network{
+		ID:       1,
+		CIDR:     "192.168.1.0/24",
+		Gateway:  net.ParseIP("192.168.1.254"),
+		Reserved: []domain.IPRange{{Start: net.ParseIP("192.168.1.200"), End: net.ParseIP("192.168.1.253")}},
+	}
+
+	t.Run("Update network successfully", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE networks").
+			WithArgs(1, "192.168.1.254", "", "", nil, "", "{}", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT id FROM ip_addresses").
+			WithArgs(1, "192.168.1.254").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("DELETE FROM network_reserved_ranges").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO network_reserved_ranges").
+			WithArgs(1, "192.168.1.200", "192.168.1.253").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		if err := repo.UpdateNetwork(network); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Gateway allocated to a host", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE networks").
+			WithArgs(1, "192.168.1.254", "", "", nil, "", "{}", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT id FROM ip_addresses").
+			WithArgs(1, "192.168.1.254").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+		mock.ExpectRollback()
+
+		if err := repo.UpdateNetwork(network); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Network not found", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE networks").
+			WithArgs(1, "192.168.1.254", "", "", nil, "", "{}", "").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		if err := repo.UpdateNetwork(network); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteNetwork(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB))
+
+	t.Run("Allocations exist", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id FROM networks WHERE parent_id").
+			WithArgs(1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("SELECT count\\(\\*\\) FROM ip_addresses").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectRollback()
+
+		if err := repo.DeleteNetwork(1, false); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Force delete", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM networks").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id FROM networks WHERE parent_id").
+			WithArgs(1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec("DELETE FROM networks").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := repo.DeleteNetwork(1, true); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Child networks exist", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM networks WHERE id").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id FROM networks WHERE parent_id").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+		mock.ExpectRollback()
+
+		if err := repo.DeleteNetwork(1, true); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Child created concurrently", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM networks WHERE id").
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id FROM networks WHERE parent_id").
+			WithArgs(1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("DELETE FROM ip_addresses").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM networks").
+			WithArgs(1).
+			WillReturnError(&pq.Error{Code: foreignKeyViolation})
+		mock.ExpectRollback()
+
+		if err := repo.DeleteNetwork(1, true); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Network not found", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM networks").
+			WithArgs(1).
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		if err := repo.DeleteNetwork(1, false); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAllocateIPQuarantine(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB), WithQuarantine(time.Hour))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT cidr, gateway, allocation_strategy FROM networks").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"cidr", "gateway", "allocation_strategy"}).AddRow("192.168.1.0/24", "192.168.1.1", ""))
+	mock.ExpectQuery("SELECT hostname FROM ip_addresses").
+		WithArgs(1, "test-host").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT network_id, host\\(start_address\\), host\\(end_address\\) FROM network_reserved_ranges").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"network_id", "start_address", "end_address"}))
+	mock.ExpectExec("DELETE FROM ip_addresses").
+		WithArgs(1, 3600.0).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("INSERT INTO ip_addresses").
+		WithArgs(1, pq.Array([]string{"192.168.1.2"}), pq.Array([]string{"192.168.1.254"}), "test-host", "allocated", nil, "", "", "{}", nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "address", "created_at"}).AddRow(1, "192.168.1.2/32", time.Now()))
+	mock.ExpectCommit()
+
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 1, Hostname: "test-host"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpireLeases(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mockDB.Close()
+
+	repo := NewIPAMRepository(db.NewDB(mockDB), WithQuarantine(time.Hour))
+	now := time.Now()
+	columns := []string{"id", "network_id", "address", "hostname", "status", "mac", "description", "owner", "tags", "created_at", "updated_at", "released_at", "lease_expires_at", "idempotency_key"}
+
+	mock.ExpectQuery(`UPDATE ip_addresses .* FROM \(\s*SELECT .* FOR UPDATE\s*\) AS expired .* RETURNING expired\.\*`).
+		WithArgs(now.UTC(), "quarantined").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(3, 1, "192.168.1.4/32", "ci-2", "allocated", nil, "", "ci", []byte(`{}`), now, now, nil, now.Add(-time.Minute), "").
+			AddRow(2, 1, "192.168.1.3/32", "ci-1", "allocated", nil, "", "ci", []byte(`{}`), now, now, nil, now.Add(-time.Hour), ""))
+
+	expired, err := repo.ExpireLeases(now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(expired) != 2 || expired[0].Hostname != "ci-1" || expired[1].Address.String() != "192.168.1.4" || expired[0].LeaseExpiresAt == nil {
+		t.Errorf("unexpected expired addresses %+v", expired)
+	}
+
+	t.Run("Renew released address", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT status FROM ip_addresses").
+			WithArgs(2).
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("quarantined"))
+		mock.ExpectRollback()
+
+		if err := repo.RenewLease(2, now.Add(time.Hour)); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
 }
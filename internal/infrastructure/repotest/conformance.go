@@ -0,0 +1,1552 @@
+// Package repotest provides a conformance suite that every
+// domain.IPAMRepository implementation is expected to pass.
+package repotest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+)
+
+// Factory returns an empty repository. It is called once per test case.
+type Factory func(t *testing.T) domain.IPAMRepository
+
+// Run exercises the business rules shared by all storage backends.
+func Run(t *testing.T, newRepository Factory) {
+	t.Run("NetworkRoundTrip", func(t *testing.T) { testNetworkRoundTrip(t, newRepository(t)) })
+	t.Run("NetworkParent", func(t *testing.T) { testNetworkParent(t, newRepository(t)) })
+	t.Run("NetworkMetadata", func(t *testing.T) { testNetworkMetadata(t, newRepository(t)) })
+	t.Run("NetworkFilter", func(t *testing.T) { testNetworkFilter(t, newRepository(t)) })
+	t.Run("NetworkPagination", func(t *testing.T) { testNetworkPagination(t, newRepository(t)) })
+	t.Run("UpdateNetwork", func(t *testing.T) { testUpdateNetwork(t, newRepository(t)) })
+	t.Run("DeleteNetwork", func(t *testing.T) { testDeleteNetwork(t, newRepository(t)) })
+	t.Run("DeleteNetworkWithChildren", func(t *testing.T) { testDeleteNetworkWithChildren(t, newRepository(t)) })
+	t.Run("FirstFreeAllocation", func(t *testing.T) { testFirstFreeAllocation(t, newRepository(t)) })
+	t.Run("GatewayNeverAllocated", func(t *testing.T) { testGatewayNeverAllocated(t, newRepository(t)) })
+	t.Run("NetworkAndBroadcastNeverAllocated", func(t *testing.T) { testNetworkAndBroadcastNeverAllocated(t, newRepository(t)) })
+	t.Run("PointToPointNetwork", func(t *testing.T) { testPointToPointNetwork(t, newRepository(t)) })
+	t.Run("ReservedRanges", func(t *testing.T) { testReservedRanges(t, newRepository(t)) })
+	t.Run("RequestedAddress", func(t *testing.T) { testRequestedAddress(t, newRepository(t)) })
+	t.Run("IPMetadata", func(t *testing.T) { testIPMetadata(t, newRepository(t)) })
+	t.Run("IPPagination", func(t *testing.T) { testIPPagination(t, newRepository(t)) })
+	t.Run("AddressStatus", func(t *testing.T) { testAddressStatus(t, newRepository(t)) })
+	t.Run("BulkAllocation", func(t *testing.T) { testBulkAllocation(t, newRepository(t)) })
+	t.Run("BulkAllocationContiguous", func(t *testing.T) { testBulkAllocationContiguous(t, newRepository(t)) })
+	t.Run("BulkAllocationAllOrNothing", func(t *testing.T) { testBulkAllocationAllOrNothing(t, newRepository(t)) })
+	t.Run("BulkAllocationLarge", func(t *testing.T) { testBulkAllocationLarge(t, newRepository(t)) })
+	t.Run("Leases", func(t *testing.T) { testLeases(t, newRepository(t)) })
+	t.Run("IdempotencyKey", func(t *testing.T) { testIdempotencyKey(t, newRepository(t)) })
+	t.Run("AllocationStrategies", func(t *testing.T) { testAllocationStrategies(t, newRepository(t)) })
+	t.Run("LeastRecentlyReleased", func(t *testing.T) { testLeastRecentlyReleased(t, newRepository(t)) })
+	t.Run("Utilization", func(t *testing.T) { testUtilization(t, newRepository(t)) })
+	t.Run("Search", func(t *testing.T) { testSearch(t, newRepository(t)) })
+	t.Run("ConcurrentAllocation", func(t *testing.T) { testConcurrentAllocation(t, newRepository(t)) })
+	t.Run("ConcurrentOverlappingNetworks", func(t *testing.T) { testConcurrentOverlappingNetworks(t, newRepository(t)) })
+	t.Run("ConcurrentChildNetworks", func(t *testing.T) { testConcurrentChildNetworks(t, newRepository(t)) })
+	t.Run("DuplicateHostnameRejected", func(t *testing.T) { testDuplicateHostnameRejected(t, newRepository(t)) })
+	t.Run("HostnameUniquePerNetwork", func(t *testing.T) { testHostnameUniquePerNetwork(t, newRepository(t)) })
+	t.Run("ReleasedAddressReusable", func(t *testing.T) { testReleasedAddressReusable(t, newRepository(t)) })
+	t.Run("Exhaustion", func(t *testing.T) { testExhaustion(t, newRepository(t)) })
+	t.Run("IPv6FirstFree", func(t *testing.T) { testIPv6FirstFree(t, newRepository(t)) })
+	t.Run("IPv6Sparse", func(t *testing.T) { testIPv6Sparse(t, newRepository(t)) })
+	t.Run("IPv6EUI64", func(t *testing.T) { testIPv6EUI64(t, newRepository(t)) })
+	t.Run("DualStackHost", func(t *testing.T) { testDualStackHost(t, newRepository(t)) })
+	t.Run("UnknownIP", func(t *testing.T) { testUnknownIP(t, newRepository(t)) })
+	t.Run("UnknownNetwork", func(t *testing.T) { testUnknownNetwork(t, newRepository(t)) })
+}
+
+// QuarantineFactory returns an empty repository that keeps released
+// addresses out of allocation for the given duration.
+type QuarantineFactory func(t *testing.T, quarantine time.Duration) domain.IPAMRepository
+
+// RunQuarantine checks that released addresses are held back until their
+// quarantine has passed.
+func RunQuarantine(t *testing.T, newRepository QuarantineFactory) {
+	t.Run("QuarantinedAddressNotReused", func(t *testing.T) {
+		repo := newRepository(t, time.Hour)
+		network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+		ip := allocate(t, repo, network.ID, "", "host-a")
+		if err := repo.ReleaseIP(ip.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		released, err := repo.GetIP(ip.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if released == nil || released.Status != domain.StatusQuarantined || released.Hostname != "" || released.ReleasedAt == nil {
+			t.Errorf("expected a released record, got %+v", released)
+		}
+
+		next := allocate(t, repo, network.ID, "", "host-b")
+		if next.Address.Equal(ip.Address) {
+			t.Errorf("quarantined address %s was handed out again", ip.Address)
+		}
+		if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, RequestedIP: ip.Address, Hostname: "host-c"}); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("expected ErrConflict when requesting a quarantined address, got %v", err)
+		}
+	})
+
+	t.Run("ExpiredQuarantineReused", func(t *testing.T) {
+		repo := newRepository(t, 10*time.Millisecond)
+		network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+		ip := allocate(t, repo, network.ID, "", "host-a")
+		if err := repo.ReleaseIP(ip.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		again := allocate(t, repo, network.ID, "", "host-b")
+		if !again.Address.Equal(ip.Address) {
+			t.Errorf("expected address %s to be reused after quarantine, got %s", ip.Address, again.Address)
+		}
+	})
+
+	t.Run("QuarantinedAddressNotFree", func(t *testing.T) {
+		repo := newRepository(t, time.Hour)
+		network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+		ip := allocate(t, repo, network.ID, "", "host-a")
+		if err := repo.ReleaseIP(ip.ID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		u, err := repo.GetUtilization(network.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if u.Allocated.Int64() != 0 || u.Reserved.Int64() != 1 || u.Free.Int64() != 252 {
+			t.Errorf("expected the quarantined address to count as reserved, got allocated %s, reserved %s, free %s", u.Allocated, u.Reserved, u.Free)
+		}
+	})
+}
+
+func createNetwork(t *testing.T, repo domain.IPAMRepository, cidr, gateway string) *domain.Network {
+	t.Helper()
+	network := &domain.Network{CIDR: cidr, Gateway: net.ParseIP(gateway)}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("failed to create network %s: %v", cidr, err)
+	}
+	return network
+}
+
+func allocate(t *testing.T, repo domain.IPAMRepository, networkID int, requestedIP, hostname string) *domain.IPAddress {
+	t.Helper()
+	var requested net.IP
+	if requestedIP != "" {
+		requested = net.ParseIP(requestedIP)
+	}
+	ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: networkID, RequestedIP: requested, Hostname: hostname})
+	if err != nil {
+		t.Fatalf("failed to allocate %q for %s: %v", requestedIP, hostname, err)
+	}
+	return ip
+}
+
+func testNetworkRoundTrip(t *testing.T, repo domain.IPAMRepository) {
+	first := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	second := createNetwork(t, repo, "192.168.2.0/24", "192.168.2.1")
+	if first.ID == 0 || first.ID == second.ID {
+		t.Fatalf("expected distinct non-zero network IDs, got %d and %d", first.ID, second.ID)
+	}
+
+	network, err := repo.GetNetwork(second.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if network == nil || network.CIDR != "192.168.2.0/24" || !network.Gateway.Equal(net.ParseIP("192.168.2.1")) {
+		t.Errorf("unexpected network %+v", network)
+	}
+
+	vrf := &domain.Network{CIDR: "192.168.1.0/24", Gateway: net.ParseIP("192.168.1.1"), VRF: "blue"}
+	if err := repo.CreateNetwork(vrf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	network, err = repo.GetNetwork(vrf.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if network.VRF != "blue" {
+		t.Errorf("expected VRF blue, got %q", network.VRF)
+	}
+
+	networks, _, err := repo.ListNetworks(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(networks) != 3 {
+		t.Errorf("expected 3 networks, got %d", len(networks))
+	}
+}
+
+func testNetworkParent(t *testing.T, repo domain.IPAMRepository) {
+	parent := createNetwork(t, repo, "10.0.0.0/16", "10.0.0.1")
+	child := &domain.Network{CIDR: "10.0.1.0/24", Gateway: net.ParseIP("10.0.1.1"), ParentID: &parent.ID}
+	if err := repo.CreateNetwork(child); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, err := repo.GetNetwork(child.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.ParentID == nil || *stored.ParentID != parent.ID {
+		t.Errorf("expected parent %d, got %v", parent.ID, stored.ParentID)
+	}
+
+	stored, err = repo.GetNetwork(parent.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.ParentID != nil {
+		t.Errorf("expected no parent, got %d", *stored.ParentID)
+	}
+}
+
+func testNetworkMetadata(t *testing.T, repo domain.IPAMRepository) {
+	network := &domain.Network{
+		CIDR:        "10.20.30.0/24",
+		Gateway:     net.ParseIP("10.20.30.1"),
+		Name:        "tokyo-prod",
+		Description: "Production servers",
+		VLAN:        120,
+		Site:        "tokyo",
+		Tags:        map[string]string{"env": "prod", "team": "web"},
+	}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, err := repo.GetNetwork(network.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.Name != "tokyo-prod" || stored.Description != "Production servers" || stored.VLAN != 120 || stored.Site != "tokyo" {
+		t.Errorf("expected metadata of %+v, got %+v", network, stored)
+	}
+	if len(stored.Tags) != 2 || stored.Tags["env"] != "prod" || stored.Tags["team"] != "web" {
+		t.Errorf("expected tags %v, got %v", network.Tags, stored.Tags)
+	}
+
+	stored.Name = "tokyo-staging"
+	stored.VLAN = 0
+	stored.Tags = map[string]string{"env": "staging"}
+	if err := repo.UpdateNetwork(stored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := repo.GetNetwork(network.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.Name != "tokyo-staging" || updated.VLAN != 0 || updated.Site != "tokyo" || len(updated.Tags) != 1 || updated.Tags["env"] != "staging" {
+		t.Errorf("expected updated metadata, got %+v", updated)
+	}
+}
+
+func testNetworkFilter(t *testing.T, repo domain.IPAMRepository) {
+	for _, network := range []*domain.Network{
+		{CIDR: "10.0.1.0/24", Gateway: net.ParseIP("10.0.1.1"), Site: "tokyo", VLAN: 10, Tags: map[string]string{"env": "prod"}},
+		{CIDR: "10.0.2.0/24", Gateway: net.ParseIP("10.0.2.1"), Site: "tokyo", VLAN: 20, Tags: map[string]string{"env": "dev"}},
+		{CIDR: "10.0.3.0/24", Gateway: net.ParseIP("10.0.3.1"), Site: "osaka", VLAN: 10, Tags: map[string]string{"env": "prod", "team": "db"}},
+		{CIDR: "10.0.4.0/24", Gateway: net.ParseIP("10.0.4.1")},
+	} {
+		if err := repo.CreateNetwork(network); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter *domain.NetworkFilter
+		want   []string
+	}{
+		{"No filter", nil, []string{"10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24", "10.0.4.0/24"}},
+		{"Site", &domain.NetworkFilter{Site: "tokyo"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{"VLAN", &domain.NetworkFilter{VLAN: 10}, []string{"10.0.1.0/24", "10.0.3.0/24"}},
+		{"Tag", &domain.NetworkFilter{Tags: map[string]string{"env": "prod"}}, []string{"10.0.1.0/24", "10.0.3.0/24"}},
+		{"All tags", &domain.NetworkFilter{Tags: map[string]string{"env": "prod", "team": "db"}}, []string{"10.0.3.0/24"}},
+		{"Site and tag", &domain.NetworkFilter{Site: "tokyo", Tags: map[string]string{"env": "prod"}}, []string{"10.0.1.0/24"}},
+		{"No match", &domain.NetworkFilter{Site: "nagoya"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, _, err := repo.ListNetworks(tt.filter, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, network := range networks {
+				got = append(got, network.CIDR)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func testNetworkPagination(t *testing.T, repo domain.IPAMRepository) {
+	for _, cidr := range []string{"10.0.2.0/24", "2001:db8::/64", "10.0.0.0/16", "10.0.1.0/24", "10.0.0.0/24"} {
+		gateway := domain.NextIP(net.ParseIP(strings.Split(cidr, "/")[0]))
+		if err := repo.CreateNetwork(&domain.Network{CIDR: cidr, Gateway: gateway, VRF: cidr}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		page domain.Page
+		want []string
+	}{
+		{"By ID", domain.Page{Sort: domain.SortByID, Limit: 2}, []string{"10.0.2.0/24", "2001:db8::/64", "10.0.0.0/16", "10.0.1.0/24", "10.0.0.0/24"}},
+		{"By CIDR", domain.Page{Sort: domain.SortByCIDR, Limit: 2}, []string{"10.0.0.0/16", "10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "2001:db8::/64"}},
+		{"By CIDR descending", domain.Page{Sort: domain.SortByCIDR, Descending: true, Limit: 3}, []string{"2001:db8::/64", "10.0.2.0/24", "10.0.1.0/24", "10.0.0.0/24", "10.0.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			page := tt.page
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatalf("expected the listing to end, got %v so far", got)
+				}
+				networks, next, err := repo.ListNetworks(nil, &page)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(networks) > page.Limit {
+					t.Fatalf("expected at most %d networks, got %d", page.Limit, len(networks))
+				}
+				for _, network := range networks {
+					got = append(got, network.CIDR)
+				}
+				if next == "" {
+					break
+				}
+				page.Cursor = next
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func testUpdateNetwork(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	ip := allocate(t, repo, network.ID, "", "host-a")
+
+	network.Gateway = ip.Address
+	if err := repo.UpdateNetwork(network); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict when moving the gateway onto an allocated address, got %v", err)
+	}
+
+	network.Gateway = net.ParseIP("192.168.1.254")
+	network.Reserved = []domain.IPRange{{Start: net.ParseIP("192.168.1.200"), End: net.ParseIP("192.168.1.253")}}
+	if err := repo.UpdateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, err := repo.GetNetwork(network.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stored.Gateway.Equal(network.Gateway) || len(stored.Reserved) != 1 || stored.CIDR != network.CIDR {
+		t.Errorf("expected updated network %+v, got %+v", network, stored)
+	}
+
+	// The previous gateway is now free for hosts.
+	allocate(t, repo, network.ID, "192.168.1.1", "host-b")
+
+	if err := repo.UpdateNetwork(&domain.Network{ID: 4242, Gateway: net.ParseIP("10.0.0.1")}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating an unknown network, got %v", err)
+	}
+}
+
+func testDeleteNetwork(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	ip := allocate(t, repo, network.ID, "", "host-a")
+	released := allocate(t, repo, network.ID, "", "host-b")
+	if err := repo.ReleaseIP(released.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := repo.DeleteNetwork(network.ID, false); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict deleting a network with allocations, got %v", err)
+	}
+	if err := repo.DeleteNetwork(network.ID, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := repo.GetNetwork(network.ID); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for the deleted network, got %v", err)
+	}
+	for _, id := range []int{ip.ID, released.ID} {
+		if _, err := repo.GetIP(id); !errors.Is(err, domain.ErrNotFound) {
+			t.Errorf("expected ErrNotFound for IP address %d of the deleted network, got %v", id, err)
+		}
+	}
+
+	empty := createNetwork(t, repo, "192.168.2.0/24", "192.168.2.1")
+	if err := repo.DeleteNetwork(empty.ID, false); err != nil {
+		t.Errorf("unexpected error deleting an empty network: %v", err)
+	}
+	if err := repo.DeleteNetwork(4242, true); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound deleting an unknown network, got %v", err)
+	}
+}
+
+func testDeleteNetworkWithChildren(t *testing.T, repo domain.IPAMRepository) {
+	parent := createNetwork(t, repo, "10.7.0.0/16", "10.7.0.1")
+	child := &domain.Network{CIDR: "10.7.1.0/24", Gateway: net.ParseIP("10.7.1.1"), ParentID: &parent.ID}
+	if err := repo.CreateNetwork(child); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.DeleteNetwork(parent.ID, true); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict for a network with children, got %v", err)
+	}
+	if err := repo.DeleteNetwork(child.ID, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.DeleteNetwork(parent.ID, false); err != nil {
+		t.Errorf("unexpected error once the child is gone: %v", err)
+	}
+
+	// A child created while its parent is deleted must never outlive it.
+	for i := 0; i < 8; i++ {
+		parent := createNetwork(t, repo, "10.7.0.0/16", "10.7.0.1")
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			child := &domain.Network{CIDR: "10.7.1.0/24", Gateway: net.ParseIP("10.7.1.1"), ParentID: &parent.ID}
+			if err := repo.CreateNetwork(child); err != nil && !errors.Is(err, domain.ErrConflict) {
+				t.Errorf("unexpected error creating the child: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := repo.DeleteNetwork(parent.ID, false); err != nil && !errors.Is(err, domain.ErrConflict) {
+				t.Errorf("unexpected error deleting the parent: %v", err)
+			}
+		}()
+		wg.Wait()
+
+		networks, _, err := repo.ListNetworks(nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids := make(map[int]bool)
+		for _, network := range networks {
+			ids[network.ID] = true
+		}
+		for _, network := range networks {
+			if network.ParentID != nil && !ids[*network.ParentID] {
+				t.Fatalf("network %d outlived its parent %d", network.ID, *network.ParentID)
+			}
+		}
+		for _, network := range networks {
+			if network.ParentID != nil {
+				if err := repo.DeleteNetwork(network.ID, true); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+		}
+		for _, network := range networks {
+			if network.ParentID == nil {
+				if err := repo.DeleteNetwork(network.ID, true); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func testFirstFreeAllocation(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+
+	for _, want := range []string{"192.168.1.2", "192.168.1.3", "192.168.1.4"} {
+		ip := allocate(t, repo, network.ID, "", "host-"+want)
+		if ip.Address.String() != want {
+			t.Errorf("expected IP %s, got %s", want, ip.Address)
+		}
+		if ip.NetworkID != network.ID || ip.Status != domain.StatusAllocated {
+			t.Errorf("unexpected allocation %+v", ip)
+		}
+	}
+
+	ips, _, err := repo.ListIPs(network.ID, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 3 {
+		t.Errorf("expected 3 IP addresses, got %d", len(ips))
+	}
+}
+
+func testGatewayNeverAllocated(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "10.0.0.0/29", "10.0.0.3")
+
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, RequestedIP: net.ParseIP("10.0.0.3"), Hostname: "gw"}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid when requesting the gateway, got %v", err)
+	}
+
+	for i := 0; i < 8; i++ {
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: fmt.Sprintf("host-%d", i)})
+		if err != nil {
+			break
+		}
+		if ip.Address.Equal(network.Gateway) {
+			t.Fatalf("gateway %s was handed out", network.Gateway)
+		}
+	}
+}
+
+func testNetworkAndBroadcastNeverAllocated(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "10.0.0.0/30", "10.0.0.1")
+
+	for _, address := range []string{"10.0.0.0", "10.0.0.3", "10.0.1.2", "2001:db8::2"} {
+		req := &domain.AllocationRequest{NetworkID: network.ID, RequestedIP: net.ParseIP(address), Hostname: "host-a"}
+		if _, err := repo.AllocateIP(req); !errors.Is(err, domain.ErrInvalid) {
+			t.Errorf("expected ErrInvalid when requesting %s, got %v", address, err)
+		}
+	}
+
+	ip := allocate(t, repo, network.ID, "", "host-a")
+	if ip.Address.String() != "10.0.0.2" {
+		t.Errorf("expected IP 10.0.0.2, got %s", ip.Address)
+	}
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-b"}); !errors.Is(err, domain.ErrExhausted) {
+		t.Errorf("expected ErrExhausted, got %v", err)
+	}
+}
+
+func testPointToPointNetwork(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "10.0.0.4/31", "10.0.0.4")
+
+	ip := allocate(t, repo, network.ID, "", "host-a")
+	if ip.Address.String() != "10.0.0.5" {
+		t.Errorf("expected IP 10.0.0.5, got %s", ip.Address)
+	}
+}
+
+func testReservedRanges(t *testing.T, repo domain.IPAMRepository) {
+	network := &domain.Network{
+		CIDR:     "192.168.1.0/24",
+		Gateway:  net.ParseIP("192.168.1.1"),
+		Reserved: []domain.IPRange{{Start: net.ParseIP("192.168.1.2"), End: net.ParseIP("192.168.1.10")}},
+	}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, err := repo.GetNetwork(network.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stored.Reserved) != 1 || !stored.Reserved[0].Start.Equal(net.ParseIP("192.168.1.2")) || !stored.Reserved[0].End.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("expected reserved range 192.168.1.2-192.168.1.10, got %+v", stored.Reserved)
+	}
+
+	ip := allocate(t, repo, network.ID, "", "host-a")
+	if ip.Address.String() != "192.168.1.11" {
+		t.Errorf("expected IP 192.168.1.11, got %s", ip.Address)
+	}
+
+	// Reserved addresses can still be assigned on request.
+	allocate(t, repo, network.ID, "192.168.1.5", "router")
+}
+
+func testRequestedAddress(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+
+	ip := allocate(t, repo, network.ID, "192.168.1.10", "host-a")
+	if ip.Address.String() != "192.168.1.10" {
+		t.Errorf("expected IP 192.168.1.10, got %s", ip.Address)
+	}
+
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, RequestedIP: net.ParseIP("192.168.1.10"), Hostname: "host-b"}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict when requesting an allocated address, got %v", err)
+	}
+
+	stored, err := repo.GetIP(ip.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored == nil || !stored.Address.Equal(ip.Address) || stored.Hostname != "host-a" {
+		t.Errorf("expected stored allocation %+v, got %+v", ip, stored)
+	}
+}
+
+func testIPMetadata(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	before := time.Now().Add(-time.Second)
+	ip, err := repo.AllocateIP(&domain.AllocationRequest{
+		NetworkID:   network.ID,
+		Hostname:    "host-a",
+		MAC:         mac,
+		Description: "Build server",
+		Owner:       "infra",
+		Tags:        map[string]string{"env": "prod"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, err := repo.GetIP(ip.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.MAC.String() != mac.String() || stored.Description != "Build server" || stored.Owner != "infra" || stored.Tags["env"] != "prod" {
+		t.Errorf("expected metadata of %+v, got %+v", ip, stored)
+	}
+	if stored.CreatedAt.Before(before) || !stored.UpdatedAt.Equal(stored.CreatedAt) || !ip.CreatedAt.Equal(stored.CreatedAt) {
+		t.Errorf("expected matching creation timestamps, got created %v, updated %v, returned %v", stored.CreatedAt, stored.UpdatedAt, ip.CreatedAt)
+	}
+
+	stored.Owner = "web"
+	stored.MAC = nil
+	stored.Tags = map[string]string{"env": "staging", "rack": "a1"}
+	if err := repo.UpdateIP(stored); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := repo.GetIP(ip.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.Owner != "web" || updated.MAC != nil || updated.Description != "Build server" || len(updated.Tags) != 2 || updated.Hostname != "host-a" {
+		t.Errorf("expected updated metadata, got %+v", updated)
+	}
+	if updated.UpdatedAt.Before(updated.CreatedAt) || !updated.CreatedAt.Equal(stored.CreatedAt) {
+		t.Errorf("expected updated_at after created_at %v, got %v", updated.CreatedAt, updated.UpdatedAt)
+	}
+
+	if err := repo.ReleaseIP(ip.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	released, err := repo.GetIP(ip.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if released.Owner != "" || released.Description != "" || released.Tags != nil || released.ReleasedAt == nil {
+		t.Errorf("expected released address without metadata, got %+v", released)
+	}
+	released.Owner = "web"
+	if err := repo.UpdateIP(released); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict updating a released address, got %v", err)
+	}
+}
+
+func testIPPagination(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	for _, host := range []struct {
+		address, hostname, role string
+	}{
+		{"192.168.1.10", "web-b", "web"},
+		{"192.168.1.2", "db-a", "db"},
+		{"192.168.1.100", "web-a", "web"},
+		{"192.168.1.20", "web_c", "web"},
+		{"192.168.1.3", "", ""},
+	} {
+		status := domain.StatusAllocated
+		if host.hostname == "" {
+			status = domain.StatusReserved
+		}
+		var tags map[string]string
+		if host.role != "" {
+			tags = map[string]string{"role": host.role}
+		}
+		_, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, RequestedIP: net.ParseIP(host.address), Hostname: host.hostname, Tags: tags, Status: status})
+		if err != nil {
+			t.Fatalf("failed to allocate %s: %v", host.address, err)
+		}
+	}
+	other := createNetwork(t, repo, "192.168.2.0/24", "192.168.2.1")
+	allocate(t, repo, other.ID, "", "web-z")
+
+	tests := []struct {
+		name   string
+		filter *domain.IPFilter
+		page   domain.Page
+		want   []string
+	}{
+		{"By address", nil, domain.Page{Sort: domain.SortByAddress, Limit: 2}, []string{"192.168.1.2", "192.168.1.3", "192.168.1.10", "192.168.1.20", "192.168.1.100"}},
+		{"By address descending", nil, domain.Page{Sort: domain.SortByAddress, Descending: true, Limit: 2}, []string{"192.168.1.100", "192.168.1.20", "192.168.1.10", "192.168.1.3", "192.168.1.2"}},
+		{"By hostname", nil, domain.Page{Sort: domain.SortByHostname, Limit: 3}, []string{"192.168.1.3", "192.168.1.2", "192.168.1.100", "192.168.1.10", "192.168.1.20"}},
+		{"By creation, newest first", nil, domain.Page{Sort: domain.SortByCreatedAt, Descending: true, Limit: 2}, []string{"192.168.1.3", "192.168.1.20", "192.168.1.100", "192.168.1.2", "192.168.1.10"}},
+		{"Status", &domain.IPFilter{Status: domain.StatusReserved}, domain.Page{Sort: domain.SortByAddress, Limit: 2}, []string{"192.168.1.3"}},
+		{"Hostname prefix", &domain.IPFilter{HostnamePrefix: "web-"}, domain.Page{Sort: domain.SortByHostname, Limit: 1}, []string{"192.168.1.100", "192.168.1.10"}},
+		{"Hostname prefix with wildcard", &domain.IPFilter{HostnamePrefix: "web_"}, domain.Page{Sort: domain.SortByHostname, Limit: 1}, []string{"192.168.1.20"}},
+		{"Tag", &domain.IPFilter{Tags: map[string]string{"role": "web"}}, domain.Page{Sort: domain.SortByID, Limit: 2}, []string{"192.168.1.10", "192.168.1.100", "192.168.1.20"}},
+		{"No match", &domain.IPFilter{HostnamePrefix: "mail"}, domain.Page{Sort: domain.SortByAddress, Limit: 2}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			page := tt.page
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatalf("expected the listing to end, got %v so far", got)
+				}
+				ips, next, err := repo.ListIPs(network.ID, tt.filter, &page)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(ips) > page.Limit {
+					t.Fatalf("expected at most %d addresses, got %d", page.Limit, len(ips))
+				}
+				for _, ip := range ips {
+					got = append(got, ip.Address.String())
+				}
+				if next == "" {
+					break
+				}
+				page.Cursor = next
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, _, err := repo.ListIPs(network.ID, nil, &domain.Page{Sort: domain.SortByAddress, Limit: 2, Cursor: "not-a-cursor"}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a malformed cursor, got %v", err)
+	}
+	_, next, err := repo.ListIPs(network.ID, nil, &domain.Page{Sort: domain.SortByAddress, Limit: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := repo.ListIPs(network.ID, nil, &domain.Page{Sort: domain.SortByHostname, Limit: 2, Cursor: next}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a cursor of another order, got %v", err)
+	}
+}
+
+func testAddressStatus(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/29", "192.168.1.1")
+
+	// Reservations need no hostname and are skipped by automatic allocation.
+	var reserved []*domain.IPAddress
+	for _, address := range []string{"192.168.1.2", "192.168.1.3"} {
+		ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, RequestedIP: net.ParseIP(address), Status: domain.StatusReserved})
+		if err != nil {
+			t.Fatalf("failed to reserve %s: %v", address, err)
+		}
+		if ip.Status != domain.StatusReserved {
+			t.Errorf("expected status reserved, got %s", ip.Status)
+		}
+		reserved = append(reserved, ip)
+	}
+	ip := allocate(t, repo, network.ID, "", "host-a")
+	if ip.Address.String() != "192.168.1.4" {
+		t.Errorf("expected IP 192.168.1.4, got %s", ip.Address)
+	}
+
+	if err := repo.UpdateIPStatus(reserved[0].ID, domain.StatusReserved, domain.StatusAllocated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, err := repo.GetIP(reserved[0].ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.Status != domain.StatusAllocated {
+		t.Errorf("expected status allocated, got %s", stored.Status)
+	}
+	if err := repo.UpdateIPStatus(reserved[0].ID, domain.StatusReserved, domain.StatusAllocated); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict for a stale status, got %v", err)
+	}
+	if err := repo.UpdateIPStatus(4242, domain.StatusReserved, domain.StatusAllocated); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown IP, got %v", err)
+	}
+
+	// Reserved addresses are in use, so they block deleting the network.
+	for _, id := range []int{reserved[0].ID, ip.ID} {
+		if err := repo.ReleaseIP(id); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := repo.DeleteNetwork(network.ID, false); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict deleting a network with a reservation, got %v", err)
+	}
+}
+
+func testBulkAllocation(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	allocate(t, repo, network.ID, "192.168.1.3", "host-a")
+
+	ips, err := repo.AllocateIPs(&domain.BulkAllocationRequest{
+		NetworkID: network.ID,
+		Hostnames: []string{"node-1", "node-2", "node-3"},
+		Owner:     "infra",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"192.168.1.2", "192.168.1.4", "192.168.1.5"}
+	if len(ips) != len(want) {
+		t.Fatalf("expected %d addresses, got %d", len(want), len(ips))
+	}
+	for i, ip := range ips {
+		if ip.Address.String() != want[i] || ip.Hostname != fmt.Sprintf("node-%d", i+1) {
+			t.Errorf("expected %s for node-%d, got %s for %s", want[i], i+1, ip.Address, ip.Hostname)
+		}
+		if ip.Status != domain.StatusAllocated || ip.Owner != "infra" {
+			t.Errorf("expected an allocated address owned by infra, got %+v", ip)
+		}
+		stored, err := repo.GetIP(ip.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !stored.Address.Equal(ip.Address) || stored.Hostname != ip.Hostname {
+			t.Errorf("expected stored allocation %+v, got %+v", ip, stored)
+		}
+	}
+
+	reserved, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 2, Status: domain.StatusReserved})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reserved) != 2 || reserved[0].Status != domain.StatusReserved || reserved[0].ID == reserved[1].ID {
+		t.Errorf("expected two distinct reservations, got %+v", reserved)
+	}
+}
+
+func testBulkAllocationContiguous(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/28", "192.168.1.1")
+	allocate(t, repo, network.ID, "192.168.1.4", "host-a")
+
+	ips, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 4, Contiguous: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, ip := range ips {
+		if want := fmt.Sprintf("192.168.1.%d", 5+i); ip.Address.String() != want {
+			t.Errorf("expected %s, got %s", want, ip.Address)
+		}
+	}
+
+	// .2, .3 and .9 to .14 are left, with no run of four below .9.
+	if _, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 7, Contiguous: true}); !errors.Is(err, domain.ErrExhausted) {
+		t.Errorf("expected ErrExhausted without a free block of 7, got %v", err)
+	}
+	if _, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 6, Contiguous: true}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	v6 := createNetwork(t, repo, "2001:db8::/64", "2001:db8::1")
+	block, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: v6.ID, Count: 4, Contiguous: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 1; i < len(block); i++ {
+		if !block[i].Address.Equal(domain.NextIP(block[i-1].Address)) {
+			t.Errorf("expected consecutive addresses, got %s after %s", block[i].Address, block[i-1].Address)
+		}
+	}
+}
+
+func testBulkAllocationAllOrNothing(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "10.0.0.0/29", "10.0.0.1")
+	allocate(t, repo, network.ID, "", "node-2")
+
+	req := &domain.BulkAllocationRequest{NetworkID: network.ID, Hostnames: []string{"node-1", "node-2"}}
+	if _, err := repo.AllocateIPs(req); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict for a hostname in use, got %v", err)
+	}
+	if _, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 5}); !errors.Is(err, domain.ErrExhausted) {
+		t.Errorf("expected ErrExhausted for more addresses than are free, got %v", err)
+	}
+	if _, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: 4242, Count: 1}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound allocating in an unknown network, got %v", err)
+	}
+
+	ips, _, err := repo.ListIPs(network.ID, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 {
+		t.Errorf("expected failed bulk allocations to leave 1 address, got %d", len(ips))
+	}
+	if _, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 4}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// testBulkAllocationLarge allocates more hostnames than fit in one Consul
+// transaction. Backends that cap bulk allocations must say so with
+// ErrInvalid and a "limit" detail, and are skipped.
+func testBulkAllocationLarge(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "10.0.0.0/24", "10.0.0.1")
+	hostnames := make([]string, 40)
+	for i := range hostnames {
+		hostnames[i] = fmt.Sprintf("node-%d", i+1)
+	}
+
+	ips, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Hostnames: hostnames})
+	var domainErr *domain.Error
+	if errors.Is(err, domain.ErrInvalid) && errors.As(err, &domainErr) && domainErr.Details["limit"] != "" {
+		stored, _, err := repo.ListIPs(network.ID, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(stored) != 0 {
+			t.Errorf("expected a rejected bulk allocation to allocate nothing, got %d addresses", len(stored))
+		}
+		t.Skipf("bulk allocations are limited to %s addresses", domainErr.Details["limit"])
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != len(hostnames) {
+		t.Fatalf("expected %d addresses, got %d", len(hostnames), len(ips))
+	}
+	for i, ip := range ips {
+		if ip.Hostname != hostnames[i] {
+			t.Errorf("expected hostname %s, got %s", hostnames[i], ip.Hostname)
+		}
+	}
+}
+
+func testLeases(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	permanent := allocate(t, repo, network.ID, "", "host-a")
+	leased, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "ci-1", Owner: "ci", Lease: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if leased.LeaseExpiresAt == nil || time.Until(*leased.LeaseExpiresAt) < 59*time.Minute {
+		t.Fatalf("expected a lease of an hour, got %v", leased.LeaseExpiresAt)
+	}
+	bulk, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 2, Lease: 3 * time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bulk[0].LeaseExpiresAt == nil {
+		t.Errorf("expected bulk allocations to carry the lease")
+	}
+
+	if expired, err := repo.ExpireLeases(time.Now()); err != nil || len(expired) != 0 {
+		t.Errorf("expected no expired leases yet, got %d (%v)", len(expired), err)
+	}
+
+	renewed := time.Now().Add(2 * time.Hour)
+	if err := repo.RenewLease(leased.ID, renewed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, err := repo.GetIP(leased.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Backends may store timestamps with less precision.
+	if stored.LeaseExpiresAt == nil || stored.LeaseExpiresAt.Sub(renewed).Abs() > time.Millisecond {
+		t.Errorf("expected lease to expire at %v, got %v", renewed, stored.LeaseExpiresAt)
+	}
+
+	expired, err := repo.ExpireLeases(time.Now().Add(150 * time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != leased.ID || expired[0].Hostname != "ci-1" || expired[0].Owner != "ci" {
+		t.Fatalf("expected the lease of ci-1 to expire, got %+v", expired)
+	}
+	released, err := repo.GetIP(leased.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !released.Status.Released() || released.Hostname != "" || released.LeaseExpiresAt != nil {
+		t.Errorf("expected the expired address to be released, got %+v", released)
+	}
+	if stored, err := repo.GetIP(permanent.ID); err != nil || stored.Status != domain.StatusAllocated {
+		t.Errorf("expected the address without a lease to stay allocated, got %+v (%v)", stored, err)
+	}
+
+	if err := repo.RenewLease(leased.ID, renewed); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict renewing a released address, got %v", err)
+	}
+	if err := repo.RenewLease(4242, renewed); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound renewing an unknown IP, got %v", err)
+	}
+	allocate(t, repo, network.ID, "", "ci-1")
+}
+
+func testIdempotencyKey(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	other := createNetwork(t, repo, "192.168.2.0/24", "192.168.2.1")
+
+	req := &domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a", IdempotencyKey: "req-1"}
+	ip, err := repo.AllocateIP(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.IdempotencyKey != "req-1" {
+		t.Errorf("expected idempotency key req-1, got %q", ip.IdempotencyKey)
+	}
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-b", IdempotencyKey: "req-1"}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict for a key in use, got %v", err)
+	}
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: other.ID, Hostname: "host-a", IdempotencyKey: "req-1"}); err != nil {
+		t.Errorf("unexpected error reusing a key in another network: %v", err)
+	}
+
+	byKey, err := repo.GetIPByIdempotencyKey(network.ID, "req-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	byHostname, err := repo.GetIPByHostname(network.ID, "host-a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if byKey.ID != ip.ID || byHostname.ID != ip.ID {
+		t.Errorf("expected IP %d by key and hostname, got %d and %d", ip.ID, byKey.ID, byHostname.ID)
+	}
+
+	if err := repo.ReleaseIP(ip.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := repo.GetIPByIdempotencyKey(network.ID, "req-1"); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for the key of a released address, got %v", err)
+	}
+	if _, err := repo.GetIPByHostname(network.ID, "host-a"); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for the hostname of a released address, got %v", err)
+	}
+	if _, err := repo.AllocateIP(req); err != nil {
+		t.Errorf("unexpected error reusing the key of a released address: %v", err)
+	}
+}
+
+func testAllocationStrategies(t *testing.T, repo domain.IPAMRepository) {
+	// 192.168.1.2 to .6 are allocatable.
+	network := &domain.Network{CIDR: "192.168.1.0/29", Gateway: net.ParseIP("192.168.1.1"), Strategy: domain.StrategyLastFree}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stored, err := repo.GetNetwork(network.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.Strategy != domain.StrategyLastFree {
+		t.Errorf("expected strategy %s, got %q", domain.StrategyLastFree, stored.Strategy)
+	}
+
+	if ip := allocate(t, repo, network.ID, "", "host-a"); ip.Address.String() != "192.168.1.6" {
+		t.Errorf("expected the network's last-free strategy to pick 192.168.1.6, got %s", ip.Address)
+	}
+	first, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-b", Strategy: domain.StrategyFirstFree})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.Address.String() != "192.168.1.2" {
+		t.Errorf("expected the requested first-free strategy to pick 192.168.1.2, got %s", first.Address)
+	}
+	random, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-c", Strategy: domain.StrategyRandom})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	switch random.Address.String() {
+	case "192.168.1.3", "192.168.1.4", "192.168.1.5":
+	default:
+		t.Errorf("expected a random free address, got %s", random.Address)
+	}
+
+	ips, err := repo.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	seen := map[string]bool{"192.168.1.2": true, "192.168.1.6": true, random.Address.String(): true}
+	for _, ip := range ips {
+		if seen[ip.Address.String()] {
+			t.Errorf("address %s was allocated twice", ip.Address)
+		}
+		seen[ip.Address.String()] = true
+	}
+
+	network.Strategy = domain.StrategyFirstFree
+	if err := repo.UpdateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored, err = repo.GetNetwork(network.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.Strategy != domain.StrategyFirstFree {
+		t.Errorf("expected updated strategy %s, got %q", domain.StrategyFirstFree, stored.Strategy)
+	}
+}
+
+func testLeastRecentlyReleased(t *testing.T, repo domain.IPAMRepository) {
+	network := &domain.Network{CIDR: "192.168.1.0/29", Gateway: net.ParseIP("192.168.1.1"), Strategy: domain.StrategyLeastRecentlyReleased}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	a := allocate(t, repo, network.ID, "", "host-a")
+	b := allocate(t, repo, network.ID, "", "host-b")
+	if a.Address.String() != "192.168.1.2" || b.Address.String() != "192.168.1.3" {
+		t.Fatalf("expected 192.168.1.2 and .3 before any release, got %s and %s", a.Address, b.Address)
+	}
+	// Release .3 before .2, with a pause so the release times differ.
+	if err := repo.ReleaseIP(b.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := repo.ReleaseIP(a.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Addresses that were never released come first, then the one
+	// released longest ago.
+	for i, want := range []string{"192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.3", "192.168.1.2"} {
+		ip := allocate(t, repo, network.ID, "", fmt.Sprintf("host-%d", i))
+		if ip.Address.String() != want {
+			t.Errorf("allocation %d: expected %s, got %s", i, want, ip.Address)
+		}
+	}
+}
+
+func testUtilization(t *testing.T, repo domain.IPAMRepository) {
+	network := &domain.Network{
+		CIDR:     "192.168.1.0/24",
+		Gateway:  net.ParseIP("192.168.1.1"),
+		Reserved: []domain.IPRange{{Start: net.ParseIP("192.168.1.2"), End: net.ParseIP("192.168.1.10")}},
+		Site:     "tokyo",
+	}
+	if err := repo.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	empty := createNetwork(t, repo, "10.0.0.0/30", "10.0.0.1")
+
+	released := allocate(t, repo, network.ID, "", "host-a")
+	deprecated := allocate(t, repo, network.ID, "", "host-b")
+	allocate(t, repo, network.ID, "192.168.1.5", "router")
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, RequestedIP: net.ParseIP("192.168.1.20"), Status: domain.StatusReserved}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.UpdateIPStatus(deprecated.ID, domain.StatusAllocated, domain.StatusDeprecated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.ReleaseIP(released.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 253 usable addresses: host-b and the router are allocated; .2-.10
+	// but the router and the .20 reservation are reserved.
+	u, err := repo.GetUtilization(network.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.Network == nil || u.Network.ID != network.ID {
+		t.Errorf("expected the utilization of network %d, got %+v", network.ID, u.Network)
+	}
+	if u.Total.Int64() != 253 || u.Allocated.Int64() != 2 || u.Reserved.Int64() != 9 || u.Free.Int64() != 242 {
+		t.Errorf("expected total 253, allocated 2, reserved 9, free 242, got %s, %s, %s, %s", u.Total, u.Allocated, u.Reserved, u.Free)
+	}
+
+	all, err := repo.ListUtilization(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(all) != 2 || all[0].Network.ID != network.ID || all[1].Network.ID != empty.ID {
+		t.Fatalf("expected the utilization of networks %d and %d, got %d entries", network.ID, empty.ID, len(all))
+	}
+	if all[1].Total.Int64() != 1 || all[1].Free.Int64() != 1 {
+		t.Errorf("expected 1 free address in %s, got total %s, free %s", empty.CIDR, all[1].Total, all[1].Free)
+	}
+	filtered, err := repo.ListUtilization(&domain.NetworkFilter{Site: "tokyo"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].Network.ID != network.ID {
+		t.Errorf("expected only network %d for site tokyo, got %d entries", network.ID, len(filtered))
+	}
+
+	if _, err := repo.GetUtilization(4242); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown network, got %v", err)
+	}
+}
+
+func testSearch(t *testing.T, repo domain.IPAMRepository) {
+	parent := createNetwork(t, repo, "10.4.0.0/16", "10.4.0.1")
+	child := &domain.Network{CIDR: "10.4.7.0/24", Gateway: net.ParseIP("10.4.7.1"), ParentID: &parent.ID}
+	if err := repo.CreateNetwork(child); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other := &domain.Network{CIDR: "10.4.0.0/16", Gateway: net.ParseIP("10.4.0.1"), VRF: "customer-a"}
+	if err := repo.CreateNetwork(other); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v6 := createNetwork(t, repo, "2001:db8::/64", "2001:db8::1")
+
+	mac, _ := net.ParseMAC("02:00:5e:10:00:01")
+	web1, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: child.ID, RequestedIP: net.ParseIP("10.4.7.22"), Hostname: "web-1", MAC: mac})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	web2 := allocate(t, repo, other.ID, "10.4.7.22", "web-2")
+	db1 := allocate(t, repo, child.ID, "10.4.7.23", "db-1")
+	web3 := allocate(t, repo, v6.ID, "2001:db8::10", "web_3")
+	released := allocate(t, repo, child.ID, "10.4.7.30", "old")
+	if err := repo.ReleaseIP(released.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, prefix, _ := net.ParseCIDR("10.4.7.16/28")
+	tests := []struct {
+		name      string
+		query     *domain.SearchQuery
+		addresses []int
+		networks  []int
+		truncated bool
+	}{
+		{"IP in two VRFs", &domain.SearchQuery{IP: net.ParseIP("10.4.7.22")}, []int{web1.ID, web2.ID}, []int{child.ID, other.ID}, false},
+		{"Prefix", &domain.SearchQuery{Prefix: prefix}, []int{web1.ID, web2.ID, db1.ID}, []int{child.ID, other.ID}, false},
+		{"Prefix with limit", &domain.SearchQuery{Prefix: prefix, Limit: 2}, []int{web1.ID, web2.ID}, []int{child.ID, other.ID}, true},
+		{"Exact hostname", &domain.SearchQuery{Hostname: "web-1"}, []int{web1.ID}, []int{child.ID}, false},
+		{"Hostname wildcard", &domain.SearchQuery{Hostname: "web*"}, []int{web1.ID, web2.ID, web3.ID}, []int{child.ID, other.ID, v6.ID}, false},
+		{"Hostname wildcard with underscore", &domain.SearchQuery{Hostname: "web_*"}, []int{web3.ID}, []int{v6.ID}, false},
+		{"Hostname wildcard inside", &domain.SearchQuery{Hostname: "*b-*"}, []int{web1.ID, web2.ID, db1.ID}, []int{child.ID, other.ID}, false},
+		{"MAC", &domain.SearchQuery{MAC: mac}, []int{web1.ID}, []int{child.ID}, false},
+		{"Released address", &domain.SearchQuery{IP: net.ParseIP("10.4.7.30")}, nil, []int{child.ID, other.ID}, false},
+		{"Address outside any network", &domain.SearchQuery{IP: net.ParseIP("192.0.2.1")}, nil, nil, false},
+		{"IPv6 address", &domain.SearchQuery{IP: net.ParseIP("2001:db8::5")}, nil, []int{v6.ID}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := repo.Search(tt.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var addresses, networks []int
+			for _, ip := range result.Addresses {
+				addresses = append(addresses, ip.ID)
+			}
+			for _, network := range result.Networks {
+				networks = append(networks, network.ID)
+			}
+			if !slices.Equal(addresses, tt.addresses) {
+				t.Errorf("expected addresses %v, got %v", tt.addresses, addresses)
+			}
+			if !slices.Equal(networks, tt.networks) {
+				t.Errorf("expected networks %v, got %v", tt.networks, networks)
+			}
+			if result.Truncated != tt.truncated {
+				t.Errorf("expected truncated %v, got %v", tt.truncated, result.Truncated)
+			}
+		})
+	}
+}
+
+func testConcurrentAllocation(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+
+	// Most workers allocate a host of their own; the rest race for the
+	// same hostname, which only one of them may get.
+	const workers, contenders = 16, 4
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	addresses := make(map[string]int)
+	shared := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hostname := fmt.Sprintf("host-%d", i)
+			if i < contenders {
+				hostname = "shared"
+			}
+			ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: hostname})
+			if i < contenders && errors.Is(err, domain.ErrConflict) {
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error allocating %s: %v", hostname, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			addresses[ip.Address.String()]++
+			if hostname == "shared" {
+				shared++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for address, count := range addresses {
+		if count > 1 {
+			t.Errorf("address %s was allocated %d times", address, count)
+		}
+	}
+	if shared != 1 {
+		t.Errorf("expected exactly one allocation of the shared hostname, got %d", shared)
+	}
+	ips, _, err := repo.ListIPs(network.ID, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := workers - contenders + 1; len(ips) != want {
+		t.Errorf("expected %d addresses, got %d", want, len(ips))
+	}
+}
+
+func testConcurrentOverlappingNetworks(t *testing.T, repo domain.IPAMRepository) {
+	cidrs := []string{"10.9.0.0/16", "10.9.0.0/24", "10.9.1.0/24", "10.9.128.0/17"}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for _, cidr := range cidrs {
+		wg.Add(1)
+		go func(cidr string) {
+			defer wg.Done()
+			_, ipNet, _ := net.ParseCIDR(cidr)
+			network := &domain.Network{CIDR: cidr, Gateway: domain.NextIP(ipNet.IP)}
+			err := repo.CreateNetwork(network)
+			if errors.Is(err, domain.ErrConflict) {
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error creating %s: %v", cidr, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			created++
+		}(cidr)
+	}
+	wg.Wait()
+
+	// 10.9.0.0/24 and 10.9.1.0/24 may both exist, but neither together
+	// with the /16 or the /17.
+	networks, _, err := repo.ListNetworks(nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(networks) != created {
+		t.Errorf("expected %d networks, got %d", created, len(networks))
+	}
+	for i, a := range networks {
+		for _, b := range networks[i+1:] {
+			_, netA, _ := net.ParseCIDR(a.CIDR)
+			_, netB, _ := net.ParseCIDR(b.CIDR)
+			if netA.Contains(netB.IP) || netB.Contains(netA.IP) {
+				t.Errorf("overlapping networks %s and %s were both created", a.CIDR, b.CIDR)
+			}
+		}
+	}
+}
+
+func testConcurrentChildNetworks(t *testing.T, repo domain.IPAMRepository) {
+	parent := createNetwork(t, repo, "10.8.0.0/20", "10.8.0.1")
+
+	const workers = 16
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	carved := make(map[string]int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			child, err := repo.AllocateChildNetwork(parent.ID, 24)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if child.ParentID == nil || *child.ParentID != parent.ID {
+				t.Errorf("expected parent %d, got %v", parent.ID, child.ParentID)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			carved[child.CIDR]++
+		}()
+	}
+	wg.Wait()
+
+	if len(carved) != workers {
+		t.Errorf("expected %d different prefixes, got %v", workers, carved)
+	}
+	if _, err := repo.AllocateChildNetwork(parent.ID, 24); !errors.Is(err, domain.ErrExhausted) {
+		t.Errorf("expected ErrExhausted once the parent is full, got %v", err)
+	}
+	if _, err := repo.AllocateChildNetwork(parent.ID, 32); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a host route, got %v", err)
+	}
+	if _, err := repo.AllocateChildNetwork(999, 24); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown parent, got %v", err)
+	}
+}
+
+func testDuplicateHostnameRejected(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	allocate(t, repo, network.ID, "", "host-a")
+	b := allocate(t, repo, network.ID, "", "host-b")
+
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a"}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict when allocating a duplicate hostname, got %v", err)
+	}
+	b.Hostname = "host-a"
+	if err := repo.UpdateIP(b); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict when renaming to a duplicate hostname, got %v", err)
+	}
+
+	b.Hostname = "host-c"
+	if err := repo.UpdateIP(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	renamed, err := repo.GetIP(b.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if renamed.Hostname != "host-c" {
+		t.Errorf("expected hostname host-c, got %s", renamed.Hostname)
+	}
+	// The previous hostname can be taken by another allocation.
+	allocate(t, repo, network.ID, "", "host-b")
+}
+
+func testHostnameUniquePerNetwork(t *testing.T, repo domain.IPAMRepository) {
+	a := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	b := createNetwork(t, repo, "192.168.2.0/24", "192.168.2.1")
+
+	allocate(t, repo, a.ID, "", "host-a")
+	allocate(t, repo, b.ID, "", "host-a")
+}
+
+func testReleasedAddressReusable(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	ip := allocate(t, repo, network.ID, "", "host-a")
+
+	if err := repo.ReleaseIP(ip.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := repo.ReleaseIP(ip.ID); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict releasing a released address, got %v", err)
+	}
+
+	again := allocate(t, repo, network.ID, "", "host-a")
+	if !again.Address.Equal(ip.Address) {
+		t.Errorf("expected released address %s to be reused, got %s", ip.Address, again.Address)
+	}
+	if err := repo.ReleaseIP(again.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	requested := allocate(t, repo, network.ID, ip.Address.String(), "host-b")
+	if !requested.Address.Equal(ip.Address) {
+		t.Errorf("expected requested address %s, got %s", ip.Address, requested.Address)
+	}
+}
+
+func testExhaustion(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "10.0.0.0/30", "10.0.0.1")
+
+	for i := 0; i < 4; i++ {
+		if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: fmt.Sprintf("host-%d", i)}); err != nil {
+			if !errors.Is(err, domain.ErrExhausted) {
+				t.Errorf("expected ErrExhausted, got %v", err)
+			}
+			return
+		}
+	}
+	t.Error("expected the /30 network to run out of addresses")
+}
+
+func testIPv6FirstFree(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "2001:db8::/120", "2001:db8::1")
+
+	for _, want := range []string{"2001:db8::2", "2001:db8::3"} {
+		ip := allocate(t, repo, network.ID, "", "host-"+want)
+		if ip.Address.String() != want {
+			t.Errorf("expected IP %s, got %s", want, ip.Address)
+		}
+	}
+
+	req := &domain.AllocationRequest{NetworkID: network.ID, RequestedIP: net.ParseIP("2001:db8::"), Hostname: "anycast"}
+	if _, err := repo.AllocateIP(req); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid when requesting the subnet-router anycast address, got %v", err)
+	}
+}
+
+func testIPv6Sparse(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "2001:db8:0:1::/64", "2001:db8:0:1::1")
+	_, ipNet, _ := net.ParseCIDR(network.CIDR)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 16; i++ {
+		ip := allocate(t, repo, network.ID, "", fmt.Sprintf("host-%d", i))
+		if !ipNet.Contains(ip.Address) || ip.Address.Equal(ipNet.IP) || ip.Address.Equal(network.Gateway) {
+			t.Errorf("unexpected address %s in %s", ip.Address, network.CIDR)
+		}
+		if seen[ip.Address.String()] {
+			t.Errorf("address %s was handed out twice", ip.Address)
+		}
+		seen[ip.Address.String()] = true
+	}
+}
+
+func testIPv6EUI64(t *testing.T, repo domain.IPAMRepository) {
+	network := createNetwork(t, repo, "2001:db8:0:2::/64", "2001:db8:0:2::1")
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+
+	ip, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a", MAC: mac})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address.String() != "2001:db8:0:2:5054:ff:fe12:3456" {
+		t.Errorf("expected EUI-64 address 2001:db8:0:2:5054:ff:fe12:3456, got %s", ip.Address)
+	}
+
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-b", MAC: mac}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict when the EUI-64 address is taken, got %v", err)
+	}
+}
+
+func testDualStackHost(t *testing.T, repo domain.IPAMRepository) {
+	v4 := createNetwork(t, repo, "192.168.1.0/24", "192.168.1.1")
+	v6 := createNetwork(t, repo, "2001:db8::/64", "2001:db8::1")
+
+	a := allocate(t, repo, v4.ID, "", "host-a")
+	aaaa := allocate(t, repo, v6.ID, "", "host-a")
+	if a.Address.To4() == nil || aaaa.Address.To4() != nil {
+		t.Errorf("expected one IPv4 and one IPv6 address, got %s and %s", a.Address, aaaa.Address)
+	}
+
+	stored, err := repo.GetIP(aaaa.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !stored.Address.Equal(aaaa.Address) || stored.NetworkID != v6.ID {
+		t.Errorf("expected stored allocation %+v, got %+v", aaaa, stored)
+	}
+
+	ips, _, err := repo.ListIPs(v6.ID, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Address.Equal(aaaa.Address) {
+		t.Errorf("expected only %s in the IPv6 network, got %d addresses", aaaa.Address, len(ips))
+	}
+}
+
+func testUnknownIP(t *testing.T, repo domain.IPAMRepository) {
+	if _, err := repo.GetIP(4242); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound getting an unknown IP, got %v", err)
+	}
+	if err := repo.ReleaseIP(4242); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound releasing an unknown IP, got %v", err)
+	}
+	if err := repo.UpdateIP(&domain.IPAddress{ID: 4242, Hostname: "host-a"}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating an unknown IP, got %v", err)
+	}
+}
+
+func testUnknownNetwork(t *testing.T, repo domain.IPAMRepository) {
+	if _, err := repo.GetNetwork(4242); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound getting an unknown network, got %v", err)
+	}
+	if _, err := repo.AllocateIP(&domain.AllocationRequest{NetworkID: 4242, Hostname: "host-a"}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound allocating in an unknown network, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+)
+
+// errorResponse is the JSON body of every error returned by the API.
+type errorResponse struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// writeError maps domain error kinds to HTTP status codes. Errors of no
+// known kind are reported as internal server errors.
+func writeError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, "internal"
+	switch {
+	case errors.Is(err, domain.ErrNotFound):
+		status, code = http.StatusNotFound, "not_found"
+	case errors.Is(err, domain.ErrConflict):
+		status, code = http.StatusConflict, "conflict"
+	case errors.Is(err, domain.ErrInvalid):
+		status, code = http.StatusUnprocessableEntity, "invalid"
+	case errors.Is(err, domain.ErrExhausted):
+		status, code = http.StatusInsufficientStorage, "exhausted"
+	}
+
+	body := errorResponse{Code: code, Message: err.Error()}
+	var domainErr *domain.Error
+	if errors.As(err, &domainErr) {
+		body.Details = domainErr.Details
+	}
+	writeErrorResponse(w, status, body)
+}
+
+// writeBadRequest reports a request that could not be parsed.
+func writeBadRequest(w http.ResponseWriter, message string) {
+	writeErrorResponse(w, http.StatusBadRequest, errorResponse{Code: "bad_request", Message: message})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeErrorResponse(w, http.StatusMethodNotAllowed, errorResponse{Code: "method_not_allowed", Message: "Method not allowed"})
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, body errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
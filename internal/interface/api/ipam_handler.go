@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/zinrai/ipam-mvp-go/internal/domain"
 	"github.com/zinrai/ipam-mvp-go/internal/usecase"
@@ -18,6 +19,26 @@ func NewIPAMHandler(useCase *usecase.IPAMUseCase) *IPAMHandler {
 	return &IPAMHandler{useCase: useCase}
 }
 
+// legacyNetwork and legacyIPAddress are the shapes the legacy endpoints
+// have always returned, independent of fields added to the domain types.
+type legacyNetwork struct {
+	ID      int
+	CIDR    string
+	Gateway net.IP
+}
+
+type legacyIPAddress struct {
+	ID        int
+	NetworkID int
+	Address   net.IP
+	Hostname  string
+	Status    string
+}
+
+func toLegacyNetwork(network *domain.Network) legacyNetwork {
+	return legacyNetwork{ID: network.ID, CIDR: network.CIDR, Gateway: network.Gateway}
+}
+
 func (h *IPAMHandler) HandleNetwork(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
@@ -25,7 +46,7 @@ func (h *IPAMHandler) HandleNetwork(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		h.listNetworks(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 	}
 }
 
@@ -40,33 +61,37 @@ func (h *IPAMHandler) HandleIP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPut:
 		h.updateIPHostname(w, r)
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 	}
 }
 
 func (h *IPAMHandler) createNetwork(w http.ResponseWriter, r *http.Request) {
 	var network domain.Network
 	if err := json.NewDecoder(r.Body).Decode(&network); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBadRequest(w, err.Error())
 		return
 	}
 
 	if err := h.useCase.CreateNetwork(&network); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(network)
+	json.NewEncoder(w).Encode(toLegacyNetwork(&network))
 }
 
 func (h *IPAMHandler) listNetworks(w http.ResponseWriter, r *http.Request) {
-	networks, err := h.useCase.ListNetworks()
+	networks, _, err := h.useCase.ListNetworks(nil, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	json.NewEncoder(w).Encode(networks)
+	response := make([]legacyNetwork, len(networks))
+	for i, network := range networks {
+		response[i] = toLegacyNetwork(network)
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *IPAMHandler) allocateIP(w http.ResponseWriter, r *http.Request) {
@@ -74,9 +99,17 @@ func (h *IPAMHandler) allocateIP(w http.ResponseWriter, r *http.Request) {
 		NetworkID   int    `json:"network_id"`
 		RequestedIP string `json:"requested_ip"`
 		Hostname    string `json:"hostname"`
+		MAC         string `json:"mac"`
+		// LeaseSeconds is the lifetime of the allocation, 0 for none.
+		LeaseSeconds   int    `json:"lease_seconds"`
+		IdempotencyKey string `json:"idempotency_key"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBadRequest(w, err.Error())
+		return
+	}
+	key, ok := idempotencyKey(w, r, request.IdempotencyKey)
+	if !ok {
 		return
 	}
 
@@ -84,29 +117,43 @@ func (h *IPAMHandler) allocateIP(w http.ResponseWriter, r *http.Request) {
 	if request.RequestedIP != "" {
 		requestedIP = net.ParseIP(request.RequestedIP)
 		if requestedIP == nil {
-			http.Error(w, "Invalid IP address", http.StatusBadRequest)
+			writeBadRequest(w, "Invalid IP address")
 			return
 		}
 	}
 
-	ip, err := h.useCase.AllocateIP(request.NetworkID, requestedIP, request.Hostname)
+	mac, ok := parseMAC(w, request.MAC)
+	if !ok {
+		return
+	}
+
+	ip, _, err := h.useCase.AllocateIP(&domain.AllocationRequest{
+		NetworkID:      request.NetworkID,
+		RequestedIP:    requestedIP,
+		Hostname:       request.Hostname,
+		MAC:            mac,
+		Lease:          time.Duration(request.LeaseSeconds) * time.Second,
+		IdempotencyKey: key,
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	response := struct {
-		ID        int    `json:"id"`
-		NetworkID int    `json:"network_id"`
-		Address   string `json:"address"`
-		Hostname  string `json:"hostname"`
-		Status    string `json:"status"`
+		ID             int        `json:"id"`
+		NetworkID      int        `json:"network_id"`
+		Address        string     `json:"address"`
+		Hostname       string     `json:"hostname"`
+		Status         string     `json:"status"`
+		LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
 	}{
-		ID:        ip.ID,
-		NetworkID: ip.NetworkID,
-		Address:   ip.Address.String(),
-		Hostname:  ip.Hostname,
-		Status:    ip.Status,
+		ID:             ip.ID,
+		NetworkID:      ip.NetworkID,
+		Address:        ip.Address.String(),
+		Hostname:       ip.Hostname,
+		Status:         string(ip.Status),
+		LeaseExpiresAt: ip.LeaseExpiresAt,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -116,11 +163,11 @@ func (h *IPAMHandler) allocateIP(w http.ResponseWriter, r *http.Request) {
 func (h *IPAMHandler) releaseIP(w http.ResponseWriter, r *http.Request) {
 	ipID, err := strconv.Atoi(r.URL.Query().Get("ip_id"))
 	if err != nil {
-		http.Error(w, "Invalid IP ID", http.StatusBadRequest)
+		writeBadRequest(w, "Invalid IP ID")
 		return
 	}
 	if err := h.useCase.ReleaseIP(ipID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -129,15 +176,19 @@ func (h *IPAMHandler) releaseIP(w http.ResponseWriter, r *http.Request) {
 func (h *IPAMHandler) listIPs(w http.ResponseWriter, r *http.Request) {
 	networkID, err := strconv.Atoi(r.URL.Query().Get("network_id"))
 	if err != nil {
-		http.Error(w, "Invalid network ID", http.StatusBadRequest)
+		writeBadRequest(w, "Invalid network ID")
 		return
 	}
-	ips, err := h.useCase.ListIPs(networkID)
+	ips, _, err := h.useCase.ListIPs(networkID, nil, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	json.NewEncoder(w).Encode(ips)
+	response := make([]legacyIPAddress, len(ips))
+	for i, ip := range ips {
+		response[i] = legacyIPAddress{ID: ip.ID, NetworkID: ip.NetworkID, Address: ip.Address, Hostname: ip.Hostname, Status: string(ip.Status)}
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *IPAMHandler) updateIPHostname(w http.ResponseWriter, r *http.Request) {
@@ -146,11 +197,11 @@ func (h *IPAMHandler) updateIPHostname(w http.ResponseWriter, r *http.Request) {
 		Hostname string `json:"hostname"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBadRequest(w, err.Error())
 		return
 	}
-	if err := h.useCase.UpdateIPHostname(request.IPID, request.Hostname); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, err := h.useCase.UpdateIP(request.IPID, &domain.IPUpdate{Hostname: &request.Hostname}); err != nil {
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,824 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/memory"
+	"github.com/zinrai/ipam-mvp-go/internal/usecase"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	repo, err := memory.NewIPAMRepository("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler := NewIPAMHandler(usecase.NewIPAMUseCase(repo))
+
+	mux := http.NewServeMux()
+	handler.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func doRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestIPLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/network", `{"CIDR": "192.168.1.0/24", "Gateway": "192.168.1.1"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/ip", `{"network_id": 1, "hostname": "host-a"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var allocated struct {
+		ID      int    `json:"id"`
+		Address string `json:"address"`
+		Status  string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&allocated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if allocated.Address != "192.168.1.2" || allocated.Status != "allocated" {
+		t.Errorf("unexpected allocation %+v", allocated)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/ip", `{"network_id": 1, "requested_ip": "not-an-ip"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/ip", `{"ip_id": 1, "hostname": "host-b"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	// The legacy listings keep their original fields.
+	resp = doRequest(t, http.MethodGet, srv.URL+"/ip?network_id=1", "")
+	var ips []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&ips); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]interface{}{"ID": 1.0, "NetworkID": 1.0, "Address": "192.168.1.2", "Hostname": "host-b", "Status": "allocated"}
+	if len(ips) != 1 || fmt.Sprint(ips[0]) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, ips)
+	}
+	resp = doRequest(t, http.MethodGet, srv.URL+"/network", "")
+	var networks []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&networks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantNetwork := map[string]interface{}{"ID": 1.0, "CIDR": "192.168.1.0/24", "Gateway": "192.168.1.1"}
+	if len(networks) != 1 || fmt.Sprint(networks[0]) != fmt.Sprint(wantNetwork) {
+		t.Errorf("expected %v, got %v", wantNetwork, networks)
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/ip?ip_id=1", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/ip", "")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/network", `{"CIDR": "10.0.0.0/30", "Gateway": "10.0.0.1"}`)
+	doRequest(t, http.MethodPost, srv.URL+"/ip", `{"network_id": 1, "hostname": "host-a"}`)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"Unknown network", http.MethodPost, "/ip", `{"network_id": 42, "hostname": "host-b"}`, http.StatusNotFound, "not_found"},
+		{"Duplicate hostname", http.MethodPost, "/ip", `{"network_id": 1, "hostname": "host-a"}`, http.StatusConflict, "conflict"},
+		{"Gateway requested", http.MethodPost, "/ip", `{"network_id": 1, "requested_ip": "10.0.0.1", "hostname": "host-b"}`, http.StatusUnprocessableEntity, "invalid"},
+		{"Unknown IP", http.MethodDelete, "/ip?ip_id=42", "", http.StatusNotFound, "not_found"},
+		{"Malformed body", http.MethodPost, "/ip", `{`, http.StatusBadRequest, "bad_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := doRequest(t, tt.method, srv.URL+tt.path, tt.body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			var body errorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if body.Code != tt.code || body.Message == "" {
+				t.Errorf("unexpected error body %+v", body)
+			}
+		})
+	}
+
+	t.Run("Exhausted network", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			resp := doRequest(t, http.MethodPost, srv.URL+"/ip", fmt.Sprintf(`{"network_id": 1, "hostname": "fill-%d"}`, i))
+			if resp.StatusCode == http.StatusOK {
+				continue
+			}
+			if resp.StatusCode != http.StatusInsufficientStorage {
+				t.Errorf("expected status 507, got %d", resp.StatusCode)
+			}
+			return
+		}
+		t.Error("expected the network to run out of addresses")
+	})
+
+	t.Run("Conflict details", func(t *testing.T) {
+		resp := doRequest(t, http.MethodPost, srv.URL+"/ip", `{"network_id": 1, "hostname": "host-a"}`)
+		var body errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if body.Details["hostname"] != "host-a" {
+			t.Errorf("expected hostname detail, got %+v", body.Details)
+		}
+	})
+}
+
+func TestV1Routes(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "192.168.1.0/24", "gateway": "192.168.1.1"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/api/v1/networks/1" {
+		t.Errorf("expected Location /api/v1/networks/1, got %q", loc)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/1", "")
+	var network networkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if network.CIDR != "192.168.1.0/24" || network.Gateway != "192.168.1.1" {
+		t.Errorf("unexpected network %+v", network)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "host-a"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var ip ipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address != "192.168.1.2" || ip.NetworkID != 1 {
+		t.Errorf("unexpected allocation %+v", ip)
+	}
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/api/v1/addresses/1", `{"hostname": "host-b"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/addresses/1", "")
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Hostname != "host-b" {
+		t.Errorf("expected hostname host-b, got %s", ip.Hostname)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/1/addresses", "")
+	var ips []ipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ips); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 {
+		t.Errorf("expected 1 IP address, got %d", len(ips))
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/api/v1/addresses/1", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", resp.StatusCode)
+	}
+
+	for _, path := range []string{"/api/v1/networks/42", "/api/v1/networks/42/addresses", "/api/v1/addresses/42"} {
+		resp = doRequest(t, http.MethodGet, srv.URL+path, "")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", path, resp.StatusCode)
+		}
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/addresses/abc", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1ReservedRanges(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1", "reserved": [{"start": "10.0.0.2", "end": "10.0.0.10"}]}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var network networkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(network.Reserved) != 1 || network.Reserved[0] != (ipRange{Start: "10.0.0.2", End: "10.0.0.10"}) {
+		t.Errorf("unexpected reserved ranges %+v", network.Reserved)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "host-a"}`)
+	var ip ipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address != "10.0.0.11" {
+		t.Errorf("expected IP 10.0.0.11, got %s", ip.Address)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.1.0/24", "gateway": "10.0.1.1", "reserved": [{"start": "10.0.2.2", "end": "10.0.2.10"}]}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 for a range outside the network, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1NetworkHierarchy(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/16", "gateway": "10.0.0.1"}`)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/children", `{"prefix_length": 26}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var child networkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&child); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if child.CIDR != "10.0.0.0/26" || child.Gateway != "10.0.0.1" || child.ParentID == nil || *child.ParentID != 1 {
+		t.Errorf("unexpected child network %+v", child)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/tree", "")
+	var tree []networkTreeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tree); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tree) != 1 || len(tree[0].Children) != 1 || tree[0].Children[0].CIDR != "10.0.0.0/26" {
+		t.Errorf("unexpected tree %+v", tree)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/children", `{"prefix_length": 8}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1UpdateAndDeleteNetwork(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1"}`)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "host-a"}`)
+
+	resp := doRequest(t, http.MethodPatch, srv.URL+"/api/v1/networks/1", `{"gateway": "10.0.0.2"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409 for an allocated gateway, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/api/v1/networks/1", `{"gateway": "10.0.0.254"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var network networkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if network.Gateway != "10.0.0.254" {
+		t.Errorf("expected gateway 10.0.0.254, got %s", network.Gateway)
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/api/v1/networks/1", "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409 while addresses are allocated, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/api/v1/networks/1?force=true", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/addresses/1", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 for an address of a deleted network, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1NetworkMetadata(t *testing.T) {
+	srv := newTestServer(t)
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.20.30.0/24", "gateway": "10.20.30.1", "name": "tokyo-prod", "vlan_id": 120, "site": "tokyo", "tags": {"env": "prod"}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.20.31.0/24", "gateway": "10.20.31.1", "site": "tokyo", "tags": {"env": "dev"}}`)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.20.32.0/24", "gateway": "10.20.32.1"}`)
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks?site=tokyo&tag=env:prod", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var networks []networkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&networks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(networks) != 1 {
+		t.Fatalf("expected 1 network, got %d", len(networks))
+	}
+	network := networks[0]
+	if network.Name != "tokyo-prod" || network.VLANID == nil || *network.VLANID != 120 || network.Tags["env"] != "prod" {
+		t.Errorf("unexpected network %+v", network)
+	}
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/api/v1/networks/3", `{"description": "Lab", "tags": {"env": "lab"}}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if network.Description != "Lab" || network.Tags["env"] != "lab" || network.VLANID != nil {
+		t.Errorf("unexpected network %+v", network)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks?tag=env", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a tag without value, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.20.33.0/24", "gateway": "10.20.33.1", "vlan_id": 5000}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 for an invalid VLAN ID, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1IPMetadata(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1"}`)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "host-a", "mac": "52:54:00:12:34:56", "owner": "infra", "tags": {"env": "prod"}}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var ip ipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.MAC != "52:54:00:12:34:56" || ip.Owner != "infra" || ip.Tags["env"] != "prod" || ip.CreatedAt.IsZero() {
+		t.Errorf("unexpected IP address %+v", ip)
+	}
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/api/v1/addresses/1", `{"description": "Build server", "mac": ""}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Description != "Build server" || ip.MAC != "" || ip.Hostname != "host-a" || ip.Owner != "infra" {
+		t.Errorf("unexpected IP address %+v", ip)
+	}
+
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/api/v1/addresses/1", `{"mac": "not-a-mac"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid MAC, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1AddressStatus(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1"}`)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"requested_ip": "10.0.0.2", "status": "reserved"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var ip ipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Status != "reserved" {
+		t.Errorf("expected status reserved, got %s", ip.Status)
+	}
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/api/v1/addresses/1/status", `{"status": "deprecated"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409 deprecating a reservation, got %d", resp.StatusCode)
+	}
+	for _, status := range []string{"allocated", "deprecated", "available"} {
+		resp = doRequest(t, http.MethodPut, srv.URL+"/api/v1/addresses/1/status", `{"status": "`+status+`"}`)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", status, resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip.Status != status {
+			t.Errorf("expected status %s, got %s", status, ip.Status)
+		}
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/api/v1/addresses/1", "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409 releasing a released address, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPut, srv.URL+"/api/v1/addresses/1/status", `{"status": "retired"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 for an unknown status, got %d", resp.StatusCode)
+	}
+}
+
+func TestLegacyRoutesDeprecated(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/network", "")
+	if resp.Header.Get("Deprecation") != "true" {
+		t.Errorf("expected Deprecation header, got %q", resp.Header.Get("Deprecation"))
+	}
+	if !strings.Contains(resp.Header.Get("Link"), "/api/v1/networks") {
+		t.Errorf("expected Link to the successor, got %q", resp.Header.Get("Link"))
+	}
+}
+
+func TestV1BulkAllocation(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1"}`)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses/bulk", `{"hostnames": ["node-1", "node-2", "node-3"], "contiguous": true, "owner": "infra"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var ips []ipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ips); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 3 {
+		t.Fatalf("expected 3 addresses, got %d", len(ips))
+	}
+	for i, ip := range ips {
+		if want := fmt.Sprintf("10.0.0.%d", i+2); ip.Address != want || ip.Hostname != fmt.Sprintf("node-%d", i+1) || ip.Owner != "infra" {
+			t.Errorf("expected %s for node-%d, got %+v", want, i+1, ip)
+		}
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses/bulk", `{"count": 300}`)
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("expected status 507 for more addresses than are free, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses/bulk", `{"hostnames": ["node-3", "node-4"]}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409 for a hostname in use, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses/bulk", `{"count": 0}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 without a count, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/1/addresses", "")
+	if err := json.NewDecoder(resp.Body).Decode(&ips); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 3 {
+		t.Errorf("expected failed bulk allocations to leave 3 addresses, got %d", len(ips))
+	}
+}
+
+func TestV1Leases(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1"}`)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "ci-1", "lease_seconds": 3600}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var ip ipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.LeaseExpiresAt == nil {
+		t.Fatal("expected lease_expires_at to be set")
+	}
+	expiresAt := *ip.LeaseExpiresAt
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/api/v1/addresses/1/lease", `{"lease_seconds": 7200}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.LeaseExpiresAt == nil || !ip.LeaseExpiresAt.After(expiresAt) {
+		t.Errorf("expected the lease to be extended past %v, got %v", expiresAt, ip.LeaseExpiresAt)
+	}
+
+	resp = doRequest(t, http.MethodPut, srv.URL+"/api/v1/addresses/1/lease", `{"lease_seconds": 0}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 without a lease, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/ip", `{"network_id": 1, "hostname": "ci-2", "lease_seconds": 60}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var legacy struct {
+		LeaseExpiresAt *string `json:"lease_expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&legacy); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if legacy.LeaseExpiresAt == nil {
+		t.Error("expected the legacy endpoint to return lease_expires_at")
+	}
+}
+
+func TestV1IdempotentAllocation(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1"}`)
+
+	allocate := func(key, body string) (*http.Response, ipResponse) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		var ip ipResponse
+		json.NewDecoder(resp.Body).Decode(&ip)
+		return resp, ip
+	}
+
+	resp, first := allocate("req-1", `{"hostname": "host-a"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	resp, again := allocate("req-1", `{"hostname": "host-a"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 for a retry, got %d", resp.StatusCode)
+	}
+	if again.ID != first.ID || again.Address != first.Address {
+		t.Errorf("expected the retry to return %+v, got %+v", first, again)
+	}
+
+	resp, _ = allocate("req-1", `{"hostname": "host-a", "idempotency_key": "req-2"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400 for differing keys, got %d", resp.StatusCode)
+	}
+	resp, _ = allocate("req-1", `{"hostname": "host-b"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409 reusing a key for another host, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1AllocationStrategies(t *testing.T) {
+	srv := newTestServer(t)
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1", "allocation_strategy": "last_free"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", resp.StatusCode)
+	}
+	var network networkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if network.Strategy != "last_free" {
+		t.Errorf("expected strategy last_free, got %q", network.Strategy)
+	}
+
+	var ip ipResponse
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "host-a"}`)
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address != "10.0.0.254" {
+		t.Errorf("expected 10.0.0.254 from the network strategy, got %s", ip.Address)
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "host-b", "strategy": "first_free"}`)
+	if err := json.NewDecoder(resp.Body).Decode(&ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address != "10.0.0.2" {
+		t.Errorf("expected 10.0.0.2 from the requested strategy, got %s", ip.Address)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses", `{"hostname": "host-c", "strategy": "round_robin"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 for an unknown strategy, got %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPatch, srv.URL+"/api/v1/networks/1", `{"allocation_strategy": "round_robin"}`)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422 updating to an unknown strategy, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1Utilization(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/29", "gateway": "10.0.0.1", "site": "tokyo"}`)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.1.0/24", "gateway": "10.0.1.1", "site": "osaka"}`)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses/bulk", `{"count": 2}`)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/1/utilization", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var u utilizationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.NetworkID != 1 || u.Total.Int64() != 5 || u.Allocated.Int64() != 2 || u.Reserved.Int64() != 0 || u.Free.Int64() != 3 {
+		t.Errorf("expected 2 of 5 addresses allocated in network 1, got %+v", u)
+	}
+	if u.PercentUsed != 40 || u.Level != "ok" {
+		t.Errorf("expected 40%% used at level ok, got %v%% at %s", u.PercentUsed, u.Level)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/utilization?site=tokyo", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var list struct {
+		Networks []utilizationResponse `json:"networks"`
+		Total    utilizationResponse   `json:"total"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(list.Networks) != 1 || list.Networks[0].NetworkID != 1 {
+		t.Errorf("expected only network 1 for site tokyo, got %+v", list.Networks)
+	}
+	if list.Total.NetworkID != 0 || list.Total.Total.Int64() != 5 || list.Total.Free.Int64() != 3 {
+		t.Errorf("expected the total to match network 1, got %+v", list.Total)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/42/utilization", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown network, got %d", resp.StatusCode)
+	}
+}
+
+func TestV1Pagination(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.0.0/24", "gateway": "10.0.0.1"}`)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/addresses/bulk", `{"hostnames": ["web-1", "web-2", "db-1"]}`)
+
+	listIPs := func(query string) ([]ipResponse, *http.Response) {
+		t.Helper()
+		resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/1/addresses"+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 for %q, got %d", query, resp.StatusCode)
+		}
+		var ips []ipResponse
+		if err := json.NewDecoder(resp.Body).Decode(&ips); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return ips, resp
+	}
+
+	ips, resp := listIPs("?limit=2")
+	if len(ips) != 2 || ips[0].Address != "10.0.0.2" || ips[1].Address != "10.0.0.3" {
+		t.Fatalf("expected the first two addresses, got %+v", ips)
+	}
+	cursor := resp.Header.Get("X-Next-Cursor")
+	if cursor == "" {
+		t.Fatal("expected an X-Next-Cursor header")
+	}
+	if link := resp.Header.Get("Link"); !strings.Contains(link, "cursor="+cursor) || !strings.HasSuffix(link, `rel="next"`) {
+		t.Errorf("expected a next link with the cursor, got %q", link)
+	}
+
+	ips, resp = listIPs("?limit=2&cursor=" + cursor)
+	if len(ips) != 1 || ips[0].Address != "10.0.0.4" {
+		t.Errorf("expected only 10.0.0.4 on the last page, got %+v", ips)
+	}
+	if resp.Header.Get("Link") != "" || resp.Header.Get("X-Next-Cursor") != "" {
+		t.Error("expected no next link on the last page")
+	}
+
+	ips, _ = listIPs("?sort=-hostname&hostname_prefix=web")
+	if len(ips) != 2 || ips[0].Hostname != "web-2" || ips[1].Hostname != "web-1" {
+		t.Errorf("expected web-2 and web-1, got %+v", ips)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"?limit=many", http.StatusBadRequest},
+		{"?limit=0", http.StatusUnprocessableEntity},
+		{"?sort=vlan", http.StatusUnprocessableEntity},
+		{"?cursor=bogus", http.StatusUnprocessableEntity},
+		{"?status=gone", http.StatusUnprocessableEntity},
+		{"?sort=-id&cursor=" + cursor, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks/1/addresses"+tt.query, "")
+		if resp.StatusCode != tt.status {
+			t.Errorf("expected status %d for %q, got %d", tt.status, tt.query, resp.StatusCode)
+		}
+	}
+
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.0.1.0/24", "gateway": "10.0.1.1"}`)
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/v1/networks?sort=-cidr&limit=1", "")
+	var networks []networkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&networks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(networks) != 1 || networks[0].CIDR != "10.0.1.0/24" || resp.Header.Get("X-Next-Cursor") == "" {
+		t.Errorf("expected 10.0.1.0/24 first with a next cursor, got %+v", networks)
+	}
+}
+
+func TestV1Search(t *testing.T) {
+	srv := newTestServer(t)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks", `{"cidr": "10.4.0.0/16", "gateway": "10.4.0.1"}`)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/1/children", `{"prefix_length": 24}`)
+	doRequest(t, http.MethodPost, srv.URL+"/api/v1/networks/2/addresses", `{"requested_ip": "10.4.0.22", "hostname": "web-1", "mac": "02:00:5e:10:00:01"}`)
+
+	type searchResponse struct {
+		Addresses []ipResponse      `json:"addresses"`
+		Networks  []networkResponse `json:"networks"`
+		Truncated bool              `json:"truncated"`
+	}
+	search := func(query string) searchResponse {
+		t.Helper()
+		resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/search"+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200 for %q, got %d", query, resp.StatusCode)
+		}
+		var result searchResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return result
+	}
+
+	result := search("?ip=10.4.0.22")
+	if len(result.Addresses) != 1 || result.Addresses[0].Hostname != "web-1" {
+		t.Errorf("expected web-1, got %+v", result.Addresses)
+	}
+	if len(result.Networks) != 1 || result.Networks[0].CIDR != "10.4.0.0/24" {
+		t.Errorf("expected the child network 10.4.0.0/24, got %+v", result.Networks)
+	}
+
+	result = search("?ip=10.4.9.9")
+	if len(result.Addresses) != 0 || len(result.Networks) != 1 || result.Networks[0].CIDR != "10.4.0.0/16" {
+		t.Errorf("expected only the parent network, got %+v", result)
+	}
+
+	for _, query := range []string{"?hostname=web-*", "?mac=02-00-5E-10-00-01", "?prefix=10.4.0.0/24"} {
+		if result := search(query); len(result.Addresses) != 1 || result.Addresses[0].Address != "10.4.0.22" {
+			t.Errorf("expected 10.4.0.22 for %q, got %+v", query, result.Addresses)
+		}
+	}
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"?ip=10.4.0", http.StatusBadRequest},
+		{"?prefix=10.4.0.0", http.StatusBadRequest},
+		{"?mac=nope", http.StatusBadRequest},
+		{"?limit=many&hostname=web-1", http.StatusBadRequest},
+		{"", http.StatusUnprocessableEntity},
+		{"?ip=10.4.0.22&hostname=web-1", http.StatusUnprocessableEntity},
+		{"?hostname=*", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, http.MethodGet, srv.URL+"/api/v1/search"+tt.query, "")
+		if resp.StatusCode != tt.status {
+			t.Errorf("expected status %d for %q, got %d", tt.status, tt.query, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import "net/http"
+
+// RegisterRoutes registers the versioned API under /api/v1 together with
+// the deprecated /network and /ip endpoints.
+func (h *IPAMHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/networks", h.createNetworkV1)
+	mux.HandleFunc("GET /api/v1/networks", h.listNetworksV1)
+	mux.HandleFunc("GET /api/v1/networks/tree", h.networkTreeV1)
+	mux.HandleFunc("GET /api/v1/networks/utilization", h.listUtilizationV1)
+	mux.HandleFunc("GET /api/v1/networks/{id}", h.getNetworkV1)
+	mux.HandleFunc("PATCH /api/v1/networks/{id}", h.updateNetworkV1)
+	mux.HandleFunc("DELETE /api/v1/networks/{id}", h.deleteNetworkV1)
+	mux.HandleFunc("POST /api/v1/networks/{id}/children", h.allocateChildNetworkV1)
+	mux.HandleFunc("GET /api/v1/networks/{id}/utilization", h.networkUtilizationV1)
+	mux.HandleFunc("GET /api/v1/networks/{id}/addresses", h.listIPsV1)
+	mux.HandleFunc("POST /api/v1/networks/{id}/addresses", h.allocateIPV1)
+	mux.HandleFunc("POST /api/v1/networks/{id}/addresses/bulk", h.allocateIPsV1)
+	mux.HandleFunc("GET /api/v1/addresses/{id}", h.getIPV1)
+	mux.HandleFunc("PATCH /api/v1/addresses/{id}", h.updateIPV1)
+	mux.HandleFunc("DELETE /api/v1/addresses/{id}", h.releaseIPV1)
+	mux.HandleFunc("PUT /api/v1/addresses/{id}/status", h.changeIPStatusV1)
+	mux.HandleFunc("PUT /api/v1/addresses/{id}/lease", h.renewLeaseV1)
+	mux.HandleFunc("GET /api/v1/search", h.searchV1)
+
+	mux.Handle("/network", deprecated(http.HandlerFunc(h.HandleNetwork), "/api/v1/networks"))
+	mux.Handle("/ip", deprecated(http.HandlerFunc(h.HandleIP), "/api/v1/addresses"))
+}
+
+// deprecated marks responses of a legacy endpoint as deprecated and
+// points clients at its replacement.
+func deprecated(next http.Handler, successor string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
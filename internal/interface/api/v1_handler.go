@@ -0,0 +1,818 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+)
+
+type ipRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type networkResponse struct {
+	ID          int               `json:"id"`
+	CIDR        string            `json:"cidr"`
+	Gateway     string            `json:"gateway"`
+	VRF         string            `json:"vrf"`
+	ParentID    *int              `json:"parent_id"`
+	Reserved    []ipRange         `json:"reserved"`
+	Strategy    string            `json:"allocation_strategy"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	VLANID      *int              `json:"vlan_id"`
+	Site        string            `json:"site"`
+	Tags        map[string]string `json:"tags"`
+}
+
+func newNetworkResponse(network *domain.Network) networkResponse {
+	response := networkResponse{
+		ID:          network.ID,
+		CIDR:        network.CIDR,
+		Gateway:     network.Gateway.String(),
+		VRF:         network.VRF,
+		ParentID:    network.ParentID,
+		Reserved:    make([]ipRange, 0, len(network.Reserved)),
+		Strategy:    string(network.Strategy),
+		Name:        network.Name,
+		Description: network.Description,
+		Site:        network.Site,
+		Tags:        network.Tags,
+	}
+	for _, r := range network.Reserved {
+		response.Reserved = append(response.Reserved, ipRange{Start: r.Start.String(), End: r.End.String()})
+	}
+	if network.VLAN != 0 {
+		vlan := network.VLAN
+		response.VLANID = &vlan
+	}
+	if response.Tags == nil {
+		response.Tags = map[string]string{}
+	}
+	return response
+}
+
+type networkTreeResponse struct {
+	networkResponse
+	Children []networkTreeResponse `json:"children"`
+}
+
+func newNetworkTreeResponse(node *domain.NetworkNode) networkTreeResponse {
+	response := networkTreeResponse{
+		networkResponse: newNetworkResponse(node.Network),
+		Children:        make([]networkTreeResponse, 0, len(node.Children)),
+	}
+	for _, child := range node.Children {
+		response.Children = append(response.Children, newNetworkTreeResponse(child))
+	}
+	return response
+}
+
+// utilizationResponse reports the utilization of a network, or of all
+// listed networks if NetworkID is zero. Counts are JSON numbers, which
+// may exceed the integers some clients can represent in IPv6 networks.
+type utilizationResponse struct {
+	NetworkID   int      `json:"network_id,omitempty"`
+	CIDR        string   `json:"cidr,omitempty"`
+	Total       *big.Int `json:"total"`
+	Allocated   *big.Int `json:"allocated"`
+	Reserved    *big.Int `json:"reserved"`
+	Free        *big.Int `json:"free"`
+	PercentUsed float64  `json:"percent_used"`
+	Level       string   `json:"level"`
+}
+
+func newUtilizationResponse(u *domain.Utilization) utilizationResponse {
+	response := utilizationResponse{
+		Total:       u.Total,
+		Allocated:   u.Allocated,
+		Reserved:    u.Reserved,
+		Free:        u.Free,
+		PercentUsed: math.Round(u.PercentUsed()*100) / 100,
+		Level:       string(u.Level),
+	}
+	if u.Network != nil {
+		response.NetworkID = u.Network.ID
+		response.CIDR = u.Network.CIDR
+	}
+	return response
+}
+
+type ipResponse struct {
+	ID             int               `json:"id"`
+	NetworkID      int               `json:"network_id"`
+	Address        string            `json:"address"`
+	Hostname       string            `json:"hostname"`
+	Status         string            `json:"status"`
+	MAC            string            `json:"mac"`
+	Description    string            `json:"description"`
+	Owner          string            `json:"owner"`
+	Tags           map[string]string `json:"tags"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	ReleasedAt     *time.Time        `json:"released_at,omitempty"`
+	LeaseExpiresAt *time.Time        `json:"lease_expires_at,omitempty"`
+}
+
+func newIPResponse(ip *domain.IPAddress) ipResponse {
+	response := ipResponse{
+		ID:             ip.ID,
+		NetworkID:      ip.NetworkID,
+		Address:        ip.Address.String(),
+		Hostname:       ip.Hostname,
+		Status:         string(ip.Status),
+		MAC:            ip.MAC.String(),
+		Description:    ip.Description,
+		Owner:          ip.Owner,
+		Tags:           ip.Tags,
+		CreatedAt:      ip.CreatedAt,
+		UpdatedAt:      ip.UpdatedAt,
+		ReleasedAt:     ip.ReleasedAt,
+		LeaseExpiresAt: ip.LeaseExpiresAt,
+	}
+	if response.Tags == nil {
+		response.Tags = map[string]string{}
+	}
+	return response
+}
+
+func (h *IPAMHandler) createNetworkV1(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		CIDR        string            `json:"cidr"`
+		Gateway     string            `json:"gateway"`
+		VRF         string            `json:"vrf"`
+		ParentID    *int              `json:"parent_id"`
+		Reserved    []ipRange         `json:"reserved"`
+		Strategy    string            `json:"allocation_strategy"`
+		Name        string            `json:"name"`
+		Description string            `json:"description"`
+		VLANID      int               `json:"vlan_id"`
+		Site        string            `json:"site"`
+		Tags        map[string]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+	gateway := net.ParseIP(request.Gateway)
+	if gateway == nil {
+		writeBadRequest(w, "Invalid gateway address")
+		return
+	}
+
+	reserved, ok := parseRanges(w, request.Reserved)
+	if !ok {
+		return
+	}
+
+	network := &domain.Network{
+		CIDR:        request.CIDR,
+		Gateway:     gateway,
+		VRF:         request.VRF,
+		ParentID:    request.ParentID,
+		Reserved:    reserved,
+		Strategy:    domain.Strategy(request.Strategy),
+		Name:        request.Name,
+		Description: request.Description,
+		VLAN:        request.VLANID,
+		Site:        request.Site,
+		Tags:        request.Tags,
+	}
+	if err := h.useCase.CreateNetwork(network); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/networks/%d", network.ID))
+	writeJSON(w, http.StatusCreated, newNetworkResponse(network))
+}
+
+func (h *IPAMHandler) listNetworksV1(w http.ResponseWriter, r *http.Request) {
+	filter, ok := networkFilter(w, r)
+	if !ok {
+		return
+	}
+	page, ok := pageParams(w, r, domain.SortByID)
+	if !ok {
+		return
+	}
+	networks, next, err := h.useCase.ListNetworks(filter, page)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setNextLink(w, r, next)
+	response := make([]networkResponse, 0, len(networks))
+	for _, network := range networks {
+		response = append(response, newNetworkResponse(network))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *IPAMHandler) getNetworkV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	network, err := h.useCase.GetNetwork(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newNetworkResponse(network))
+}
+
+func (h *IPAMHandler) updateNetworkV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Gateway     string             `json:"gateway"`
+		Reserved    *[]ipRange         `json:"reserved"`
+		Strategy    *domain.Strategy   `json:"allocation_strategy"`
+		Name        *string            `json:"name"`
+		Description *string            `json:"description"`
+		VLANID      *int               `json:"vlan_id"`
+		Site        *string            `json:"site"`
+		Tags        *map[string]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+
+	update := &domain.NetworkUpdate{
+		Strategy:    request.Strategy,
+		Name:        request.Name,
+		Description: request.Description,
+		VLAN:        request.VLANID,
+		Site:        request.Site,
+		Tags:        request.Tags,
+	}
+	if request.Gateway != "" {
+		if update.Gateway = net.ParseIP(request.Gateway); update.Gateway == nil {
+			writeBadRequest(w, "Invalid gateway address")
+			return
+		}
+	}
+	if request.Reserved != nil {
+		reserved, ok := parseRanges(w, *request.Reserved)
+		if !ok {
+			return
+		}
+		update.Reserved = &reserved
+	}
+
+	network, err := h.useCase.UpdateNetwork(id, update)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newNetworkResponse(network))
+}
+
+func (h *IPAMHandler) deleteNetworkV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		if force, err = strconv.ParseBool(value); err != nil {
+			writeBadRequest(w, "Invalid force parameter")
+			return
+		}
+	}
+
+	if err := h.useCase.DeleteNetwork(id, force); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *IPAMHandler) networkTreeV1(w http.ResponseWriter, r *http.Request) {
+	roots, err := h.useCase.NetworkTree()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := make([]networkTreeResponse, 0, len(roots))
+	for _, root := range roots {
+		response = append(response, newNetworkTreeResponse(root))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *IPAMHandler) networkUtilizationV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	u, err := h.useCase.GetUtilization(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUtilizationResponse(u))
+}
+
+func (h *IPAMHandler) listUtilizationV1(w http.ResponseWriter, r *http.Request) {
+	filter, ok := networkFilter(w, r)
+	if !ok {
+		return
+	}
+	utilization, total, err := h.useCase.ListUtilization(filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := struct {
+		Networks []utilizationResponse `json:"networks"`
+		Total    utilizationResponse   `json:"total"`
+	}{
+		Networks: make([]utilizationResponse, 0, len(utilization)),
+		Total:    newUtilizationResponse(total),
+	}
+	for _, u := range utilization {
+		response.Networks = append(response.Networks, newUtilizationResponse(u))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *IPAMHandler) allocateChildNetworkV1(w http.ResponseWriter, r *http.Request) {
+	parentID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		PrefixLength int `json:"prefix_length"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+
+	network, err := h.useCase.AllocateChildNetwork(parentID, request.PrefixLength)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/networks/%d", network.ID))
+	writeJSON(w, http.StatusCreated, newNetworkResponse(network))
+}
+
+func (h *IPAMHandler) listIPsV1(w http.ResponseWriter, r *http.Request) {
+	networkID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := h.useCase.GetNetwork(networkID); err != nil {
+		writeError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	filter := &domain.IPFilter{
+		Status:         domain.AddressStatus(query.Get("status")),
+		HostnamePrefix: query.Get("hostname_prefix"),
+	}
+	if filter.Tags, ok = parseTags(w, query["tag"]); !ok {
+		return
+	}
+	page, ok := pageParams(w, r, domain.SortByAddress)
+	if !ok {
+		return
+	}
+	ips, next, err := h.useCase.ListIPs(networkID, filter, page)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setNextLink(w, r, next)
+	response := make([]ipResponse, 0, len(ips))
+	for _, ip := range ips {
+		response = append(response, newIPResponse(ip))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *IPAMHandler) allocateIPV1(w http.ResponseWriter, r *http.Request) {
+	networkID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		RequestedIP string            `json:"requested_ip"`
+		Hostname    string            `json:"hostname"`
+		MAC         string            `json:"mac"`
+		Description string            `json:"description"`
+		Owner       string            `json:"owner"`
+		Tags        map[string]string `json:"tags"`
+		Status      string            `json:"status"`
+		// LeaseSeconds is the lifetime of the allocation, 0 for none.
+		LeaseSeconds   int    `json:"lease_seconds"`
+		IdempotencyKey string `json:"idempotency_key"`
+		// Strategy overrides the network's allocation strategy.
+		Strategy string `json:"strategy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+	key, ok := idempotencyKey(w, r, request.IdempotencyKey)
+	if !ok {
+		return
+	}
+
+	var requestedIP net.IP
+	if request.RequestedIP != "" {
+		requestedIP = net.ParseIP(request.RequestedIP)
+		if requestedIP == nil {
+			writeBadRequest(w, "Invalid IP address")
+			return
+		}
+	}
+
+	mac, ok := parseMAC(w, request.MAC)
+	if !ok {
+		return
+	}
+
+	ip, created, err := h.useCase.AllocateIP(&domain.AllocationRequest{
+		NetworkID:      networkID,
+		RequestedIP:    requestedIP,
+		Hostname:       request.Hostname,
+		MAC:            mac,
+		Description:    request.Description,
+		Owner:          request.Owner,
+		Tags:           request.Tags,
+		Status:         domain.AddressStatus(request.Status),
+		Lease:          time.Duration(request.LeaseSeconds) * time.Second,
+		IdempotencyKey: key,
+		Strategy:       domain.Strategy(request.Strategy),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// A repeated request gets the earlier allocation back.
+	if !created {
+		writeJSON(w, http.StatusOK, newIPResponse(ip))
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/addresses/%d", ip.ID))
+	writeJSON(w, http.StatusCreated, newIPResponse(ip))
+}
+
+func (h *IPAMHandler) allocateIPsV1(w http.ResponseWriter, r *http.Request) {
+	networkID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Count        int               `json:"count"`
+		Hostnames    []string          `json:"hostnames"`
+		Contiguous   bool              `json:"contiguous"`
+		Description  string            `json:"description"`
+		Owner        string            `json:"owner"`
+		Tags         map[string]string `json:"tags"`
+		Status       string            `json:"status"`
+		LeaseSeconds int               `json:"lease_seconds"`
+		Strategy     string            `json:"strategy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+
+	ips, err := h.useCase.AllocateIPs(&domain.BulkAllocationRequest{
+		NetworkID:   networkID,
+		Count:       request.Count,
+		Hostnames:   request.Hostnames,
+		Contiguous:  request.Contiguous,
+		Description: request.Description,
+		Owner:       request.Owner,
+		Tags:        request.Tags,
+		Status:      domain.AddressStatus(request.Status),
+		Lease:       time.Duration(request.LeaseSeconds) * time.Second,
+		Strategy:    domain.Strategy(request.Strategy),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := make([]ipResponse, 0, len(ips))
+	for _, ip := range ips {
+		response = append(response, newIPResponse(ip))
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+func (h *IPAMHandler) getIPV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	ip, err := h.useCase.GetIP(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newIPResponse(ip))
+}
+
+func (h *IPAMHandler) updateIPV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Hostname    *string            `json:"hostname"`
+		MAC         *string            `json:"mac"`
+		Description *string            `json:"description"`
+		Owner       *string            `json:"owner"`
+		Tags        *map[string]string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+
+	update := &domain.IPUpdate{
+		Hostname:    request.Hostname,
+		Description: request.Description,
+		Owner:       request.Owner,
+		Tags:        request.Tags,
+	}
+	if request.MAC != nil {
+		mac, ok := parseMAC(w, *request.MAC)
+		if !ok {
+			return
+		}
+		update.MAC = &mac
+	}
+
+	ip, err := h.useCase.UpdateIP(id, update)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newIPResponse(ip))
+}
+
+func (h *IPAMHandler) releaseIPV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.useCase.ReleaseIP(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *IPAMHandler) changeIPStatusV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+
+	ip, err := h.useCase.ChangeIPStatus(id, domain.AddressStatus(request.Status))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newIPResponse(ip))
+}
+
+func (h *IPAMHandler) renewLeaseV1(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		LeaseSeconds int `json:"lease_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBadRequest(w, err.Error())
+		return
+	}
+
+	ip, err := h.useCase.RenewLease(id, time.Duration(request.LeaseSeconds)*time.Second)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newIPResponse(ip))
+}
+
+func (h *IPAMHandler) searchV1(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search := &domain.SearchQuery{Hostname: query.Get("hostname")}
+	if value := query.Get("ip"); value != "" {
+		if search.IP = net.ParseIP(value); search.IP == nil {
+			writeBadRequest(w, "Invalid ip parameter")
+			return
+		}
+	}
+	if value := query.Get("prefix"); value != "" {
+		_, prefix, err := net.ParseCIDR(value)
+		if err != nil {
+			writeBadRequest(w, "Invalid prefix parameter")
+			return
+		}
+		search.Prefix = prefix
+	}
+	var ok bool
+	if search.MAC, ok = parseMAC(w, query.Get("mac")); !ok {
+		return
+	}
+	if search.Limit, ok = limitParam(w, r); !ok {
+		return
+	}
+
+	result, err := h.useCase.Search(search)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := struct {
+		Addresses []ipResponse      `json:"addresses"`
+		Networks  []networkResponse `json:"networks"`
+		Truncated bool              `json:"truncated"`
+	}{
+		Addresses: make([]ipResponse, 0, len(result.Addresses)),
+		Networks:  make([]networkResponse, 0, len(result.Networks)),
+		Truncated: result.Truncated,
+	}
+	for _, ip := range result.Addresses {
+		response.Addresses = append(response.Addresses, newIPResponse(ip))
+	}
+	for _, network := range result.Networks {
+		response.Networks = append(response.Networks, newNetworkResponse(network))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// pathID parses the {id} path segment, writing a 400 response if it is
+// not a number.
+func pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeBadRequest(w, "Invalid ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// idempotencyKey returns the key from the Idempotency-Key header or the
+// request body, writing a 400 response if both are given and differ.
+func idempotencyKey(w http.ResponseWriter, r *http.Request, field string) (string, bool) {
+	header := r.Header.Get("Idempotency-Key")
+	if header != "" && field != "" && header != field {
+		writeBadRequest(w, "Idempotency-Key header and idempotency_key field differ")
+		return "", false
+	}
+	if header != "" {
+		return header, true
+	}
+	return field, true
+}
+
+// networkFilter builds a filter from the site, vlan_id and tag query
+// parameters. Tags are given as key:value and may be repeated.
+func networkFilter(w http.ResponseWriter, r *http.Request) (*domain.NetworkFilter, bool) {
+	query := r.URL.Query()
+	filter := &domain.NetworkFilter{Site: query.Get("site")}
+	if value := query.Get("vlan_id"); value != "" {
+		vlan, err := strconv.Atoi(value)
+		if err != nil {
+			writeBadRequest(w, "Invalid vlan_id parameter")
+			return nil, false
+		}
+		filter.VLAN = vlan
+	}
+	var ok bool
+	if filter.Tags, ok = parseTags(w, query["tag"]); !ok {
+		return nil, false
+	}
+	return filter, true
+}
+
+// parseTags parses tag query parameters given as key:value, writing a 400
+// response if one is malformed.
+func parseTags(w http.ResponseWriter, params []string) (map[string]string, bool) {
+	var tags map[string]string
+	for _, tag := range params {
+		key, value, found := strings.Cut(tag, ":")
+		if !found || key == "" {
+			writeBadRequest(w, "Invalid tag parameter, expected key:value")
+			return nil, false
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = value
+	}
+	return tags, true
+}
+
+// pageParams builds a page from the limit, cursor and sort query
+// parameters. A sort key prefixed with "-" sorts in descending order.
+func pageParams(w http.ResponseWriter, r *http.Request, defaultSort domain.SortKey) (*domain.Page, bool) {
+	query := r.URL.Query()
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return nil, false
+	}
+	page := &domain.Page{Sort: defaultSort, Limit: limit, Cursor: query.Get("cursor")}
+	if value := query.Get("sort"); value != "" {
+		key, descending := strings.CutPrefix(value, "-")
+		page.Sort, page.Descending = domain.SortKey(key), descending
+	}
+	return page, true
+}
+
+// limitParam parses the limit query parameter, writing a 400 response if
+// it is not a number. It defaults to domain.DefaultPageLimit.
+func limitParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return domain.DefaultPageLimit, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		writeBadRequest(w, "Invalid limit parameter")
+		return 0, false
+	}
+	return limit, true
+}
+
+// setNextLink points the client at the next page of a listing, if there
+// is one, with a Link header and the cursor in X-Next-Cursor.
+func setNextLink(w http.ResponseWriter, r *http.Request, next string) {
+	if next == "" {
+		return
+	}
+	query := r.URL.Query()
+	query.Set("cursor", next)
+	link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Set("Link", "<"+link.String()+`>; rel="next"`)
+	w.Header().Set("X-Next-Cursor", next)
+}
+
+// parseMAC parses an optional MAC address, writing a 400 response if it
+// is malformed. An empty string yields a nil address.
+func parseMAC(w http.ResponseWriter, s string) (net.HardwareAddr, bool) {
+	if s == "" {
+		return nil, true
+	}
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		writeBadRequest(w, "Invalid MAC address")
+		return nil, false
+	}
+	return mac, true
+}
+
+func parseRanges(w http.ResponseWriter, ranges []ipRange) ([]domain.IPRange, bool) {
+	var parsed []domain.IPRange
+	for _, r := range ranges {
+		start, end := net.ParseIP(r.Start), net.ParseIP(r.End)
+		if start == nil || end == nil {
+			writeBadRequest(w, "Invalid reserved range")
+			return nil, false
+		}
+		parsed = append(parsed, domain.IPRange{Start: start, End: end})
+	}
+	return parsed, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
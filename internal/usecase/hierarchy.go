@@ -0,0 +1,69 @@
+package usecase
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+)
+
+// AllocateChildNetwork carves the first free, aligned prefix of length
+// prefixLength out of the parent network and creates it as a child. The
+// child's gateway is its first usable address.
+func (uc *IPAMUseCase) AllocateChildNetwork(parentID, prefixLength int) (*domain.Network, error) {
+	return uc.repo.AllocateChildNetwork(parentID, prefixLength)
+}
+
+// NetworkTree returns all networks arranged by parent. Networks without a
+// parent are the roots.
+func (uc *IPAMUseCase) NetworkTree() ([]*domain.NetworkNode, error) {
+	networks, _, err := uc.repo.ListNetworks(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].ID < networks[j].ID })
+
+	nodes := make(map[int]*domain.NetworkNode, len(networks))
+	for _, network := range networks {
+		nodes[network.ID] = &domain.NetworkNode{Network: network}
+	}
+
+	var roots []*domain.NetworkNode
+	for _, network := range networks {
+		node := nodes[network.ID]
+		if network.ParentID != nil {
+			if parent, ok := nodes[*network.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots, nil
+}
+
+// checkParent verifies that network fits inside its parent. A child
+// without a VRF inherits the parent's.
+func checkParent(network *domain.Network, ipNet *net.IPNet, parent *domain.Network) error {
+	if network.VRF == "" {
+		network.VRF = parent.VRF
+	}
+	if network.VRF != parent.VRF {
+		return domain.NewError(domain.ErrInvalid, "network must be in the VRF of its parent %d", parent.ID).
+			WithDetail("parent_id", strconv.Itoa(parent.ID))
+	}
+
+	_, parentNet, err := net.ParseCIDR(parent.CIDR)
+	if err != nil {
+		return fmt.Errorf("failed to parse network CIDR: %v", err)
+	}
+	parentOnes, _ := parentNet.Mask.Size()
+	ones, _ := ipNet.Mask.Size()
+	if !parentNet.Contains(ipNet.IP) || ones <= parentOnes {
+		return domain.NewError(domain.ErrInvalid, "network %s is not inside its parent %s", ipNet, parent.CIDR).
+			WithDetail("parent_id", strconv.Itoa(parent.ID))
+	}
+	return nil
+}
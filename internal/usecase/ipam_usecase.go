@@ -1,20 +1,63 @@
 package usecase
 
 import (
+	"bytes"
+	"errors"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/zinrai/ipam-mvp-go/internal/domain"
 )
 
 type IPAMUseCase struct {
-	repo domain.IPAMRepository
+	repo       domain.IPAMRepository
+	events     domain.EventPublisher
+	thresholds domain.UtilizationThresholds
 }
 
-func NewIPAMUseCase(repo domain.IPAMRepository) *IPAMUseCase {
-	return &IPAMUseCase{repo: repo}
+type Option func(*IPAMUseCase)
+
+// WithEventPublisher delivers events, such as expired leases, to p.
+func WithEventPublisher(p domain.EventPublisher) Option {
+	return func(uc *IPAMUseCase) {
+		uc.events = p
+	}
+}
+
+func NewIPAMUseCase(repo domain.IPAMRepository, opts ...Option) *IPAMUseCase {
+	uc := &IPAMUseCase{repo: repo}
+	for _, opt := range opts {
+		opt(uc)
+	}
+	return uc
 }
 
+// CreateNetwork validates network, canonicalizes its CIDR and stores it.
+// Networks in the same VRF must not overlap, except that a network lies
+// inside its parent and the parent's ancestors.
 func (uc *IPAMUseCase) CreateNetwork(network *domain.Network) error {
+	ipNet, err := validateNetwork(network)
+	if err != nil {
+		return err
+	}
+	network.CIDR = ipNet.String()
+
+	if network.ParentID != nil {
+		parent, err := uc.repo.GetNetwork(*network.ParentID)
+		if errors.Is(err, domain.ErrNotFound) {
+			return domain.NewError(domain.ErrInvalid, "parent network %d not found", *network.ParentID).
+				WithDetail("parent_id", strconv.Itoa(*network.ParentID))
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkParent(network, ipNet, parent); err != nil {
+			return err
+		}
+	}
+	// Overlaps with other networks are ruled out by the repository, which
+	// checks them atomically with the insert.
 	return uc.repo.CreateNetwork(network)
 }
 
@@ -22,26 +65,371 @@ func (uc *IPAMUseCase) GetNetwork(id int) (*domain.Network, error) {
 	return uc.repo.GetNetwork(id)
 }
 
-func (uc *IPAMUseCase) ListNetworks() ([]*domain.Network, error) {
-	return uc.repo.ListNetworks()
+// ListNetworks returns the page of networks matching filter and the
+// cursor of the next page, which is empty on the last one. A nil filter
+// matches all networks, and a nil page returns all of them.
+func (uc *IPAMUseCase) ListNetworks(filter *domain.NetworkFilter, page *domain.Page) ([]*domain.Network, string, error) {
+	if page != nil {
+		if err := page.Validate(domain.NetworkSorts); err != nil {
+			return nil, "", err
+		}
+	}
+	return uc.repo.ListNetworks(filter, page)
+}
+
+// UpdateNetwork applies update to a network after validating the result.
+func (uc *IPAMUseCase) UpdateNetwork(id int, update *domain.NetworkUpdate) (*domain.Network, error) {
+	network, err := uc.repo.GetNetwork(id)
+	if err != nil {
+		return nil, err
+	}
+	if update.Gateway != nil {
+		network.Gateway = update.Gateway
+	}
+	if update.Reserved != nil {
+		network.Reserved = *update.Reserved
+	}
+	if update.Strategy != nil {
+		network.Strategy = *update.Strategy
+	}
+	if update.Name != nil {
+		network.Name = *update.Name
+	}
+	if update.Description != nil {
+		network.Description = *update.Description
+	}
+	if update.VLAN != nil {
+		network.VLAN = *update.VLAN
+	}
+	if update.Site != nil {
+		network.Site = *update.Site
+	}
+	if update.Tags != nil {
+		network.Tags = *update.Tags
+	}
+
+	if _, err := validateNetwork(network); err != nil {
+		return nil, err
+	}
+	if err := uc.repo.UpdateNetwork(network); err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+// DeleteNetwork deletes a network that has no child networks. With force
+// its allocations are released and removed along with it.
+func (uc *IPAMUseCase) DeleteNetwork(id int, force bool) error {
+	return uc.repo.DeleteNetwork(id, force)
+}
+
+// AllocateIP allocates an address, or reserves it without a host if
+// req.Status is StatusReserved. If req repeats an earlier allocation,
+// identified by its idempotency key or by its hostname and MAC, that
+// allocation is returned instead and created is false.
+func (uc *IPAMUseCase) AllocateIP(req *domain.AllocationRequest) (ip *domain.IPAddress, created bool, err error) {
+	if status := req.InitialStatus(); status != domain.StatusAllocated && status != domain.StatusReserved {
+		return nil, false, domain.NewError(domain.ErrInvalid, "new IP addresses must be allocated or reserved, not %s", status).
+			WithDetail("status", string(status))
+	}
+	if err := validateTags(req.Tags); err != nil {
+		return nil, false, err
+	}
+	if err := validateLease(req.Lease); err != nil {
+		return nil, false, err
+	}
+	if err := validateStrategy(req.Strategy); err != nil {
+		return nil, false, err
+	}
+
+	if ip, err := uc.findAllocation(req); err != nil || ip != nil {
+		return ip, false, err
+	}
+	ip, err = uc.repo.AllocateIP(req)
+	if errors.Is(err, domain.ErrConflict) {
+		// A concurrent retry of the same request may have won the race.
+		if existing, findErr := uc.findAllocation(req); findErr == nil && existing != nil {
+			return existing, false, nil
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return ip, true, nil
+}
+
+// findAllocation returns the allocation req repeats, or nil if there is
+// none. Reusing an idempotency key for a different hostname or address is
+// a conflict.
+func (uc *IPAMUseCase) findAllocation(req *domain.AllocationRequest) (*domain.IPAddress, error) {
+	if req.IdempotencyKey != "" {
+		ip, err := uc.repo.GetIPByIdempotencyKey(req.NetworkID, req.IdempotencyKey)
+		if errors.Is(err, domain.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ip.Hostname != req.Hostname || (req.RequestedIP != nil && !ip.Address.Equal(req.RequestedIP)) {
+			return nil, domain.NewError(domain.ErrConflict, "idempotency key %s was used for a different allocation", req.IdempotencyKey).
+				WithDetail("idempotency_key", req.IdempotencyKey)
+		}
+		return ip, nil
+	}
+
+	if req.Hostname == "" || len(req.MAC) == 0 {
+		return nil, nil
+	}
+	ip, err := uc.repo.GetIPByHostname(req.NetworkID, req.Hostname)
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A different host with the same name is left to fail as a conflict.
+	if !bytes.Equal(ip.MAC, req.MAC) || (req.RequestedIP != nil && !ip.Address.Equal(req.RequestedIP)) {
+		return nil, nil
+	}
+	return ip, nil
 }
 
-func (uc *IPAMUseCase) AllocateIP(networkID int, requestedIP net.IP, hostname string) (*domain.IPAddress, error) {
-	return uc.repo.AllocateIP(networkID, requestedIP, hostname)
+// maxBulkAllocation bounds the number of addresses allocated at once.
+const maxBulkAllocation = 1024
+
+// AllocateIPs allocates Count addresses, or one per hostname, all or
+// nothing. Count may be left zero when hostnames are given.
+func (uc *IPAMUseCase) AllocateIPs(req *domain.BulkAllocationRequest) ([]*domain.IPAddress, error) {
+	if status := req.InitialStatus(); status != domain.StatusAllocated && status != domain.StatusReserved {
+		return nil, domain.NewError(domain.ErrInvalid, "new IP addresses must be allocated or reserved, not %s", status).
+			WithDetail("status", string(status))
+	}
+	if len(req.Hostnames) > 0 && req.Count != 0 && req.Count != len(req.Hostnames) {
+		return nil, domain.NewError(domain.ErrInvalid, "count %d does not match the %d hostnames given", req.Count, len(req.Hostnames)).
+			WithDetail("count", strconv.Itoa(req.Count))
+	}
+	if n := req.Size(); n < 1 || n > maxBulkAllocation {
+		return nil, domain.NewError(domain.ErrInvalid, "count must be between 1 and %d", maxBulkAllocation).
+			WithDetail("count", strconv.Itoa(n)).
+			WithDetail("limit", strconv.Itoa(maxBulkAllocation))
+	}
+
+	seen := make(map[string]bool, len(req.Hostnames))
+	for _, hostname := range req.Hostnames {
+		if hostname == "" {
+			return nil, domain.NewError(domain.ErrInvalid, "hostnames must not be empty")
+		}
+		if seen[hostname] {
+			return nil, domain.NewError(domain.ErrInvalid, "hostname %s is given more than once", hostname).
+				WithDetail("hostname", hostname)
+		}
+		seen[hostname] = true
+	}
+	if err := validateTags(req.Tags); err != nil {
+		return nil, err
+	}
+	if err := validateLease(req.Lease); err != nil {
+		return nil, err
+	}
+	if err := validateStrategy(req.Strategy); err != nil {
+		return nil, err
+	}
+	return uc.repo.AllocateIPs(req)
 }
 
+// ReleaseIP releases a reserved, allocated or deprecated address.
 func (uc *IPAMUseCase) ReleaseIP(id int) error {
+	ip, err := uc.repo.GetIP(id)
+	if err != nil {
+		return err
+	}
+	if err := domain.CheckTransition(ip.Status, domain.StatusAvailable); err != nil {
+		return err
+	}
 	return uc.repo.ReleaseIP(id)
 }
 
+// ChangeIPStatus moves an address to another status. Moving it to
+// StatusAvailable releases it.
+func (uc *IPAMUseCase) ChangeIPStatus(id int, status domain.AddressStatus) (*domain.IPAddress, error) {
+	if !status.Valid() {
+		return nil, domain.NewError(domain.ErrInvalid, "unknown status %q", status).WithDetail("status", string(status))
+	}
+	ip, err := uc.repo.GetIP(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := domain.CheckTransition(ip.Status, status); err != nil {
+		return nil, err
+	}
+
+	if status == domain.StatusAvailable {
+		err = uc.repo.ReleaseIP(id)
+	} else {
+		err = uc.repo.UpdateIPStatus(id, ip.Status, status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return uc.repo.GetIP(id)
+}
+
+// RenewLease extends the lease of an address to lease from now. Addresses
+// allocated without a lease cannot be renewed.
+func (uc *IPAMUseCase) RenewLease(id int, lease time.Duration) (*domain.IPAddress, error) {
+	if lease <= 0 {
+		return nil, domain.NewError(domain.ErrInvalid, "lease must be positive").
+			WithDetail("lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	ip, err := uc.repo.GetIP(id)
+	if err != nil {
+		return nil, err
+	}
+	if ip.LeaseExpiresAt == nil {
+		return nil, domain.NewError(domain.ErrConflict, "IP address %d has no lease", id)
+	}
+	if err := uc.repo.RenewLease(id, time.Now().Add(lease)); err != nil {
+		return nil, err
+	}
+	return uc.repo.GetIP(id)
+}
+
+// ExpireLeases releases the addresses whose lease has expired and
+// publishes an EventLeaseExpired for each. It returns the number of
+// addresses released.
+func (uc *IPAMUseCase) ExpireLeases() (int, error) {
+	now := time.Now()
+	expired, err := uc.repo.ExpireLeases(now)
+	if err != nil {
+		return 0, err
+	}
+	if uc.events != nil {
+		for _, ip := range expired {
+			uc.events.Publish(domain.Event{Type: domain.EventLeaseExpired, Time: now, IP: ip})
+		}
+	}
+	return len(expired), nil
+}
+
 func (uc *IPAMUseCase) GetIP(id int) (*domain.IPAddress, error) {
 	return uc.repo.GetIP(id)
 }
 
-func (uc *IPAMUseCase) ListIPs(networkID int) ([]*domain.IPAddress, error) {
-	return uc.repo.ListIPs(networkID)
+// ListIPs returns the page of addresses in a network matching filter like
+// ListNetworks.
+func (uc *IPAMUseCase) ListIPs(networkID int, filter *domain.IPFilter, page *domain.Page) ([]*domain.IPAddress, string, error) {
+	if filter != nil && filter.Status != "" && !filter.Status.Valid() {
+		return nil, "", domain.NewError(domain.ErrInvalid, "unknown status %q", filter.Status).WithDetail("status", string(filter.Status))
+	}
+	if page != nil {
+		if err := page.Validate(domain.IPSorts); err != nil {
+			return nil, "", err
+		}
+	}
+	return uc.repo.ListIPs(networkID, filter, page)
+}
+
+// Search finds address records and networks across all networks by IP,
+// prefix, hostname or MAC.
+func (uc *IPAMUseCase) Search(query *domain.SearchQuery) (*domain.SearchResult, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	return uc.repo.Search(query)
+}
+
+// UpdateIP applies update to an IP address and returns the result.
+func (uc *IPAMUseCase) UpdateIP(id int, update *domain.IPUpdate) (*domain.IPAddress, error) {
+	ip, err := uc.repo.GetIP(id)
+	if err != nil {
+		return nil, err
+	}
+	if ip.Status.Released() {
+		return nil, domain.NewError(domain.ErrConflict, "IP address %d has been released", id).
+			WithDetail("status", string(ip.Status))
+	}
+	if update.Hostname != nil {
+		ip.Hostname = *update.Hostname
+	}
+	if update.MAC != nil {
+		ip.MAC = *update.MAC
+	}
+	if update.Description != nil {
+		ip.Description = *update.Description
+	}
+	if update.Owner != nil {
+		ip.Owner = *update.Owner
+	}
+	if update.Tags != nil {
+		ip.Tags = *update.Tags
+	}
+
+	if err := validateTags(ip.Tags); err != nil {
+		return nil, err
+	}
+	if err := uc.repo.UpdateIP(ip); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+func validateNetwork(network *domain.Network) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(network.CIDR)
+	if err != nil {
+		return nil, domain.NewError(domain.ErrInvalid, "invalid CIDR %s", network.CIDR).WithDetail("cidr", network.CIDR)
+	}
+
+	gateway := network.Gateway
+	switch {
+	case gateway == nil:
+		return nil, domain.NewError(domain.ErrInvalid, "gateway is required")
+	case !ipNet.Contains(gateway):
+		return nil, domain.NewError(domain.ErrInvalid, "gateway %s is outside network %s", gateway, ipNet).
+			WithDetail("gateway", gateway.String())
+	case domain.IsNetworkOrBroadcast(ipNet, gateway) || domain.IsSubnetRouterAnycast(ipNet, gateway):
+		return nil, domain.NewError(domain.ErrInvalid, "gateway %s cannot be the network or broadcast address", gateway).
+			WithDetail("gateway", gateway.String())
+	}
+
+	if err := domain.ValidateReserved(network, ipNet); err != nil {
+		return nil, err
+	}
+
+	// VLAN IDs 0 and 4095 are reserved by 802.1Q; 0 means no VLAN here.
+	if network.VLAN < 0 || network.VLAN > 4094 {
+		return nil, domain.NewError(domain.ErrInvalid, "invalid VLAN ID %d", network.VLAN).
+			WithDetail("vlan", strconv.Itoa(network.VLAN))
+	}
+	if err := validateTags(network.Tags); err != nil {
+		return nil, err
+	}
+	if err := validateStrategy(network.Strategy); err != nil {
+		return nil, err
+	}
+	return ipNet, nil
+}
+
+func validateTags(tags map[string]string) error {
+	for key := range tags {
+		if key == "" {
+			return domain.NewError(domain.ErrInvalid, "tag keys must not be empty")
+		}
+	}
+	return nil
+}
+
+func validateLease(lease time.Duration) error {
+	if lease < 0 {
+		return domain.NewError(domain.ErrInvalid, "lease must not be negative").
+			WithDetail("lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	return nil
 }
 
-func (uc *IPAMUseCase) UpdateIPHostname(id int, hostname string) error {
-	return uc.repo.UpdateIPHostname(id, hostname)
+func validateStrategy(strategy domain.Strategy) error {
+	if !strategy.Valid() {
+		return domain.NewError(domain.ErrInvalid, "unknown allocation strategy %q", strategy).
+			WithDetail("strategy", string(strategy))
+	}
+	return nil
 }
@@ -0,0 +1,660 @@
+package usecase
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zinrai/ipam-mvp-go/internal/domain"
+	"github.com/zinrai/ipam-mvp-go/internal/infrastructure/memory"
+)
+
+func newTestUseCase(t *testing.T) *IPAMUseCase {
+	t.Helper()
+	repo, err := memory.NewIPAMRepository("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return NewIPAMUseCase(repo)
+}
+
+func TestCreateNetworkValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		gateway string
+	}{
+		{"Invalid CIDR", "10.0.0.0/33", "10.0.0.1"},
+		{"Missing gateway", "10.0.0.0/24", ""},
+		{"Gateway outside network", "10.0.0.0/24", "10.0.1.1"},
+		{"Gateway is network address", "10.0.0.0/24", "10.0.0.0"},
+		{"Gateway is broadcast address", "10.0.0.0/24", "10.0.0.255"},
+		{"Gateway is subnet-router anycast", "2001:db8::/64", "2001:db8::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := newTestUseCase(t)
+			network := &domain.Network{CIDR: tt.cidr, Gateway: net.ParseIP(tt.gateway)}
+			if err := uc.CreateNetwork(network); !errors.Is(err, domain.ErrInvalid) {
+				t.Errorf("expected ErrInvalid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateNetworkCanonicalizesCIDR(t *testing.T) {
+	uc := newTestUseCase(t)
+	network := &domain.Network{CIDR: "10.0.0.5/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, err := uc.GetNetwork(network.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stored.CIDR != "10.0.0.0/24" {
+		t.Errorf("expected CIDR 10.0.0.0/24, got %s", stored.CIDR)
+	}
+}
+
+func TestCreateNetworkOverlap(t *testing.T) {
+	uc := newTestUseCase(t)
+	if err := uc.CreateNetwork(&domain.Network{CIDR: "10.0.0.0/16", Gateway: net.ParseIP("10.0.0.1")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, cidr := range []string{"10.0.0.0/16", "10.0.4.0/24", "10.0.0.0/8"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		network := &domain.Network{CIDR: cidr, Gateway: domain.NextIP(ipNet.IP)}
+		if err := uc.CreateNetwork(network); !errors.Is(err, domain.ErrConflict) {
+			t.Errorf("%s: expected ErrConflict, got %v", cidr, err)
+		}
+	}
+
+	if err := uc.CreateNetwork(&domain.Network{CIDR: "10.1.0.0/16", Gateway: net.ParseIP("10.1.0.1")}); err != nil {
+		t.Errorf("unexpected error for an adjacent network: %v", err)
+	}
+	if err := uc.CreateNetwork(&domain.Network{CIDR: "10.0.4.0/24", Gateway: net.ParseIP("10.0.4.1"), VRF: "blue"}); err != nil {
+		t.Errorf("unexpected error for an overlapping network in another VRF: %v", err)
+	}
+	if err := uc.CreateNetwork(&domain.Network{CIDR: "10.0.4.128/25", Gateway: net.ParseIP("10.0.4.129"), VRF: "blue"}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict within the same VRF, got %v", err)
+	}
+}
+
+func TestCreateChildNetwork(t *testing.T) {
+	uc := newTestUseCase(t)
+	parent := &domain.Network{CIDR: "10.0.0.0/16", Gateway: net.ParseIP("10.0.0.1"), VRF: "blue"}
+	if err := uc.CreateNetwork(parent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	child := &domain.Network{CIDR: "10.0.1.0/24", Gateway: net.ParseIP("10.0.1.1"), ParentID: &parent.ID}
+	if err := uc.CreateNetwork(child); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if child.VRF != "blue" {
+		t.Errorf("expected the child to inherit VRF blue, got %q", child.VRF)
+	}
+
+	tests := []struct {
+		name    string
+		network *domain.Network
+		kind    error
+	}{
+		{"Outside parent", &domain.Network{CIDR: "10.1.0.0/24", Gateway: net.ParseIP("10.1.0.1"), ParentID: &parent.ID}, domain.ErrInvalid},
+		{"Same size as parent", &domain.Network{CIDR: "10.0.0.0/16", Gateway: net.ParseIP("10.0.0.1"), ParentID: &parent.ID}, domain.ErrInvalid},
+		{"Unknown parent", &domain.Network{CIDR: "10.0.2.0/24", Gateway: net.ParseIP("10.0.2.1"), ParentID: new(int)}, domain.ErrInvalid},
+		{"Overlapping sibling", &domain.Network{CIDR: "10.0.1.128/25", Gateway: net.ParseIP("10.0.1.129"), ParentID: &parent.ID}, domain.ErrConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := uc.CreateNetwork(tt.network); !errors.Is(err, tt.kind) {
+				t.Errorf("expected %v, got %v", tt.kind, err)
+			}
+		})
+	}
+
+	// Nested below the child, which overlaps both ancestors.
+	grandchild := &domain.Network{CIDR: "10.0.1.128/25", Gateway: net.ParseIP("10.0.1.129"), ParentID: &child.ID}
+	if err := uc.CreateNetwork(grandchild); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAllocateChildNetwork(t *testing.T) {
+	uc := newTestUseCase(t)
+	parent := &domain.Network{CIDR: "10.0.0.0/22", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(parent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	existing := &domain.Network{CIDR: "10.0.0.0/26", Gateway: net.ParseIP("10.0.0.1"), ParentID: &parent.ID}
+	if err := uc.CreateNetwork(existing); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tt := range []struct {
+		prefixLength int
+		want         string
+	}{
+		{24, "10.0.1.0/24"},
+		{26, "10.0.0.64/26"},
+		{25, "10.0.0.128/25"},
+		{23, "10.0.2.0/23"},
+	} {
+		network, err := uc.AllocateChildNetwork(parent.ID, tt.prefixLength)
+		if err != nil {
+			t.Fatalf("/%d: unexpected error: %v", tt.prefixLength, err)
+		}
+		if network.CIDR != tt.want {
+			t.Errorf("/%d: expected %s, got %s", tt.prefixLength, tt.want, network.CIDR)
+		}
+		if network.ParentID == nil || *network.ParentID != parent.ID {
+			t.Errorf("/%d: expected parent %d, got %v", tt.prefixLength, parent.ID, network.ParentID)
+		}
+	}
+
+	if _, err := uc.AllocateChildNetwork(parent.ID, 24); !errors.Is(err, domain.ErrExhausted) {
+		t.Errorf("expected ErrExhausted, got %v", err)
+	}
+	if _, err := uc.AllocateChildNetwork(parent.ID, 22); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a prefix as large as the parent, got %v", err)
+	}
+}
+
+func TestAllocateChildNetworkPrefixLengths(t *testing.T) {
+	tests := []struct {
+		name         string
+		cidr         string
+		gateway      string
+		prefixLength int
+		want         string
+		wantGateway  string
+	}{
+		{"IPv4 point-to-point", "10.0.0.0/24", "10.0.0.1", 31, "10.0.0.0/31", "10.0.0.1"},
+		{"IPv6 point-to-point", "2001:db8::/64", "2001:db8::1", 127, "2001:db8::/127", "2001:db8::1"},
+		{"IPv4 host route", "10.0.0.0/24", "10.0.0.1", 32, "", ""},
+		{"IPv6 host route", "2001:db8::/64", "2001:db8::1", 128, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := newTestUseCase(t)
+			parent := &domain.Network{CIDR: tt.cidr, Gateway: net.ParseIP(tt.gateway)}
+			if err := uc.CreateNetwork(parent); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			network, err := uc.AllocateChildNetwork(parent.ID, tt.prefixLength)
+			if tt.want == "" {
+				if !errors.Is(err, domain.ErrInvalid) {
+					t.Errorf("expected ErrInvalid, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if network.CIDR != tt.want || network.Gateway.String() != tt.wantGateway {
+				t.Errorf("expected %s with gateway %s, got %s with gateway %s", tt.want, tt.wantGateway, network.CIDR, network.Gateway)
+			}
+		})
+	}
+}
+
+func TestNetworkTree(t *testing.T) {
+	uc := newTestUseCase(t)
+	parent := &domain.Network{CIDR: "10.0.0.0/16", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(parent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := uc.AllocateChildNetwork(parent.ID, 24); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.CreateNetwork(&domain.Network{CIDR: "192.168.0.0/24", Gateway: net.ParseIP("192.168.0.1")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	roots, err := uc.NetworkTree()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(roots) != 2 || len(roots[0].Children) != 1 || len(roots[1].Children) != 0 {
+		t.Fatalf("unexpected tree %+v", roots)
+	}
+	if roots[0].Children[0].Network.CIDR != "10.0.0.0/24" {
+		t.Errorf("expected child 10.0.0.0/24, got %s", roots[0].Children[0].Network.CIDR)
+	}
+}
+
+func TestUpdateNetwork(t *testing.T) {
+	uc := newTestUseCase(t)
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := uc.UpdateNetwork(network.ID, &domain.NetworkUpdate{Gateway: net.ParseIP("10.0.1.1")}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a gateway outside the network, got %v", err)
+	}
+
+	reserved := []domain.IPRange{{Start: net.ParseIP("10.0.0.2"), End: net.ParseIP("10.0.0.9")}}
+	updated, err := uc.UpdateNetwork(network.ID, &domain.NetworkUpdate{Reserved: &reserved})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !updated.Gateway.Equal(network.Gateway) || len(updated.Reserved) != 1 {
+		t.Errorf("expected only the reserved ranges to change, got %+v", updated)
+	}
+}
+
+func TestDeleteNetworkWithChildren(t *testing.T) {
+	uc := newTestUseCase(t)
+	parent := &domain.Network{CIDR: "10.0.0.0/16", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(parent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	child, err := uc.AllocateChildNetwork(parent.ID, 24)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := uc.DeleteNetwork(parent.ID, true); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict deleting a network with children, got %v", err)
+	}
+	if err := uc.DeleteNetwork(child.ID, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := uc.DeleteNetwork(parent.ID, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNetworkMetadataValidation(t *testing.T) {
+	uc := newTestUseCase(t)
+	for _, network := range []*domain.Network{
+		{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1"), VLAN: 4095},
+		{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1"), VLAN: -1},
+		{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1"), Tags: map[string]string{"": "prod"}},
+	} {
+		if err := uc.CreateNetwork(network); !errors.Is(err, domain.ErrInvalid) {
+			t.Errorf("expected ErrInvalid for %+v, got %v", network, err)
+		}
+	}
+
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1"), VLAN: 100, Site: "tokyo"}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	name, vlan := "office", 0
+	updated, err := uc.UpdateNetwork(network.ID, &domain.NetworkUpdate{Name: &name, VLAN: &vlan})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.Name != "office" || updated.VLAN != 0 || updated.Site != "tokyo" {
+		t.Errorf("expected name and VLAN to change, got %+v", updated)
+	}
+}
+
+func TestUpdateIP(t *testing.T) {
+	uc := newTestUseCase(t)
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ip, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a", Owner: "infra"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	description := "Build server"
+	updated, err := uc.UpdateIP(ip.ID, &domain.IPUpdate{Description: &description})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.Description != description || updated.Hostname != "host-a" || updated.Owner != "infra" {
+		t.Errorf("expected only the description to change, got %+v", updated)
+	}
+
+	tags := map[string]string{"": "x"}
+	if _, err := uc.UpdateIP(ip.ID, &domain.IPUpdate{Tags: &tags}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for an empty tag key, got %v", err)
+	}
+	if _, err := uc.UpdateIP(4242, &domain.IPUpdate{Description: &description}); !errors.Is(err, domain.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAddressStatusLifecycle(t *testing.T) {
+	uc := newTestUseCase(t)
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Status: domain.StatusDeprecated}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid creating a deprecated address, got %v", err)
+	}
+
+	ip, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Status: domain.StatusReserved})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := uc.ChangeIPStatus(ip.ID, domain.StatusDeprecated); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict deprecating a reserved address, got %v", err)
+	}
+
+	for _, status := range []domain.AddressStatus{domain.StatusAllocated, domain.StatusDeprecated, domain.StatusAvailable} {
+		ip, err = uc.ChangeIPStatus(ip.ID, status)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", status, err)
+		}
+		if ip.Status != status {
+			t.Errorf("expected status %s, got %s", status, ip.Status)
+		}
+	}
+
+	if err := uc.ReleaseIP(ip.ID); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict releasing a released address, got %v", err)
+	}
+	owner := "web"
+	if _, err := uc.UpdateIP(ip.ID, &domain.IPUpdate{Owner: &owner}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict updating a released address, got %v", err)
+	}
+	if _, err := uc.ChangeIPStatus(ip.ID, "retired"); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for an unknown status, got %v", err)
+	}
+}
+
+func TestAllocateIPsValidation(t *testing.T) {
+	uc := newTestUseCase(t)
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		req  *domain.BulkAllocationRequest
+	}{
+		{"No addresses", &domain.BulkAllocationRequest{}},
+		{"Too many addresses", &domain.BulkAllocationRequest{Count: 100000}},
+		{"Count does not match hostnames", &domain.BulkAllocationRequest{Count: 3, Hostnames: []string{"node-1", "node-2"}}},
+		{"Duplicate hostname", &domain.BulkAllocationRequest{Hostnames: []string{"node-1", "node-1"}}},
+		{"Empty hostname", &domain.BulkAllocationRequest{Hostnames: []string{"node-1", ""}}},
+		{"Deprecated status", &domain.BulkAllocationRequest{Count: 2, Status: domain.StatusDeprecated}},
+		{"Empty tag key", &domain.BulkAllocationRequest{Count: 2, Tags: map[string]string{"": "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.NetworkID = network.ID
+			if _, err := uc.AllocateIPs(tt.req); !errors.Is(err, domain.ErrInvalid) {
+				t.Errorf("expected ErrInvalid, got %v", err)
+			}
+		})
+	}
+
+	ips, err := uc.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 2, Hostnames: []string{"node-1", "node-2"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 2 {
+		t.Errorf("expected 2 addresses, got %d", len(ips))
+	}
+}
+
+type recordingPublisher struct {
+	events []domain.Event
+}
+
+func (p *recordingPublisher) Publish(event domain.Event) {
+	p.events = append(p.events, event)
+}
+
+func TestLeases(t *testing.T) {
+	repo, err := memory.NewIPAMRepository("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := &recordingPublisher{}
+	uc := NewIPAMUseCase(repo, WithEventPublisher(events))
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "ci-1", Lease: -time.Second}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a negative lease, got %v", err)
+	}
+	permanent, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := uc.RenewLease(permanent.ID, time.Hour); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict renewing an address without a lease, got %v", err)
+	}
+
+	leased, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "ci-1", Lease: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := uc.RenewLease(leased.ID, 0); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid renewing for no time, got %v", err)
+	}
+	renewed, err := uc.RenewLease(leased.ID, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !renewed.LeaseExpiresAt.Before(*leased.LeaseExpiresAt) {
+		t.Errorf("expected the lease to be shortened, got %v", renewed.LeaseExpiresAt)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	n, err := uc.ExpireLeases()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 1 || len(events.events) != 1 {
+		t.Fatalf("expected 1 expired lease and event, got %d and %d", n, len(events.events))
+	}
+	if event := events.events[0]; event.Type != domain.EventLeaseExpired || event.IP.Hostname != "ci-1" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestIdempotentAllocation(t *testing.T) {
+	uc := newTestUseCase(t)
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := &domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a", IdempotencyKey: "req-1"}
+	first, created, err := uc.AllocateIP(req)
+	if err != nil || !created {
+		t.Fatalf("expected a new allocation, got created=%v (%v)", created, err)
+	}
+	again, created, err := uc.AllocateIP(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if created || again.ID != first.ID {
+		t.Errorf("expected the retry to return IP %d, got %d (created=%v)", first.ID, again.ID, created)
+	}
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-b", IdempotencyKey: "req-1"}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict reusing a key for another host, got %v", err)
+	}
+
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	withMAC := &domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-c", MAC: mac}
+	first, _, err = uc.AllocateIP(withMAC)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	again, created, err = uc.AllocateIP(withMAC)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if created || again.ID != first.ID {
+		t.Errorf("expected the same hostname and MAC to return IP %d, got %d (created=%v)", first.ID, again.ID, created)
+	}
+
+	otherMAC, _ := net.ParseMAC("52:54:00:65:43:21")
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-c", MAC: otherMAC}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict for the hostname of another host, got %v", err)
+	}
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-c"}); !errors.Is(err, domain.ErrConflict) {
+		t.Errorf("expected ErrConflict for a duplicate hostname without MAC, got %v", err)
+	}
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	uc := newTestUseCase(t)
+	if err := uc.CreateNetwork(&domain.Network{CIDR: "10.0.1.0/24", Gateway: net.ParseIP("10.0.1.1"), Strategy: "round_robin"}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for an unknown network strategy, got %v", err)
+	}
+
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1"), Strategy: domain.StrategyLastFree}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ip, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address.String() != "10.0.0.254" {
+		t.Errorf("expected the network strategy to pick 10.0.0.254, got %s", ip.Address)
+	}
+	ip, _, err = uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-b", Strategy: domain.StrategyFirstFree})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address.String() != "10.0.0.2" {
+		t.Errorf("expected the requested strategy to pick 10.0.0.2, got %s", ip.Address)
+	}
+
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: network.ID, Hostname: "host-c", Strategy: "round_robin"}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for an unknown strategy, got %v", err)
+	}
+	if _, err := uc.AllocateIPs(&domain.BulkAllocationRequest{NetworkID: network.ID, Count: 2, Strategy: "round_robin"}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for an unknown bulk strategy, got %v", err)
+	}
+	bad := domain.Strategy("round_robin")
+	if _, err := uc.UpdateNetwork(network.ID, &domain.NetworkUpdate{Strategy: &bad}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid updating to an unknown strategy, got %v", err)
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	repo, err := memory.NewIPAMRepository("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	uc := NewIPAMUseCase(repo, WithUtilizationThresholds(domain.UtilizationThresholds{Warning: 50, Critical: 90}))
+
+	parent := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(parent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	child, err := uc.AllocateChildNetwork(parent.ID, 29)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The /29 has 5 usable addresses besides its gateway.
+	for i := 0; i < 3; i++ {
+		if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: child.ID}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	u, err := uc.GetUtilization(child.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.PercentUsed() != 60 || u.Level != domain.UtilizationWarning {
+		t.Errorf("expected 60%% used at level warning, got %v%% at %s", u.PercentUsed(), u.Level)
+	}
+
+	networks, total, err := uc.ListUtilization(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(networks) != 2 || networks[0].Level != domain.UtilizationOK {
+		t.Fatalf("expected 2 networks with the parent at level ok, got %+v", networks)
+	}
+	if total.Total.Int64() != 5 || total.Allocated.Int64() != 3 {
+		t.Errorf("expected the total to cover only the child, got total %s, allocated %s", total.Total, total.Allocated)
+	}
+
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: child.ID}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := uc.AllocateIP(&domain.AllocationRequest{NetworkID: child.ID}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u, err = uc.GetUtilization(child.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.Level != domain.UtilizationCritical {
+		t.Errorf("expected a full network at level critical, got %s", u.Level)
+	}
+}
+
+func TestListingValidation(t *testing.T) {
+	uc := newTestUseCase(t)
+	network := &domain.Network{CIDR: "10.0.0.0/24", Gateway: net.ParseIP("10.0.0.1")}
+	if err := uc.CreateNetwork(network); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cidrCursor := (&domain.Cursor{Sort: domain.SortByCIDR, Key: "10.0.0.0/24", ID: 1}).Encode()
+
+	tests := []struct {
+		name   string
+		filter *domain.IPFilter
+		page   *domain.Page
+	}{
+		{"Unknown sort", nil, &domain.Page{Sort: domain.SortByCIDR, Limit: 10}},
+		{"Zero limit", nil, &domain.Page{Sort: domain.SortByAddress}},
+		{"Limit too large", nil, &domain.Page{Sort: domain.SortByAddress, Limit: domain.MaxPageLimit + 1}},
+		{"Malformed cursor", nil, &domain.Page{Sort: domain.SortByAddress, Limit: 10, Cursor: "not a cursor"}},
+		{"Cursor of another order", nil, &domain.Page{Sort: domain.SortByAddress, Limit: 10, Cursor: cidrCursor}},
+		{"Unknown status", &domain.IPFilter{Status: "gone"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := uc.ListIPs(network.ID, tt.filter, tt.page); !errors.Is(err, domain.ErrInvalid) {
+				t.Errorf("expected ErrInvalid, got %v", err)
+			}
+		})
+	}
+
+	if _, _, err := uc.ListNetworks(nil, &domain.Page{Sort: domain.SortByCIDR, Limit: 10, Cursor: cidrCursor}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err := uc.ListNetworks(nil, &domain.Page{Sort: domain.SortByHostname, Limit: 10}); !errors.Is(err, domain.ErrInvalid) {
+		t.Errorf("expected ErrInvalid for a network sort by hostname, got %v", err)
+	}
+}
+
+func TestSearchValidation(t *testing.T) {
+	uc := newTestUseCase(t)
+	_, prefix, _ := net.ParseCIDR("10.0.0.0/24")
+	tests := []struct {
+		name  string
+		query *domain.SearchQuery
+	}{
+		{"Nothing to search for", &domain.SearchQuery{Limit: 10}},
+		{"IP and hostname", &domain.SearchQuery{IP: net.ParseIP("10.0.0.2"), Hostname: "web-1", Limit: 10}},
+		{"Only wildcards", &domain.SearchQuery{Hostname: "**", Limit: 10}},
+		{"Zero limit", &domain.SearchQuery{Prefix: prefix}},
+		{"Limit too large", &domain.SearchQuery{Prefix: prefix, Limit: domain.MaxPageLimit + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := uc.Search(tt.query); !errors.Is(err, domain.ErrInvalid) {
+				t.Errorf("expected ErrInvalid, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package usecase
+
+import "github.com/zinrai/ipam-mvp-go/internal/domain"
+
+// WithUtilizationThresholds grades the utilization of networks against t.
+func WithUtilizationThresholds(t domain.UtilizationThresholds) Option {
+	return func(uc *IPAMUseCase) {
+		uc.thresholds = t
+	}
+}
+
+// GetUtilization reports how much of a network is in use.
+func (uc *IPAMUseCase) GetUtilization(id int) (*domain.Utilization, error) {
+	u, err := uc.repo.GetUtilization(id)
+	if err != nil {
+		return nil, err
+	}
+	u.Level = uc.thresholds.Level(u)
+	return u, nil
+}
+
+// ListUtilization reports how much of each network matching filter is in
+// use, along with their sum. Networks that others in the list were carved
+// from are left out of the sum, so no address is counted twice.
+func (uc *IPAMUseCase) ListUtilization(filter *domain.NetworkFilter) ([]*domain.Utilization, *domain.Utilization, error) {
+	utilization, err := uc.repo.ListUtilization(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parents := make(map[int]bool)
+	for _, u := range utilization {
+		if u.Network.ParentID != nil {
+			parents[*u.Network.ParentID] = true
+		}
+	}
+	total := domain.NewUtilizationSum()
+	for _, u := range utilization {
+		u.Level = uc.thresholds.Level(u)
+		if !parents[u.Network.ID] {
+			total.Add(u)
+		}
+	}
+	total.Level = uc.thresholds.Level(total)
+	return utilization, total, nil
+}